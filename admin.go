@@ -0,0 +1,443 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/corazawaf/coraza/v3"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI serves the introspection endpoints of the WAFs in the pool
+// under /coraza/ on the admin API:
+//
+//	GET /coraza/wafs              lists the WAFs
+//	GET /coraza/wafs/<key>        describes a WAF
+//	GET /coraza/wafs/<key>/rules  lists the rules of a WAF
+//
+// and manage the runtime overrides of a WAF:
+//
+//	GET|DELETE   /coraza/wafs/<key>/overrides                 lists or removes them all
+//	PUT|DELETE   /coraza/wafs/<key>/overrides/rule_engine     switches the rule engine
+//	POST|DELETE  /coraza/wafs/<key>/overrides/disabled_rules  disables rules
+//
+// Overrides apply to every site using the WAF, or to the server and host
+// given in the request body only.
+//
+// WAFs are listed until every config referencing them is unloaded, the
+// sites are those of the running config.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.coraza",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/coraza/", Handler: caddy.AdminHandlerFunc(a.serveHTTP)},
+	}
+}
+
+// wafInfo describes a pooled WAF.
+type wafInfo struct {
+	Key string `json:"key"`
+	// References is the number of handlers and profiles of the loaded
+	// configs holding the WAF.
+	References    int         `json:"references"`
+	Rules         int         `json:"rules"`
+	CRSVersion    string      `json:"crs_version,omitempty"`
+	BuiltAt       time.Time   `json:"built_at"`
+	BuildDuration string      `json:"build_duration"`
+	Watch         bool        `json:"watch"`
+	Sites         []wafSite   `json:"sites"`
+	Counters      wafCounters `json:"counters"`
+	// Overrides are the changes made to the WAF through the admin API.
+	Overrides *overridesInfo `json:"overrides,omitempty"`
+}
+
+// wafSite is a handler of the running config using a WAF.
+type wafSite struct {
+	Server string   `json:"server"`
+	Hosts  []string `json:"hosts,omitempty"`
+	// Profile is the profile the handler uses the WAF through.
+	Profile string `json:"profile,omitempty"`
+	// Shadow tells the WAF is the shadow rule set of the handler.
+	Shadow bool `json:"shadow,omitempty"`
+}
+
+type wafCounters struct {
+	Transactions uint64 `json:"transactions"`
+	Skipped      uint64 `json:"skipped"`
+	Interrupted  uint64 `json:"interrupted"`
+}
+
+// ruleInfo describes a rule of a WAF.
+type ruleInfo struct {
+	ID       int      `json:"id"`
+	Phase    string   `json:"phase"`
+	Severity string   `json:"severity,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	File     string   `json:"file,omitempty"`
+	Line     int      `json:"line,omitempty"`
+}
+
+func (a adminAPI) serveHTTP(w http.ResponseWriter, r *http.Request) error {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/coraza/"), "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "wafs" || len(parts) > 4 {
+		return errUnknownEndpoint(r)
+	}
+	if len(parts) == 1 {
+		if err := allowMethods(r, http.MethodGet); err != nil {
+			return err
+		}
+		return writeJSON(w, listWAFs())
+	}
+
+	pooled, waf := lookupWAF(parts[1])
+	if pooled == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown WAF %q", parts[1]),
+		}
+	}
+	switch strings.Join(parts[2:], "/") {
+	case "":
+		if err := allowMethods(r, http.MethodGet); err != nil {
+			return err
+		}
+		return writeJSON(w, describeWAF(pooled, waf, wafSites(caddy.ActiveContext())[waf]))
+	case "rules":
+		if err := allowMethods(r, http.MethodGet); err != nil {
+			return err
+		}
+		return writeJSON(w, listRules(waf))
+	case "overrides":
+		return serveOverrides(w, r, pooled.overrides)
+	case "overrides/rule_engine":
+		return serveEngineOverride(w, r, pooled.overrides)
+	case "overrides/disabled_rules":
+		return serveDisabledRules(w, r, pooled.overrides)
+	}
+	return errUnknownEndpoint(r)
+}
+
+func errUnknownEndpoint(r *http.Request) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("unknown endpoint %s", r.URL.Path),
+	}
+}
+
+// allowMethods returns an API error if r uses none of methods.
+func allowMethods(r *http.Request, methods ...string) error {
+	for _, m := range methods {
+		if r.Method == m {
+			return nil
+		}
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method %s not allowed", r.Method),
+	}
+}
+
+// decodeBody decodes the JSON body of r into v.
+func decodeBody(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+	return nil
+}
+
+// serveOverrides describes the overrides of a WAF on GET, and removes them
+// all on DELETE.
+func serveOverrides(w http.ResponseWriter, r *http.Request, o *wafOverrides) error {
+	if err := allowMethods(r, http.MethodGet, http.MethodDelete); err != nil {
+		return err
+	}
+	if r.Method == http.MethodDelete {
+		o.clear()
+	}
+	info := o.info()
+	if info == nil {
+		info = &overridesInfo{}
+	}
+	return writeJSON(w, info)
+}
+
+// engineOverrideRequest is the body of PUT
+// /coraza/wafs/<key>/overrides/rule_engine.
+type engineOverrideRequest struct {
+	overrideScope
+	// Mode is the rule engine to switch to, On or DetectionOnly.
+	Mode string `json:"mode"`
+	// TTL is how long the override lasts, until removed if zero.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+	// Persist keeps the override across config reloads.
+	Persist bool `json:"persist,omitempty"`
+}
+
+// serveEngineOverride switches the rule engine of a WAF on PUT, and
+// restores the configured one on DELETE, for every site or the server and
+// host of the body.
+func serveEngineOverride(w http.ResponseWriter, r *http.Request, o *wafOverrides) error {
+	if err := allowMethods(r, http.MethodPut, http.MethodDelete); err != nil {
+		return err
+	}
+	if r.Method == http.MethodDelete {
+		var scope overrideScope
+		if r.ContentLength != 0 {
+			if err := decodeBody(r, &scope); err != nil {
+				return err
+			}
+		}
+		o.clearEngine(scope)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	var req engineOverrideRequest
+	if err := decodeBody(r, &req); err != nil {
+		return err
+	}
+	if req.TTL < 0 {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("negative ttl")}
+	}
+	if err := o.setEngine(req.overrideScope, req.Mode, time.Duration(req.TTL), req.Persist); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// disabledRulesRequest is the body of POST and DELETE
+// /coraza/wafs/<key>/overrides/disabled_rules.
+type disabledRulesRequest struct {
+	overrideScope
+	// IDs are the rules to disable, or to enable again. Deleting with no
+	// IDs enables every rule disabled at runtime for the scope.
+	IDs []int `json:"ids"`
+	// TTL is how long the rules stay disabled, until enabled again if
+	// zero.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+	// Persist keeps the rules disabled across config reloads.
+	Persist bool `json:"persist,omitempty"`
+}
+
+// serveDisabledRules disables rules of a WAF on POST, and enables them
+// again on DELETE.
+func serveDisabledRules(w http.ResponseWriter, r *http.Request, o *wafOverrides) error {
+	if err := allowMethods(r, http.MethodPost, http.MethodDelete); err != nil {
+		return err
+	}
+	if r.Method == http.MethodDelete && r.ContentLength == 0 {
+		o.enableRules(overrideScope{}, nil)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	var req disabledRulesRequest
+	if err := decodeBody(r, &req); err != nil {
+		return err
+	}
+	if r.Method == http.MethodDelete {
+		o.enableRules(req.overrideScope, req.IDs)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if len(req.IDs) == 0 {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("no rule IDs")}
+	}
+	if req.TTL < 0 {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("negative ttl")}
+	}
+	for _, id := range req.IDs {
+		if id <= 0 {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("invalid rule ID %d", id)}
+		}
+	}
+	o.disableRules(req.overrideScope, req.IDs, time.Duration(req.TTL), req.Persist)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// listWAFs describes the WAFs of the pool, sorted by key.
+func listWAFs() []wafInfo {
+	sites := wafSites(caddy.ActiveContext())
+
+	infos := []wafInfo{}
+	wafPool.Range(func(key, value any) bool {
+		p := value.(*pooledWAF)
+		waf := p.current()
+		if waf == nil {
+			// Destructed.
+			return true
+		}
+		infos = append(infos, describeWAF(p, waf, sites[waf]))
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos
+}
+
+// describeWAF describes p, whose WAF is waf, used by sites.
+func describeWAF(p *pooledWAF, waf coraza.WAF, sites []wafSite) wafInfo {
+	info := wafInfo{
+		Key:        p.key,
+		CRSVersion: p.crsVersion,
+		Sites:      sites,
+		Counters: wafCounters{
+			Transactions: p.stats.transactions.Load(),
+			Skipped:      p.stats.skipped.Load(),
+			Interrupted:  p.stats.interrupted.Load(),
+		},
+		Overrides: p.overrides.info(),
+	}
+	if info.Sites == nil {
+		info.Sites = []wafSite{}
+	}
+	info.References, _ = wafPool.References(p.key)
+	_, info.Watch = waf.(*reloadableWAF)
+	if c := compiled(waf); c != nil {
+		info.Rules = countRules(c)
+		info.BuiltAt = c.builtAt
+		info.BuildDuration = c.buildDuration.String()
+	}
+	return info
+}
+
+// lookupWAF returns the entry of the pool stored under key and its WAF,
+// nil if there is none.
+func lookupWAF(key string) (*pooledWAF, coraza.WAF) {
+	var (
+		found *pooledWAF
+		waf   coraza.WAF
+	)
+	wafPool.Range(func(k, value any) bool {
+		if k != key {
+			return true
+		}
+		p := value.(*pooledWAF)
+		if waf = p.current(); waf != nil {
+			found = p
+		}
+		return false
+	})
+	return found, waf
+}
+
+// countRules returns the number of rules of w, SecMarkers aside.
+func countRules(w *compiledWAF) int {
+	return len(withoutMarkers(w.rules))
+}
+
+// listRules describes the rules of waf.
+func listRules(waf coraza.WAF) []ruleInfo {
+	rules := []ruleInfo{}
+	for _, r := range withoutMarkers(wafRules(waf)) {
+		info := ruleInfo{
+			ID:    r.ID(),
+			Phase: phaseName(r.Phase()),
+			Tags:  r.Tags(),
+			File:  r.File(),
+			Line:  r.Line(),
+		}
+		if s := r.Severity(); s.Int() >= 0 {
+			info.Severity = s.String()
+		}
+		rules = append(rules, info)
+	}
+	return rules
+}
+
+// wafSites returns the handlers of the http app of ctx by the WAF they
+// use.
+func wafSites(ctx caddy.Context) map[coraza.WAF][]wafSite {
+	sites := map[coraza.WAF][]wafSite{}
+	app, err := ctx.AppIfConfigured("http")
+	if err != nil {
+		return sites
+	}
+	servers := app.(*caddyhttp.App).Servers
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		srv := servers[name]
+		visit := func(m *corazaModule, hosts []string) {
+			if m.waf != nil {
+				sites[m.waf] = append(sites[m.waf], wafSite{Server: name, Hosts: hosts, Profile: m.Use})
+			}
+			if m.Shadow != nil && m.Shadow.waf != nil {
+				sites[m.Shadow.waf] = append(sites[m.Shadow.waf], wafSite{Server: name, Hosts: hosts, Shadow: true})
+			}
+		}
+		walkWAFHandlers(srv.Routes, nil, visit)
+		if srv.Errors != nil {
+			walkWAFHandlers(srv.Errors.Routes, nil, visit)
+		}
+	}
+	return sites
+}
+
+// walkWAFHandlers calls visit with every WAF handler of routes, subroutes
+// included, along with the hosts the routes leading to it match.
+func walkWAFHandlers(routes caddyhttp.RouteList, hosts []string, visit func(*corazaModule, []string)) {
+	for _, route := range routes {
+		routeHosts := hosts
+		for _, set := range route.MatcherSets {
+			for _, matcher := range set {
+				switch h := matcher.(type) {
+				case caddyhttp.MatchHost:
+					routeHosts = append(routeHosts[:len(routeHosts):len(routeHosts)], h...)
+				case *caddyhttp.MatchHost:
+					routeHosts = append(routeHosts[:len(routeHosts):len(routeHosts)], *h...)
+				}
+			}
+		}
+		for _, handler := range route.Handlers {
+			switch h := handler.(type) {
+			case *corazaModule:
+				visit(h, routeHosts)
+			case *caddyhttp.Subroute:
+				walkWAFHandlers(h.Routes, routeHosts, visit)
+			}
+		}
+	}
+}
+
+var (
+	_ caddy.Module      = (*adminAPI)(nil)
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
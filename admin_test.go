@@ -0,0 +1,179 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(`{
+		admin localhost:%d
+		auto_https off
+		order coraza_waf first
+	}
+
+	:8080 {
+		route /api/* {
+			coraza_waf {
+				directives `+"`"+`
+					SecRuleEngine On
+					SecMarker BEGIN
+					SecRule REQUEST_URI "/blocked" "id:1,phase:1,deny,status:403,severity:CRITICAL,tag:test"
+					SecRule ARGS "@contains attack" "id:2,phase:2,deny,status:403"
+				`+"`"+`
+			}
+		}
+		respond "ok"
+	}`, caddytest.Default.AdminPort), "caddyfile")
+
+	req, _ := http.NewRequest("GET", baseURL+"/api/blocked", nil)
+	tester.AssertResponseCode(req, 403)
+	req, _ = http.NewRequest("GET", baseURL+"/api/fine", nil)
+	tester.AssertResponseCode(req, 200)
+
+	adminURL := fmt.Sprintf("http://localhost:%d/coraza/wafs", caddytest.Default.AdminPort)
+	get := func(t *testing.T, url string, status int, v any) {
+		t.Helper()
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, status, resp.StatusCode, string(body))
+		if v != nil {
+			require.NoError(t, json.Unmarshal(body, v))
+		}
+	}
+
+	var wafs []wafInfo
+	get(t, adminURL, http.StatusOK, &wafs)
+	require.Len(t, wafs, 1)
+	info := wafs[0]
+	require.NotEmpty(t, info.Key)
+	require.Equal(t, 2, info.Rules, "the SecMarker is not a rule")
+	require.False(t, info.BuiltAt.IsZero())
+	require.NotEmpty(t, info.BuildDuration)
+	require.False(t, info.Watch)
+	require.Equal(t, []wafSite{{Server: "srv0"}}, info.Sites)
+	require.Equal(t, wafCounters{Transactions: 2, Interrupted: 1}, info.Counters)
+
+	t.Run("waf", func(t *testing.T) {
+		var got wafInfo
+		get(t, adminURL+"/"+info.Key, http.StatusOK, &got)
+		require.Equal(t, info.Key, got.Key)
+		require.Equal(t, info.Counters, got.Counters)
+	})
+
+	t.Run("rules", func(t *testing.T) {
+		var rules []ruleInfo
+		get(t, adminURL+"/"+info.Key+"/rules", http.StatusOK, &rules)
+		require.Len(t, rules, 2)
+		require.Equal(t, 1, rules[0].ID)
+		require.Equal(t, "request_headers", rules[0].Phase)
+		require.Equal(t, "critical", rules[0].Severity)
+		require.Equal(t, []string{"test"}, rules[0].Tags)
+		require.Equal(t, 2, rules[1].ID)
+		require.Equal(t, "request_body", rules[1].Phase)
+	})
+
+	t.Run("unknown WAF", func(t *testing.T) {
+		get(t, adminURL+"/unknown", http.StatusNotFound, nil)
+		get(t, adminURL+"/unknown/rules", http.StatusNotFound, nil)
+	})
+
+	t.Run("unknown endpoint", func(t *testing.T) {
+		get(t, adminURL+"/"+info.Key+"/other", http.StatusNotFound, nil)
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		overridesURL := adminURL + "/" + info.Key + "/overrides"
+		send := func(t *testing.T, method, url, body string, status int) {
+			t.Helper()
+			req, _ := http.NewRequest(method, url, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			require.Equal(t, status, resp.StatusCode, string(b))
+		}
+		blocked, _ := http.NewRequest("GET", baseURL+"/api/blocked", nil)
+
+		send(t, http.MethodPut, overridesURL+"/rule_engine", `{"mode": "DetectionOnly", "ttl": "1h"}`, http.StatusNoContent)
+		tester.AssertResponseCode(blocked, 200)
+		var overrides overridesInfo
+		get(t, overridesURL, http.StatusOK, &overrides)
+		require.Len(t, overrides.RuleEngines, 1)
+		require.Equal(t, "DetectionOnly", overrides.RuleEngines[0].Mode)
+		require.NotNil(t, overrides.RuleEngines[0].Expires)
+		send(t, http.MethodDelete, overridesURL+"/rule_engine", "", http.StatusNoContent)
+		tester.AssertResponseCode(blocked, 403)
+
+		// Overrides scoped to another site leave this one alone.
+		send(t, http.MethodPut, overridesURL+"/rule_engine", `{"mode": "DetectionOnly", "host": "other.localhost"}`, http.StatusNoContent)
+		send(t, http.MethodPost, overridesURL+"/disabled_rules", `{"ids": [1], "server": "other"}`, http.StatusNoContent)
+		tester.AssertResponseCode(blocked, 403)
+		send(t, http.MethodPut, overridesURL+"/rule_engine", `{"mode": "DetectionOnly", "server": "srv0", "host": "127.0.0.1"}`, http.StatusNoContent)
+		tester.AssertResponseCode(blocked, 200)
+		send(t, http.MethodDelete, overridesURL+"/rule_engine", `{"server": "srv0", "host": "127.0.0.1"}`, http.StatusNoContent)
+		tester.AssertResponseCode(blocked, 403)
+		send(t, http.MethodDelete, overridesURL, "", http.StatusOK)
+
+		send(t, http.MethodPost, overridesURL+"/disabled_rules", `{"ids": [1], "persist": true}`, http.StatusNoContent)
+		tester.AssertResponseCode(blocked, 200)
+		var got wafInfo
+		get(t, adminURL+"/"+info.Key, http.StatusOK, &got)
+		require.Equal(t, &overridesInfo{DisabledRules: []disabledRuleInfo{{ID: 1, Persist: true}}}, got.Overrides)
+		send(t, http.MethodDelete, overridesURL+"/disabled_rules", `{"ids": [1]}`, http.StatusNoContent)
+		tester.AssertResponseCode(blocked, 403)
+
+		send(t, http.MethodPost, overridesURL+"/disabled_rules", `{"ids": [1]}`, http.StatusNoContent)
+		send(t, http.MethodDelete, overridesURL, "", http.StatusOK)
+		tester.AssertResponseCode(blocked, 403)
+
+		send(t, http.MethodPut, overridesURL+"/rule_engine", `{"mode": "Off"}`, http.StatusBadRequest)
+		send(t, http.MethodPut, overridesURL+"/rule_engine", `{"mode": "On", "unknown": 1}`, http.StatusBadRequest)
+		send(t, http.MethodPost, overridesURL+"/disabled_rules", `{"ids": []}`, http.StatusBadRequest)
+		send(t, http.MethodPost, overridesURL+"/rule_engine", `{"mode": "On"}`, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestWalkWAFHandlers(t *testing.T) {
+	top := &corazaModule{}
+	nested := &corazaModule{}
+	routes := caddyhttp.RouteList{
+		{
+			MatcherSets: caddyhttp.MatcherSets{{caddyhttp.MatchHost{"example.com"}}},
+			Handlers: []caddyhttp.MiddlewareHandler{
+				top,
+				&caddyhttp.Subroute{Routes: caddyhttp.RouteList{
+					{
+						MatcherSets: caddyhttp.MatcherSets{{&caddyhttp.MatchHost{"api.example.com"}}},
+						Handlers:    []caddyhttp.MiddlewareHandler{nested},
+					},
+				}},
+			},
+		},
+	}
+
+	visited := map[*corazaModule][]string{}
+	walkWAFHandlers(routes, nil, func(m *corazaModule, hosts []string) {
+		visited[m] = hosts
+	})
+	require.Equal(t, map[*corazaModule][]string{
+		top:    {"example.com"},
+		nested: {"example.com", "api.example.com"},
+	}, visited)
+}
@@ -0,0 +1,285 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+	httpcaddyfile.RegisterGlobalOption("coraza", parseGlobalOption)
+}
+
+// App defines named WAF profiles that any number of WAF handlers can refer
+// to with their use field. Every profile is compiled once and all the
+// handlers referring to it share that single instance.
+//
+// The app also holds the WAFs of every handler of the config until it
+// starts: they are only registered in the pool then, so that validating a
+// config, or loading one that fails, has no effect on the running WAFs.
+// Configs with WAF handlers and no coraza app get an empty one for that
+// purpose, loaded by the first handler provisioned.
+type App struct {
+	// Profiles are the WAF configurations handlers can refer to, by name.
+	Profiles map[string]*corazaModule `json:"profiles,omitempty"`
+
+	wafs map[string]*configWAF
+	// handlerLogger is the logger of the WAF handlers of the config, audit
+	// records are written to once the config starts.
+	handlerLogger *zap.Logger
+}
+
+// configWAF is a WAF used by the config of the app.
+type configWAF struct {
+	pooled *pooledWAF
+	// shared is set when pooled is the WAF of the running config, taken
+	// from the pool.
+	shared bool
+	// registered is set once the app holds a reference in the pool.
+	registered bool
+}
+
+// CaddyModule returns the Caddy module information.
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "coraza",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision implements caddy.Provisioner, it compiles every profile.
+func (a *App) Provision(ctx caddy.Context) error {
+	a.handlerLogger = ctx.Logger(corazaModule{})
+
+	names := make([]string, 0, len(a.Profiles))
+	for name := range a.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := a.Profiles[name]
+		if p == nil {
+			return fmt.Errorf("WAF profile %q: empty profile", name)
+		}
+		if p.Use != "" {
+			return fmt.Errorf("WAF profile %q: profiles cannot use other profiles", name)
+		}
+		if len(p.Exclusions) > 0 || p.Shadow != nil || p.hasHandlerSettings() {
+			return fmt.Errorf("WAF profile %q: exclusions, shadow rule sets and handler settings such as sample_rate, skip, transaction_id, block_response and collections belong to the coraza_waf handlers using the profile", name)
+		}
+		if err := p.Provision(ctx); err != nil {
+			return fmt.Errorf("WAF profile %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Start implements caddy.App, it registers the WAFs of the config in the
+// pool, drops the runtime overrides of the WAFs taken over from the
+// running config and switches audit logs to the loggers of the config.
+func (a *App) Start() error {
+	for key, w := range a.wafs {
+		val, _, err := wafPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+			return w.pooled, nil
+		})
+		if err != nil {
+			return err
+		}
+		w.registered = true
+		if val != w.pooled {
+			// The running config can only be unloaded once this one
+			// started, both configs agree on the pool entry.
+			return fmt.Errorf("WAF %s was replaced in the pool while the config was loading", key)
+		}
+	}
+	for _, w := range a.wafs {
+		if w.shared {
+			w.pooled.overrides.reload()
+		}
+	}
+	if a.handlerLogger != nil {
+		auditLogger.Store(a.handlerLogger)
+	}
+	return nil
+}
+
+// Stop implements caddy.App.
+func (a *App) Stop() error { return nil }
+
+// Cleanup implements caddy.CleanerUpper, it releases the WAFs of the
+// config, closing the ones that never made it to the pool.
+func (a *App) Cleanup() error {
+	var errs []error
+	for name, p := range a.Profiles {
+		if p == nil {
+			continue
+		}
+		if err := p.Cleanup(); err != nil {
+			errs = append(errs, fmt.Errorf("WAF profile %q: %w", name, err))
+		}
+	}
+	for key, w := range a.wafs {
+		var err error
+		switch {
+		case w.registered:
+			_, err = wafPool.Delete(key)
+		case !w.shared:
+			err = w.pooled.Destruct()
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// loadWAF returns the WAF m is configured with: the one of the running
+// config if it was built out of the same configuration, a new one
+// otherwise. Handlers of the config with the same configuration share it.
+func (a *App) loadWAF(m *corazaModule) (*pooledWAF, error) {
+	if w, ok := a.wafs[m.poolKey]; ok {
+		return w.pooled, nil
+	}
+
+	w := &configWAF{}
+	if pooled := lookupPooledWAF(m.poolKey); pooled != nil {
+		m.logger.Info("reusing existing WAF instance from pool")
+		w.pooled, w.shared = pooled, true
+	} else {
+		pooled, err := newPooledWAF(m)
+		if err != nil {
+			return nil, err
+		}
+		w.pooled = pooled
+	}
+
+	if a.wafs == nil {
+		a.wafs = map[string]*configWAF{}
+	}
+	a.wafs[m.poolKey] = w
+	return w.pooled, nil
+}
+
+// configApp returns the coraza app of the config ctx belongs to, loading
+// an empty one if the config has none, or nil if ctx is not part of a
+// config, as in tests.
+func configApp(ctx caddy.Context) (*App, error) {
+	app, err := ctx.AppIfConfigured("coraza")
+	if err == nil {
+		return app.(*App), nil
+	}
+	if !errors.Is(err, caddy.ErrNotConfigured) {
+		return nil, err
+	}
+
+	// Handlers are provisioned by the http app, it is missing from
+	// contexts that are not part of a config only.
+	if _, err := ctx.AppIfConfigured("http"); errors.Is(err, caddy.ErrNotConfigured) {
+		return nil, nil
+	}
+	app, err = ctx.App("coraza")
+	if err != nil {
+		return nil, err
+	}
+	return app.(*App), nil
+}
+
+// useProfile makes the module share the WAF of the profile it uses.
+func (m *corazaModule) useProfile(ctx caddy.Context) error {
+	if m.Directives != "" || len(m.Include) > 0 || m.LoadOWASPCRS || m.CRS != nil || m.Watch {
+		return fmt.Errorf("use %q cannot be combined with directives, include, load_owasp_crs, crs or watch", m.Use)
+	}
+
+	app, err := ctx.AppIfConfigured("coraza")
+	if err != nil {
+		return fmt.Errorf("using WAF profile %q: %v", m.Use, err)
+	}
+	profile, ok := app.(*App).Profiles[m.Use]
+	if !ok || profile == nil {
+		return fmt.Errorf("unknown WAF profile %q", m.Use)
+	}
+
+	m.waf, m.stats, m.overrides = profile.waf, profile.stats, profile.overrides
+	m.logger.Debug("using WAF profile", zap.String("profile", m.Use))
+	return nil
+}
+
+// parseGlobalOption parses the coraza global option. Syntax:
+//
+//	coraza {
+//	    profile <name> {
+//	        load_owasp_crs
+//	        directives <directives>
+//	        watch [<interval>]
+//	    }
+//	}
+//
+// Profiles accept the same subdirectives as the coraza_waf directive,
+// except for use, skip, exclude, shadow, sample_rate, block_response,
+// collections and the transaction_id options.
+func parseGlobalOption(d *caddyfile.Dispenser, existingVal any) (any, error) {
+	app := new(App)
+	if existing, ok := existingVal.(httpcaddyfile.App); ok {
+		if err := json.Unmarshal(existing.Value, app); err != nil {
+			return nil, d.Errf("decoding existing coraza options: %v", err)
+		}
+	}
+	if app.Profiles == nil {
+		app.Profiles = map[string]*corazaModule{}
+	}
+
+	d.Next() // consume option name
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "profile":
+			var name string
+			if !d.Args(&name) {
+				return nil, d.ArgErr()
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if _, ok := app.Profiles[name]; ok {
+				return nil, d.Errf("WAF profile %q already defined", name)
+			}
+
+			p := new(corazaModule)
+			if err := p.unmarshalBlock(d, nil); err != nil {
+				return nil, err
+			}
+			if p.Use != "" {
+				return nil, d.Errf("WAF profile %q: profiles cannot use other profiles", name)
+			}
+			app.Profiles[name] = p
+		default:
+			return nil, d.Errf("unrecognized coraza option %q", d.Val())
+		}
+	}
+
+	return httpcaddyfile.App{
+		Name:  "coraza",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// Interface guards
+var (
+	_ caddy.App          = (*App)(nil)
+	_ caddy.Provisioner  = (*App)(nil)
+	_ caddy.CleanerUpper = (*App)(nil)
+)
@@ -0,0 +1,260 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseGlobalOption(t *testing.T) {
+	tests := map[string]struct {
+		config    string
+		profiles  []string
+		shouldErr bool
+	}{
+		"valid profiles": {
+			config: `coraza {
+				profile strict {
+					load_owasp_crs
+					directives ` + "`SecRuleEngine On`" + `
+				}
+				profile api {
+					directives ` + "`SecRuleEngine DetectionOnly`" + `
+				}
+			}`,
+			profiles: []string{"api", "strict"},
+		},
+		"profile without name": {
+			config: `coraza {
+				profile {
+					load_owasp_crs
+				}
+			}`,
+			shouldErr: true,
+		},
+		"duplicated profile": {
+			config: `coraza {
+				profile strict
+				profile strict
+			}`,
+			shouldErr: true,
+		},
+		"profile using another profile": {
+			config: `coraza {
+				profile strict {
+					use api
+				}
+			}`,
+			shouldErr: true,
+		},
+		"invalid profile subdirective": {
+			config: `coraza {
+				profile strict {
+					unknown_key
+				}
+			}`,
+			shouldErr: true,
+		},
+		"unknown option": {
+			config: `coraza {
+				unknown_key
+			}`,
+			shouldErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			val, err := parseGlobalOption(caddyfile.NewTestDispenser(test.config), nil)
+			if test.shouldErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			app := new(App)
+			require.NoError(t, json.Unmarshal(val.(httpcaddyfile.App).Value, app))
+			var names []string
+			for name := range app.Profiles {
+				names = append(names, name)
+			}
+			require.ElementsMatch(t, test.profiles, names)
+		})
+	}
+}
+
+func TestParseGlobalOptionMergesExistingProfiles(t *testing.T) {
+	first, err := parseGlobalOption(caddyfile.NewTestDispenser(`coraza {
+		profile strict {
+			directives `+"`SecRuleEngine On`"+`
+		}
+	}`), nil)
+	require.NoError(t, err)
+
+	second, err := parseGlobalOption(caddyfile.NewTestDispenser(`coraza {
+		profile api {
+			directives `+"`SecRuleEngine On`"+`
+		}
+	}`), first)
+	require.NoError(t, err)
+
+	app := new(App)
+	require.NoError(t, json.Unmarshal(second.(httpcaddyfile.App).Value, app))
+	require.Contains(t, app.Profiles, "strict")
+	require.Contains(t, app.Profiles, "api")
+
+	_, err = parseGlobalOption(caddyfile.NewTestDispenser(`coraza {
+		profile api
+	}`), second)
+	require.Error(t, err)
+}
+
+func TestUseProfileErrors(t *testing.T) {
+	newCtx := func(t *testing.T) caddy.Context {
+		t.Helper()
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	t.Run("combined with directives", func(t *testing.T) {
+		m := &corazaModule{Use: "strict", Directives: "SecRuleEngine On"}
+		err := m.Provision(newCtx(t))
+		require.ErrorContains(t, err, "cannot be combined")
+	})
+
+	t.Run("without coraza app", func(t *testing.T) {
+		m := &corazaModule{Use: "strict"}
+		err := m.Provision(newCtx(t))
+		require.ErrorContains(t, err, `using WAF profile "strict"`)
+	})
+
+	t.Run("cleanup without pool entry", func(t *testing.T) {
+		m := &corazaModule{Use: "strict", logger: zap.NewNop()}
+		require.NoError(t, m.Cleanup())
+	})
+}
+
+func TestAppProvisionRejectsNestedProfiles(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	app := &App{Profiles: map[string]*corazaModule{
+		"strict": {Use: "api"},
+	}}
+	require.ErrorContains(t, app.Provision(ctx), "profiles cannot use other profiles")
+}
+
+func TestSitesShareProfile(t *testing.T) {
+	directives := `SecRule REQUEST_URI "/blocked" "id:1,phase:1,deny,status:403"`
+
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(`{
+		admin localhost:%d
+		auto_https off
+		order coraza_waf first
+		coraza {
+			profile strict {
+				directives `+"`%s`"+`
+			}
+		}
+	}
+
+	http://a.localhost:8080 {
+		coraza_waf {
+			use strict
+		}
+		respond "a"
+	}
+
+	http://b.localhost:8080 {
+		coraza_waf {
+			use strict
+		}
+		respond "b"
+	}`, caddytest.Default.AdminPort, directives), "caddyfile")
+
+	for _, host := range []string{"a.localhost", "b.localhost"} {
+		req, _ := http.NewRequest("GET", baseURL+"/blocked", nil)
+		req.Host = host
+		tester.AssertResponseCode(req, 403)
+
+		req, _ = http.NewRequest("GET", baseURL+"/allowed", nil)
+		req.Host = host
+		tester.AssertResponseCode(req, 200)
+	}
+
+	// The profile is compiled once, by the coraza app, the handlers do not
+	// hold references of their own.
+	profile := &corazaModule{Directives: directives}
+	refs, ok := wafPool.References(profile.computePoolKey())
+	require.True(t, ok)
+	require.Equal(t, 1, refs)
+}
+
+func TestAppRegistersWAFsOnStart(t *testing.T) {
+	newModule := func() *corazaModule {
+		m := &corazaModule{Directives: "SecRuleEngine On", logger: zap.NewNop()}
+		m.poolKey = m.computePoolKey()
+		return m
+	}
+
+	t.Run("started", func(t *testing.T) {
+		app := new(App)
+		first, err := app.loadWAF(newModule())
+		require.NoError(t, err)
+		second, err := app.loadWAF(newModule())
+		require.NoError(t, err)
+		require.Same(t, first, second, "handlers of a config should share their WAF")
+
+		_, exists := wafPool.References(first.key)
+		require.False(t, exists, "the WAF should not be registered before the config starts")
+
+		require.NoError(t, app.Start())
+		refs, exists := wafPool.References(first.key)
+		require.True(t, exists)
+		require.Equal(t, 1, refs)
+
+		// The next config reuses the WAF of the running one.
+		first.overrides.disableRules(overrideScope{}, []int{1}, 0, false)
+		next := new(App)
+		reused, err := next.loadWAF(newModule())
+		require.NoError(t, err)
+		require.Same(t, first, reused)
+		require.NoError(t, next.Cleanup())
+		refs, _ = wafPool.References(first.key)
+		require.Equal(t, 1, refs, "a config that never started should leave the running WAF alone")
+		require.NotNil(t, first.overrides.info(), "a config that never started should keep the overrides")
+
+		next = new(App)
+		_, err = next.loadWAF(newModule())
+		require.NoError(t, err)
+		require.NoError(t, next.Start())
+		require.Nil(t, first.overrides.info(), "the overrides should be dropped once the next config starts")
+		require.NoError(t, next.Cleanup())
+
+		require.NoError(t, app.Cleanup())
+		_, exists = wafPool.References(first.key)
+		require.False(t, exists)
+	})
+
+	t.Run("never started", func(t *testing.T) {
+		app := new(App)
+		pooled, err := app.loadWAF(newModule())
+		require.NoError(t, err)
+		require.NoError(t, app.Cleanup())
+		require.Nil(t, pooled.waf, "the WAF of a config that never started should be closed")
+	})
+}
@@ -0,0 +1,513 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+func init() {
+	// SecAuditLogFormat ECS and SecAuditLogFormat CEF, Coraza already
+	// provides OCSF.
+	plugins.RegisterAuditLogFormatter("ecs", ecsFormatter{})
+	plugins.RegisterAuditLogFormatter("cef", cefFormatter{})
+}
+
+// auditInterruptions are the interruptions of the transactions being
+// logged, by transaction ID. Coraza leaves the action taken out of audit
+// logs, and formats only get to see the ID of the transaction.
+var auditInterruptions = struct {
+	sync.Mutex
+	byID map[string]*loggedTransaction
+}{byID: map[string]*loggedTransaction{}}
+
+// loggedTransaction is the transaction being logged under an ID.
+type loggedTransaction struct {
+	// mu serializes the logging phase of transactions sharing the ID, such
+	// as IDs taken from a request header, for the interruption to be the
+	// one of the transaction being formatted.
+	mu           sync.Mutex
+	interruption *types.Interruption
+	users        int
+}
+
+// interruptionFormatWAFs counts the compiled WAFs whose audit logs use a
+// format reading the interruption of the transactions, ECS or CEF. Until
+// there is one, processLogging leaves auditInterruptions alone.
+var interruptionFormatWAFs atomic.Int64
+
+// interruptionFormatRegex matches the directives setting such a format.
+var interruptionFormatRegex = regexp.MustCompile(`(?i)^\s*SecAuditLogFormat\s+["']?(ecs|cef)["']?\s*$`)
+
+// logsInterruptions reports whether the rules of m set an audit log format
+// reading the interruption of the transactions.
+func (m *corazaModule) logsInterruptions() bool {
+	var found bool
+	w := &directiveWalker{
+		root:         ruleFS(m.LoadOWASPCRS),
+		skipEmbedded: true,
+		onDirective: func(d directive) error {
+			if interruptionFormatRegex.MatchString(d.text) {
+				found = true
+				return errStopWalking
+			}
+			return nil
+		},
+	}
+	// Walking errors are reported when compiling.
+	if err := w.walkString(m.Directives); err == nil {
+		for _, inc := range m.Include {
+			if err := w.walkInclude(inc, ""); err != nil {
+				break
+			}
+		}
+	}
+	return found
+}
+
+// processLogging runs the logging phase of tx, making its interruption
+// available to the audit log formats.
+func processLogging(tx types.Transaction) {
+	if interruptionFormatWAFs.Load() == 0 {
+		tx.ProcessLogging()
+		return
+	}
+
+	id := tx.ID()
+	auditInterruptions.Lock()
+	l := auditInterruptions.byID[id]
+	if l == nil {
+		l = &loggedTransaction{}
+		auditInterruptions.byID[id] = l
+	}
+	l.users++
+	auditInterruptions.Unlock()
+
+	l.mu.Lock()
+	l.interruption = tx.Interruption()
+	tx.ProcessLogging()
+	l.interruption = nil
+	l.mu.Unlock()
+
+	auditInterruptions.Lock()
+	if l.users--; l.users == 0 {
+		delete(auditInterruptions.byID, id)
+	}
+	auditInterruptions.Unlock()
+}
+
+// loggedInterruption returns the interruption of the transaction with the
+// given ID being logged by the calling goroutine, if any.
+func loggedInterruption(id string) *types.Interruption {
+	auditInterruptions.Lock()
+	defer auditInterruptions.Unlock()
+	if l := auditInterruptions.byID[id]; l != nil {
+		return l.interruption
+	}
+	return nil
+}
+
+// auditRecord is the data of an audit log the formats have in common.
+type auditRecord struct {
+	al          plugintypes.AuditLog
+	action      string
+	status      int
+	ruleIDs     []int
+	severities  []string
+	tags        []string
+	messages    []plugintypes.AuditLogMessageData
+	severity    types.RuleSeverity
+	disruptive  plugintypes.AuditLogMessageData
+	serverName  string
+	requestURI  string
+	method      string
+	httpVersion string
+}
+
+func newAuditRecord(al plugintypes.AuditLog) *auditRecord {
+	tx := al.Transaction()
+	r := &auditRecord{
+		al:         al,
+		action:     "pass",
+		severity:   types.RuleSeverityUnset,
+		serverName: tx.ServerID(),
+	}
+	if tx.HasRequest() {
+		r.requestURI = tx.Request().URI()
+		r.method = tx.Request().Method()
+		r.httpVersion = strings.TrimPrefix(tx.Request().Protocol(), "HTTP/")
+	}
+	if tx.HasResponse() {
+		r.status = tx.Response().Status()
+	}
+
+	var ruleID int
+	if it := loggedInterruption(tx.ID()); it != nil {
+		r.action = it.Action
+		r.status = obtainStatusCodeFromInterruptionOrDefault(it, r.status)
+		ruleID = it.RuleID
+	} else if tx.IsInterrupted() {
+		r.action = "interrupted"
+	}
+
+	seenIDs := map[int]bool{}
+	seenTags := map[string]bool{}
+	for _, m := range al.Messages() {
+		d := m.Data()
+		// Messages of part H without part K only have an error message.
+		if isNilMessageData(d) {
+			continue
+		}
+		r.messages = append(r.messages, d)
+		if d.ID() == ruleID && r.disruptive == nil {
+			r.disruptive = d
+		}
+		if !seenIDs[d.ID()] {
+			seenIDs[d.ID()] = true
+			r.ruleIDs = append(r.ruleIDs, d.ID())
+			r.severities = append(r.severities, d.Severity().String())
+		}
+		// Lower values are more severe.
+		if s := d.Severity(); s != types.RuleSeverityUnset && (r.severity == types.RuleSeverityUnset || s < r.severity) {
+			r.severity = s
+		}
+		for _, tag := range d.Tags() {
+			if !seenTags[tag] {
+				seenTags[tag] = true
+				r.tags = append(r.tags, tag)
+			}
+		}
+	}
+	sort.Strings(r.tags)
+	return r
+}
+
+// isNilMessageData reports whether d is nil or a nil pointer, which is how
+// Coraza reports messages without data.
+func isNilMessageData(d plugintypes.AuditLogMessageData) bool {
+	if d == nil {
+		return true
+	}
+	v := reflect.ValueOf(d)
+	return v.Kind() == reflect.Pointer && v.IsNil()
+}
+
+// headline is the message summarizing the record, the one of the rule
+// that interrupted the transaction or else the first one matched.
+func (r *auditRecord) headline() (ruleID int, msg string) {
+	d := r.disruptive
+	if d == nil && len(r.messages) > 0 {
+		d = r.messages[0]
+	}
+	if d == nil {
+		return 0, "Transaction inspected"
+	}
+	return d.ID(), d.Msg()
+}
+
+func (r *auditRecord) timestamp() time.Time {
+	return time.Unix(0, r.al.Transaction().UnixTimestamp())
+}
+
+// ecsFormatter formats audit logs in the Elastic Common Schema, see
+// https://www.elastic.co/guide/en/ecs/current/index.html. Details of the
+// matched rules that have no ECS field are under coraza.
+type ecsFormatter struct{}
+
+// ecsVersion is the version of the Elastic Common Schema of the records.
+const ecsVersion = "8.11.0"
+
+type ecsRecord struct {
+	Timestamp   string         `json:"@timestamp"`
+	ECS         ecsECS         `json:"ecs"`
+	Message     string         `json:"message,omitempty"`
+	Event       ecsEvent       `json:"event"`
+	Observer    ecsObserver    `json:"observer"`
+	Source      ecsEndpoint    `json:"source"`
+	Destination ecsEndpoint    `json:"destination"`
+	URL         *ecsURL        `json:"url,omitempty"`
+	HTTP        *ecsHTTP       `json:"http,omitempty"`
+	UserAgent   *ecsUserAgent  `json:"user_agent,omitempty"`
+	Transaction ecsTransaction `json:"transaction"`
+	Rule        *ecsRule       `json:"rule,omitempty"`
+	Tags        []string       `json:"tags,omitempty"`
+	Coraza      ecsCoraza      `json:"coraza"`
+}
+
+type ecsECS struct {
+	Version string `json:"version"`
+}
+
+type ecsEvent struct {
+	Kind     string   `json:"kind"`
+	Category []string `json:"category"`
+	Type     []string `json:"type"`
+	Action   string   `json:"action"`
+	Outcome  string   `json:"outcome"`
+	Severity *int     `json:"severity,omitempty"`
+	Module   string   `json:"module"`
+	Dataset  string   `json:"dataset"`
+}
+
+type ecsObserver struct {
+	Vendor  string `json:"vendor"`
+	Product string `json:"product"`
+	Type    string `json:"type"`
+}
+
+type ecsEndpoint struct {
+	Address string `json:"address,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Port    int    `json:"port,omitempty"`
+	Domain  string `json:"domain,omitempty"`
+}
+
+type ecsURL struct {
+	Original string `json:"original"`
+	Domain   string `json:"domain,omitempty"`
+}
+
+type ecsHTTP struct {
+	Version  string           `json:"version,omitempty"`
+	Request  ecsHTTPRequest   `json:"request"`
+	Response *ecsHTTPResponse `json:"response,omitempty"`
+}
+
+type ecsHTTPRequest struct {
+	Method string `json:"method,omitempty"`
+	ID     string `json:"id"`
+}
+
+type ecsHTTPResponse struct {
+	StatusCode int `json:"status_code"`
+}
+
+type ecsUserAgent struct {
+	Original string `json:"original"`
+}
+
+type ecsTransaction struct {
+	ID string `json:"id"`
+}
+
+type ecsRule struct {
+	ID       []string `json:"id"`
+	Name     string   `json:"name,omitempty"`
+	Ruleset  string   `json:"ruleset,omitempty"`
+	Category string   `json:"category,omitempty"`
+}
+
+type ecsCoraza struct {
+	Interrupted bool            `json:"interrupted"`
+	Severity    string          `json:"severity,omitempty"`
+	Messages    []ecsCorazaRule `json:"messages,omitempty"`
+}
+
+type ecsCorazaRule struct {
+	ID       int      `json:"id"`
+	Message  string   `json:"message,omitempty"`
+	Data     string   `json:"data,omitempty"`
+	Severity string   `json:"severity"`
+	Tags     []string `json:"tags,omitempty"`
+	File     string   `json:"file,omitempty"`
+	Line     int      `json:"line,omitempty"`
+}
+
+func (ecsFormatter) Format(al plugintypes.AuditLog) ([]byte, error) {
+	r := newAuditRecord(al)
+	tx := al.Transaction()
+
+	rec := ecsRecord{
+		Timestamp: r.timestamp().UTC().Format(time.RFC3339Nano),
+		ECS:       ecsECS{Version: ecsVersion},
+		Event: ecsEvent{
+			Kind:     "event",
+			Category: []string{"web", "network"},
+			Type:     []string{"access", "allowed"},
+			Action:   r.action,
+			Outcome:  "success",
+			Module:   "coraza",
+			Dataset:  "coraza.audit",
+		},
+		Observer: ecsObserver{Vendor: "OWASP", Product: "Coraza", Type: "waf"},
+		Source: ecsEndpoint{
+			Address: tx.ClientIP(),
+			IP:      tx.ClientIP(),
+			Port:    tx.ClientPort(),
+		},
+		Destination: ecsEndpoint{
+			Address: tx.HostIP(),
+			IP:      tx.HostIP(),
+			Port:    tx.HostPort(),
+			Domain:  r.serverName,
+		},
+		Transaction: ecsTransaction{ID: tx.ID()},
+		Tags:        r.tags,
+		Coraza: ecsCoraza{
+			Interrupted: tx.IsInterrupted(),
+		},
+	}
+	if len(r.messages) > 0 {
+		rec.Event.Kind = "alert"
+		rec.Event.Category = append(rec.Event.Category, "intrusion_detection")
+	}
+	if tx.IsInterrupted() {
+		rec.Event.Type = []string{"access", "denied"}
+		rec.Event.Outcome = "failure"
+	}
+	if r.severity != types.RuleSeverityUnset {
+		severity := r.severity.Int()
+		rec.Event.Severity = &severity
+		rec.Coraza.Severity = r.severity.String()
+	}
+	if _, msg := r.headline(); len(r.messages) > 0 {
+		rec.Message = msg
+	}
+	if r.requestURI != "" {
+		rec.URL = &ecsURL{Original: r.requestURI, Domain: r.serverName}
+	}
+	if tx.HasRequest() {
+		rec.HTTP = &ecsHTTP{
+			Version: r.httpVersion,
+			Request: ecsHTTPRequest{Method: r.method, ID: tx.ID()},
+		}
+		if r.status != 0 {
+			rec.HTTP.Response = &ecsHTTPResponse{StatusCode: r.status}
+		}
+		if ua := tx.Request().Headers()["user-agent"]; len(ua) > 0 {
+			rec.UserAgent = &ecsUserAgent{Original: ua[0]}
+		}
+	}
+	if len(r.ruleIDs) > 0 {
+		rec.Rule = &ecsRule{Ruleset: "coraza"}
+		for _, id := range r.ruleIDs {
+			rec.Rule.ID = append(rec.Rule.ID, strconv.Itoa(id))
+		}
+		_, rec.Rule.Name = r.headline()
+	}
+	for _, d := range r.messages {
+		rec.Coraza.Messages = append(rec.Coraza.Messages, ecsCorazaRule{
+			ID:       d.ID(),
+			Message:  d.Msg(),
+			Data:     d.Data(),
+			Severity: d.Severity().String(),
+			Tags:     d.Tags(),
+			File:     d.File(),
+			Line:     d.Line(),
+		})
+	}
+	return json.Marshal(rec)
+}
+
+func (ecsFormatter) MIME() string {
+	return "application/json"
+}
+
+// cefFormatter formats audit logs in the ArcSight Common Event Format,
+// one line per transaction:
+//
+//	CEF:0|OWASP|Coraza|<version>|<rule ID>|<message>|<severity>|<extension>
+//
+// The signature is the rule that interrupted the transaction, or the first
+// one matched.
+type cefFormatter struct{}
+
+// cefSeverities maps rule severities to the 0 to 10 scale of CEF.
+var cefSeverities = map[types.RuleSeverity]int{
+	types.RuleSeverityEmergency: 10,
+	types.RuleSeverityAlert:     9,
+	types.RuleSeverityCritical:  8,
+	types.RuleSeverityError:     7,
+	types.RuleSeverityWarning:   5,
+	types.RuleSeverityNotice:    3,
+	types.RuleSeverityInfo:      1,
+	types.RuleSeverityDebug:     0,
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+func (cefFormatter) Format(al plugintypes.AuditLog) ([]byte, error) {
+	r := newAuditRecord(al)
+	tx := al.Transaction()
+
+	ruleID, msg := r.headline()
+	severity := 0
+	if s, ok := cefSeverities[r.severity]; ok {
+		severity = s
+	}
+
+	var ext []string
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefExtensionEscaper.Replace(value))
+		}
+	}
+	addInt := func(key string, value int) {
+		if value != 0 {
+			add(key, strconv.Itoa(value))
+		}
+	}
+	add("rt", strconv.FormatInt(r.timestamp().UnixMilli(), 10))
+	add("externalId", tx.ID())
+	add("act", r.action)
+	add("src", tx.ClientIP())
+	addInt("spt", tx.ClientPort())
+	add("dst", tx.HostIP())
+	addInt("dpt", tx.HostPort())
+	add("dhost", r.serverName)
+	add("requestMethod", r.method)
+	add("request", r.requestURI)
+	if tx.HasRequest() {
+		if ua := tx.Request().Headers()["user-agent"]; len(ua) > 0 {
+			add("requestClientApplication", ua[0])
+		}
+	}
+	if r.status != 0 {
+		add("cn1Label", "status")
+		addInt("cn1", r.status)
+	}
+	if len(r.ruleIDs) > 0 {
+		ids := make([]string, len(r.ruleIDs))
+		for i, id := range r.ruleIDs {
+			ids[i] = strconv.Itoa(id)
+		}
+		add("cs1Label", "ruleIds")
+		add("cs1", strings.Join(ids, ","))
+		add("cs2Label", "severities")
+		add("cs2", strings.Join(r.severities, ","))
+	}
+	if len(r.tags) > 0 {
+		add("cs3Label", "tags")
+		add("cs3", strings.Join(r.tags, ","))
+	}
+
+	line := fmt.Sprintf("CEF:0|OWASP|Coraza|%s|%s|%s|%d|%s\n",
+		cefHeaderEscaper.Replace(corazaVersion()),
+		strconv.Itoa(ruleID),
+		cefHeaderEscaper.Replace(msg),
+		severity,
+		strings.Join(ext, " "),
+	)
+	return []byte(line), nil
+}
+
+func (cefFormatter) MIME() string {
+	return "text/plain"
+}
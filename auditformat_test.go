@@ -0,0 +1,252 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// auditLogOf serves a request for target with a WAF logging to a file in
+// format and returns what is logged.
+func auditLogOf(t *testing.T, format, target string) string {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	logFile := filepath.Join(t.TempDir(), "audit.log")
+	m := &corazaModule{Directives: fmt.Sprintf(`SecRuleEngine On
+SecAuditEngine On
+SecAuditLogParts ABFHKZ
+SecAuditLogType Serial
+SecAuditLog %s
+SecAuditLogFormat %s
+SecRule ARGS:q "@contains attack" "id:101,phase:1,pass,log,severity:WARNING,tag:attack-generic,tag:paranoia-level/1,msg:'attack | detected',logdata:'q=%%{MATCHED_VAR}'"
+SecRule ARGS:q "@contains attack" "id:102,phase:1,deny,status:403,log,severity:CRITICAL,tag:attack-generic,msg:'blocked'"
+SecRule ARGS:q "@contains redirect" "id:103,phase:1,redirect:https://example.com/,log,msg:'redirected'"`, logFile, format)}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	req := newServeHTTPRequest(http.MethodGet, target, nil)
+	req.Header.Set("User-Agent", "test-agent")
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := w.Write([]byte("ok"))
+		return err
+	})
+	_ = m.ServeHTTP(httptest.NewRecorder(), req, next)
+
+	b, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestECSFormat(t *testing.T) {
+	t.Run("interrupted", func(t *testing.T) {
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal([]byte(auditLogOf(t, "ECS", "/search?q=attack")), &rec))
+
+		require.Equal(t, ecsVersion, rec["ecs"].(map[string]any)["version"])
+		event := rec["event"].(map[string]any)
+		require.Equal(t, "alert", event["kind"])
+		require.Equal(t, "deny", event["action"])
+		require.Equal(t, "failure", event["outcome"])
+		require.Equal(t, []any{"access", "denied"}, event["type"])
+		require.EqualValues(t, 2, event["severity"], "the highest severity, critical")
+
+		require.Equal(t, "192.0.2.1", rec["source"].(map[string]any)["ip"])
+		require.EqualValues(t, 1234, rec["source"].(map[string]any)["port"])
+		require.Equal(t, "example.com", rec["destination"].(map[string]any)["domain"])
+		require.Equal(t, "/search?q=attack", rec["url"].(map[string]any)["original"])
+		httpFields := rec["http"].(map[string]any)
+		require.Equal(t, "GET", httpFields["request"].(map[string]any)["method"])
+		require.EqualValues(t, 403, httpFields["response"].(map[string]any)["status_code"])
+		require.Equal(t, "test-agent", rec["user_agent"].(map[string]any)["original"])
+
+		rule := rec["rule"].(map[string]any)
+		require.Equal(t, []any{"101", "102"}, rule["id"])
+		require.Equal(t, "blocked", rule["name"])
+		require.Equal(t, "blocked", rec["message"])
+		require.Equal(t, []any{"attack-generic", "paranoia-level/1"}, rec["tags"])
+
+		coraza := rec["coraza"].(map[string]any)
+		require.Equal(t, true, coraza["interrupted"])
+		messages := coraza["messages"].([]any)
+		require.Len(t, messages, 2)
+		require.Equal(t, "warning", messages[0].(map[string]any)["severity"])
+		require.Equal(t, "q=attack", messages[0].(map[string]any)["data"])
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal([]byte(auditLogOf(t, "ECS", "/search?q=fine")), &rec))
+
+		event := rec["event"].(map[string]any)
+		require.Equal(t, "event", event["kind"])
+		require.Equal(t, "pass", event["action"])
+		require.Equal(t, "success", event["outcome"])
+		require.NotContains(t, event, "severity")
+		require.NotContains(t, rec, "rule")
+		require.NotContains(t, rec, "message")
+	})
+}
+
+func TestCEFFormat(t *testing.T) {
+	tests := map[string]struct {
+		target string
+		header string
+		ext    []string
+	}{
+		"denied": {
+			target: "/search?q=attack",
+			header: "CEF:0|OWASP|Coraza|" + corazaVersion() + "|102|blocked|8|",
+			ext: []string{
+				"act=deny", "src=192.0.2.1", "spt=1234", "dhost=example.com",
+				"requestMethod=GET", `request=/search?q\=attack`, "requestClientApplication=test-agent",
+				"cn1Label=status", "cn1=403",
+				"cs1Label=ruleIds", "cs1=101,102",
+				"cs2Label=severities", "cs2=warning,critical",
+				"cs3Label=tags", "cs3=attack-generic,paranoia-level/1",
+			},
+		},
+		"redirected": {
+			target: "/?q=redirect",
+			header: "CEF:0|OWASP|Coraza|" + corazaVersion() + "|103|redirected|0|",
+			ext:    []string{"act=redirect", "cn1=302", "cs1=103"},
+		},
+		"allowed": {
+			target: "/?q=fine",
+			header: "CEF:0|OWASP|Coraza|" + corazaVersion() + "|0|Transaction inspected|0|",
+			ext:    []string{"act=pass", "cn1=200"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			line := strings.TrimSpace(auditLogOf(t, "CEF", test.target))
+			require.NotContains(t, line, "\n")
+			require.True(t, strings.HasPrefix(line, test.header), line)
+			ext := strings.Split(strings.TrimPrefix(line, test.header), " ")
+			for _, field := range test.ext {
+				require.Contains(t, ext, field)
+			}
+		})
+	}
+}
+
+func TestCEFEscaping(t *testing.T) {
+	require.Equal(t, `a\|b\\c d`, cefHeaderEscaper.Replace("a|b\\c\nd"))
+	require.Equal(t, `a\=b\\c\nd|e`, cefExtensionEscaper.Replace("a=b\\c\nd|e"))
+}
+
+func TestAuditInterruptionsWithSharedIDs(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "audit.log")
+	m := &corazaModule{
+		Directives: fmt.Sprintf(`SecRuleEngine On
+SecAuditEngine On
+SecAuditLogParts ABHZ
+SecAuditLogType Serial
+SecAuditLog %s
+SecAuditLogFormat ECS
+SecRule ARGS:q "@contains attack" "id:102,phase:1,deny,status:403,log,msg:'blocked'"
+SecRule ARGS:q "@contains fine" "id:103,phase:1,pass,log,msg:'seen'"`, logFile),
+		logger: zap.NewNop(),
+	}
+	waf, err := m.buildWAF()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = waf.(io.Closer).Close() })
+
+	// Transactions taking their ID from the same request header, logged at
+	// the same time, must each get their own interruption.
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx := waf.NewTransactionWithID("shared-id")
+			defer tx.Close()
+			q := "fine"
+			if i%2 == 0 {
+				q = "attack"
+			}
+			tx.ProcessURI("/?q="+q, "GET", "HTTP/1.1")
+			tx.ProcessRequestHeaders()
+			processLogging(tx)
+		}()
+	}
+	wg.Wait()
+
+	b, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 50)
+	for _, line := range lines {
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		action := rec["event"].(map[string]any)["action"]
+		if strings.Contains(rec["url"].(map[string]any)["original"].(string), "attack") {
+			require.Equal(t, "deny", action)
+		} else {
+			require.Equal(t, "pass", action)
+		}
+	}
+	require.Empty(t, auditInterruptions.byID, "logged transactions should be forgotten")
+}
+
+// valueMessageData is an AuditLogMessageData implemented by a value.
+type valueMessageData struct {
+	plugintypes.AuditLogMessageData
+}
+
+func TestLogsInterruptions(t *testing.T) {
+	dir := t.TempDir()
+	include := filepath.Join(dir, "audit.conf")
+	require.NoError(t, os.WriteFile(include, []byte("SecAuditLogFormat \"cef\"\n"), 0644))
+
+	tests := map[string]struct {
+		module *corazaModule
+		want   bool
+	}{
+		"ECS":     {module: &corazaModule{Directives: "SecAuditEngine On\nSecAuditLogFormat ECS"}, want: true},
+		"CEF":     {module: &corazaModule{Include: []string{include}}, want: true},
+		"JSON":    {module: &corazaModule{Directives: "SecAuditEngine On\nSecAuditLogFormat JSON"}},
+		"default": {module: &corazaModule{Directives: "SecRuleEngine On"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.want, test.module.logsInterruptions())
+		})
+	}
+
+	t.Run("counted until closed", func(t *testing.T) {
+		before := interruptionFormatWAFs.Load()
+		m := &corazaModule{Directives: "SecAuditLogFormat ECS", logger: zap.NewNop()}
+		waf, err := m.buildWAF()
+		require.NoError(t, err)
+		require.Equal(t, before+1, interruptionFormatWAFs.Load())
+		require.NoError(t, waf.(io.Closer).Close())
+		require.NoError(t, waf.(io.Closer).Close())
+		require.Equal(t, before, interruptionFormatWAFs.Load())
+	})
+}
+
+func TestIsNilMessageData(t *testing.T) {
+	require.True(t, isNilMessageData(nil))
+	require.False(t, isNilMessageData(valueMessageData{}), "values must not make the check panic")
+}
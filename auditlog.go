@@ -0,0 +1,185 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// defaultAuditLoggerName is the logger audit records are written to when
+// SecAuditLog does not name one. Audit loggers are named after the WAF
+// handler for the logs of Caddy to include them.
+const defaultAuditLoggerName = "http.handlers.waf.audit"
+
+// auditLogger is the logger of the WAF handlers of the last config
+// started. Coraza creates audit log writers without context, and pooled
+// WAFs outlive the configs they were compiled for.
+var auditLogger atomic.Pointer[zap.Logger]
+
+var handlerModuleID = string(corazaModule{}.CaddyModule().ID)
+
+func init() {
+	// SecAuditLogType Caddy
+	plugins.RegisterAuditLogWriter("caddy", func() plugintypes.AuditLogWriter {
+		return &caddyAuditLogWriter{}
+	})
+}
+
+// caddyAuditLogWriter writes audit records to a Caddy logger, named after
+// SecAuditLog, so they go through the writers, encoders and filters of the
+// log global option.
+type caddyAuditLogWriter struct {
+	name      string
+	formatter plugintypes.AuditLogFormatter
+}
+
+var _ plugintypes.AuditLogWriter = (*caddyAuditLogWriter)(nil)
+
+func (w *caddyAuditLogWriter) Init(cfg plugintypes.AuditLogConfig) error {
+	name := cfg.Target
+	if name == "" {
+		name = defaultAuditLoggerName
+	}
+	var ok bool
+	if w.name, ok = strings.CutPrefix(name, handlerModuleID+"."); !ok {
+		return fmt.Errorf("audit logger %q must be named after %s", name, handlerModuleID)
+	}
+	w.formatter = cfg.Formatter
+	return nil
+}
+
+// Write logs al. Records of formats producing JSON are logged as fields,
+// which can be filtered, others as a single record field.
+func (w *caddyAuditLogWriter) Write(al plugintypes.AuditLog) error {
+	logger := auditLogger.Load()
+	if logger == nil {
+		// No handler was provisioned, e.g. in the coraza command.
+		logger = caddy.Log().Named(handlerModuleID)
+	}
+	ce := logger.Named(w.name).Check(zapcore.InfoLevel, "audit record")
+	if ce == nil {
+		return nil
+	}
+	b, err := w.formatter.Format(al)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(w.formatter.MIME()); mediaType != "application/json" {
+		ce.Write(zap.String("record", string(bytes.TrimSpace(b))))
+		return nil
+	}
+	fields, err := jsonFields(b)
+	if err != nil {
+		return err
+	}
+	ce.Write(fields...)
+	return nil
+}
+
+func (w *caddyAuditLogWriter) Close() error {
+	return nil
+}
+
+// jsonFields converts the members of the JSON object b to log fields.
+func jsonFields(b []byte) ([]zap.Field, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var record map[string]any
+	if err := dec.Decode(&record); err != nil {
+		return nil, fmt.Errorf("decoding audit record: %v", err)
+	}
+	keys := sortedKeys(record)
+	fields := make([]zap.Field, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, jsonField(k, record[k]))
+	}
+	return fields, nil
+}
+
+// jsonField returns the log field of a decoded JSON value. Objects are
+// logged as objects, not reflected, for log filters to reach their members.
+func jsonField(key string, v any) zap.Field {
+	switch v := v.(type) {
+	case map[string]any:
+		return zap.Object(key, jsonObject(v))
+	case []any:
+		return zap.Array(key, jsonArray(v))
+	case string:
+		return zap.String(key, v)
+	case bool:
+		return zap.Bool(key, v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return zap.Int64(key, i)
+		}
+		f, _ := v.Float64()
+		return zap.Float64(key, f)
+	default:
+		return zap.Reflect(key, v)
+	}
+}
+
+type jsonObject map[string]any
+
+func (o jsonObject) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, k := range sortedKeys(o) {
+		jsonField(k, o[k]).AddTo(enc)
+	}
+	return nil
+}
+
+type jsonArray []any
+
+func (a jsonArray) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, v := range a {
+		var err error
+		switch v := v.(type) {
+		case map[string]any:
+			err = enc.AppendObject(jsonObject(v))
+		case []any:
+			err = enc.AppendArray(jsonArray(v))
+		case string:
+			enc.AppendString(v)
+		case bool:
+			enc.AppendBool(v)
+		case json.Number:
+			if i, ierr := v.Int64(); ierr == nil {
+				enc.AppendInt64(i)
+			} else {
+				f, _ := v.Float64()
+				enc.AppendFloat64(f)
+			}
+		default:
+			err = enc.AppendReflected(v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,189 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestJSONFields(t *testing.T) {
+	fields, err := jsonFields([]byte(`{
+		"transaction": {
+			"id": "abc",
+			"client_port": 1234,
+			"score": 1.5,
+			"is_interrupted": true,
+			"request": {"headers": {"user-agent": ["curl"]}},
+			"producer": null
+		},
+		"messages": [{"data": {"id": 1, "tags": ["a", "b"]}}, "text", 2, false, [1]]
+	}`))
+	require.NoError(t, err)
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	zap.New(core).Info("audit record", fields...)
+	require.Equal(t, map[string]any{
+		"transaction": map[string]any{
+			"id":             "abc",
+			"client_port":    int64(1234),
+			"score":          1.5,
+			"is_interrupted": true,
+			"request": map[string]any{
+				"headers": map[string]any{"user-agent": []any{"curl"}},
+			},
+			"producer": nil,
+		},
+		"messages": []any{
+			map[string]any{"data": map[string]any{"id": int64(1), "tags": []any{"a", "b"}}},
+			"text",
+			int64(2),
+			false,
+			[]any{int64(1)},
+		},
+	}, logs.All()[0].ContextMap())
+
+	_, err = jsonFields([]byte(`not json`))
+	require.Error(t, err)
+}
+
+func TestCaddyAuditLogWriter(t *testing.T) {
+	tests := map[string]struct {
+		directives string
+		logger     string
+		check      func(t *testing.T, record map[string]any)
+	}{
+		"json": {
+			directives: `SecAuditLogType Caddy
+SecAuditLogFormat JSON`,
+			logger: defaultAuditLoggerName,
+			check: func(t *testing.T, record map[string]any) {
+				tx := record["transaction"].(map[string]any)
+				require.True(t, tx["is_interrupted"].(bool))
+				headers := tx["request"].(map[string]any)["headers"].(map[string]any)
+				require.Contains(t, headers, "x-test")
+				require.NotContains(t, headers, "authorization", "the log filter removes it")
+				messages := record["messages"].([]any)
+				require.Len(t, messages, 1)
+			},
+		},
+		"native to a named logger": {
+			directives: `SecAuditLogType Caddy
+SecAuditLog http.handlers.waf.audit.native`,
+			logger: "http.handlers.waf.audit.native",
+			check: func(t *testing.T, record map[string]any) {
+				require.Contains(t, record["record"], "GET /blocked HTTP/1.1")
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			logFile := filepath.Join(t.TempDir(), "audit.log")
+
+			tester := caddytest.NewTester(t)
+			tester.InitServer(fmt.Sprintf(`{
+				admin localhost:%d
+				auto_https off
+				order coraza_waf first
+				log audit {
+					output file %s
+					format filter {
+						request>headers>authorization delete
+						transaction>request>headers>authorization delete
+					}
+					include http.handlers.waf.audit
+				}
+			}
+
+			:8080 {
+				coraza_waf {
+					directives `+"`"+`
+						SecRuleEngine On
+						SecAuditEngine On
+						SecAuditLogParts ABHZ
+						%s
+						SecRule REQUEST_URI "/blocked" "id:1,phase:1,deny,status:403,log,msg:'blocked'"
+					`+"`"+`
+				}
+				respond "ok"
+			}`, caddytest.Default.AdminPort, logFile, test.directives), "caddyfile")
+
+			req, _ := http.NewRequest("GET", baseURL+"/blocked", nil)
+			req.Header.Set("X-Test", "1")
+			req.Header.Set("Authorization", "Bearer secret")
+			tester.AssertResponseCode(req, 403)
+
+			f, err := os.Open(logFile)
+			require.NoError(t, err)
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			scanner.Buffer(nil, 1<<20)
+			require.True(t, scanner.Scan(), "an audit record is logged")
+			var record map[string]any
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			require.Equal(t, test.logger, record["logger"])
+			require.Equal(t, "audit record", record["msg"])
+			test.check(t, record)
+		})
+	}
+}
+
+func TestAuditLoggerSwitchesOnStart(t *testing.T) {
+	previous := auditLogger.Load()
+	t.Cleanup(func() { auditLogger.Store(previous) })
+	running := zap.NewNop()
+	auditLogger.Store(running)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	m := &corazaModule{Directives: "SecInvalidDirective foo"}
+	require.Error(t, m.Provision(ctx))
+	require.Same(t, running, auditLogger.Load(), "a failed provision should not switch the audit logger")
+
+	app := &App{handlerLogger: zap.NewExample()}
+	require.NoError(t, app.Start())
+	t.Cleanup(func() { _ = app.Cleanup() })
+	require.Same(t, app.handlerLogger, auditLogger.Load())
+}
+
+func TestCaddyAuditLogWriterInit(t *testing.T) {
+	tests := map[string]struct {
+		target    string
+		name      string
+		shouldErr bool
+	}{
+		"default":          {name: "audit"},
+		"named":            {target: "http.handlers.waf.audit.api", name: "audit.api"},
+		"outside handlers": {target: "/var/log/audit.log", shouldErr: true},
+		"handler logger":   {target: "http.handlers.waf", shouldErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := &caddyAuditLogWriter{}
+			err := w.Init(plugintypes.AuditLogConfig{Target: test.target})
+			if test.shouldErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.name, w.name)
+		})
+	}
+}
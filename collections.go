@@ -0,0 +1,353 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/macro"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+	"go.uber.org/zap"
+)
+
+func init() {
+	// Coraza parses initcol but does nothing with it, and has no setsid
+	// and setuid actions.
+	plugins.RegisterAction("initcol", func() plugintypes.Action { return &initcolAction{} })
+	plugins.RegisterAction("setsid", func() plugintypes.Action { return &initcolAction{collection: "session"} })
+	plugins.RegisterAction("setuid", func() plugintypes.Action { return &initcolAction{collection: "user"} })
+}
+
+// collectionsNamespace is the module namespace of the persistent
+// collection backends.
+const collectionsNamespace = "http.handlers.waf.collections"
+
+// persistentCollections are the collections initcol can load.
+var persistentCollections = []string{"ip", "global", "resource", "session", "user"}
+
+// modSecCollectionRegex matches the ModSecurity syntax for the variables of
+// persistent collections, IP:hits or setvar:ip.hits=+1, which Coraza
+// rejects.
+var modSecCollectionRegex = regexp.MustCompile(`(?i)(?:^|[\s|!"])(?:ip|global|resource|session|user):|setvar\s*:\s*'?(?:ip|global|resource|session|user)\.`)
+
+// errModSecCollection is added to the compilation errors of directives
+// using the ModSecurity syntax for persistent collections.
+var errModSecCollection = errors.New("the variables of persistent collections are read as TX:<collection>.<name> and written with setvar:tx.<collection>.<name>")
+
+// CollectionStore is implemented by modules in the
+// http.handlers.waf.collections namespace, which store the records of
+// persistent collections across transactions. Records are identified by
+// the name of their collection, e.g. ip, and their key, e.g. the client IP
+// address. Stores are responsible for expiring the records, and for
+// bounding how long their calls take: Load is called while the request
+// waits, with its context, and Update after the logging phase, with a
+// context that is not canceled along with the request.
+type CollectionStore interface {
+	caddy.Module
+	// Load returns the variables of a record, nil if there is none.
+	Load(ctx context.Context, collection, key string) (map[string]string, error)
+	// Update calls update with the variables of a record, empty if there
+	// is none, and stores them as modified by update. A record left with no
+	// variable is deleted. Updates of the same record must not overlap.
+	// Stores may apply update later, in which case Load should return the
+	// variables as modified by the updates not stored yet.
+	Update(ctx context.Context, collection, key string, update func(vars map[string]string)) error
+}
+
+// Variables maintained for every record, besides the ones set by rules.
+// key and is_new are only set in transactions, the others are stored.
+const (
+	collectionKey            = "key"
+	collectionIsNew          = "is_new"
+	collectionCreateTime     = "create_time"
+	collectionLastUpdateTime = "last_update_time"
+	collectionUpdateCounter  = "update_counter"
+)
+
+func isBuiltinCollectionVar(name string) bool {
+	switch name {
+	case collectionKey, collectionIsNew, collectionCreateTime, collectionLastUpdateTime, collectionUpdateCounter:
+		return true
+	}
+	return false
+}
+
+// txCollections are the persistent collections of a transaction. The
+// variables of a collection are exposed to rules in the TX collection,
+// prefixed with the name of the collection: initcol:ip=%{REMOTE_ADDR}
+// makes the variable hits of the client readable as TX:ip.hits and
+// writable with setvar:tx.ip.hits=+1.
+type txCollections struct {
+	// ctx is the context of the request, it is only used to load records
+	// while the request is in flight.
+	ctx    context.Context
+	store  CollectionStore
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	loaded map[string]*loadedCollection
+}
+
+// loadedCollection is a record loaded into a transaction.
+type loadedCollection struct {
+	key  string
+	vars map[string]string
+}
+
+// activeCollections are the persistent collections of the transactions in
+// flight. They are keyed by transaction rather than by ID, as IDs provided
+// by clients or proxies may be shared by transactions in flight.
+var activeCollections sync.Map
+
+// startCollections makes the persistent collections of store available
+// to the actions evaluated by tx, until the returned function saves them.
+// It returns a no-op if store is nil.
+func startCollections(ctx context.Context, tx types.Transaction, store CollectionStore, logger *zap.Logger) (save func()) {
+	return registerCollections(ctx, tx, store, logger, false)
+}
+
+// startReadOnlyCollections is startCollections for transactions whose
+// changes must not be stored, such as the shadow ones: the returned
+// function only makes the collections unavailable.
+func startReadOnlyCollections(ctx context.Context, tx types.Transaction, store CollectionStore, logger *zap.Logger) (end func()) {
+	return registerCollections(ctx, tx, store, logger, true)
+}
+
+func registerCollections(ctx context.Context, tx types.Transaction, store CollectionStore, logger *zap.Logger, readOnly bool) func() {
+	if store == nil {
+		return func() {}
+	}
+	c := &txCollections{
+		ctx:    ctx,
+		store:  store,
+		logger: logger,
+		loaded: map[string]*loadedCollection{},
+	}
+	activeCollections.Store(tx, c)
+	return func() {
+		activeCollections.Delete(tx)
+		if !readOnly {
+			c.save(tx)
+		}
+	}
+}
+
+// init loads the record of collection stored under key into tx. A
+// collection is loaded once per transaction, later calls are ignored. The
+// request waits for the store, until its context is canceled.
+func (c *txCollections) init(tx plugintypes.TransactionState, collection, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.loaded[collection]; ok {
+		return
+	}
+
+	vars, err := c.store.Load(c.ctx, collection, key)
+	if err != nil {
+		c.logger.Warn("Failed to load persistent collection, starting a new record",
+			zap.String("tx_id", tx.ID()),
+			zap.String("collection", collection),
+			zap.Error(err),
+		)
+		vars = nil
+	}
+	c.loaded[collection] = &loadedCollection{key: key, vars: vars}
+
+	txVars := tx.Variables().TX()
+	prefix := collection + "."
+	for name, value := range vars {
+		txVars.Set(prefix+name, []string{value})
+	}
+	txVars.Set(prefix+collectionKey, []string{key})
+	isNew := "0"
+	if vars == nil {
+		isNew = "1"
+	}
+	txVars.Set(prefix+collectionIsNew, []string{isNew})
+}
+
+// save stores the variables of the loaded collections that tx changed.
+// Only the changed variables are written, and integers are stored as the
+// difference between their value at load time and their final value,
+// applied to the stored value: two transactions incrementing a counter at
+// once both count. Other values are overwritten by the last transaction
+// storing them.
+func (c *txCollections) save(tx types.Transaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.loaded) == 0 {
+		return
+	}
+
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	current := map[string]map[string]string{}
+	for _, md := range state.Variables().TX().FindAll() {
+		collection, name, ok := strings.Cut(strings.ToLower(md.Key()), ".")
+		if !ok || isBuiltinCollectionVar(name) {
+			continue
+		}
+		if _, ok := c.loaded[collection]; !ok {
+			continue
+		}
+		if current[collection] == nil {
+			current[collection] = map[string]string{}
+		}
+		current[collection][name] = md.Value()
+	}
+
+	for collection, l := range c.loaded {
+		vars := current[collection]
+		changed := map[string]string{}
+		deltas := map[string]int64{}
+		for name, value := range vars {
+			old, ok := l.vars[name]
+			if ok && old == value {
+				continue
+			}
+			if delta, ok := integerDelta(old, value); ok {
+				deltas[name] = delta
+			} else {
+				changed[name] = value
+			}
+		}
+		var removed []string
+		for name := range l.vars {
+			if _, ok := vars[name]; !ok && !isBuiltinCollectionVar(name) {
+				removed = append(removed, name)
+			}
+		}
+		if len(changed) == 0 && len(deltas) == 0 && len(removed) == 0 {
+			continue
+		}
+
+		err := c.store.Update(context.WithoutCancel(c.ctx), collection, l.key, func(stored map[string]string) {
+			for name, value := range changed {
+				stored[name] = value
+			}
+			for name, delta := range deltas {
+				// A value stored in the meantime by another transaction
+				// that is not an integer counts as 0.
+				n, _ := strconv.ParseInt(stored[name], 10, 64)
+				stored[name] = strconv.FormatInt(n+delta, 10)
+			}
+			for _, name := range removed {
+				delete(stored, name)
+			}
+			userVars := false
+			for name := range stored {
+				userVars = userVars || !isBuiltinCollectionVar(name)
+			}
+			if !userVars {
+				clear(stored)
+				return
+			}
+			now := strconv.FormatInt(time.Now().Unix(), 10)
+			if stored[collectionCreateTime] == "" {
+				stored[collectionCreateTime] = now
+			}
+			stored[collectionLastUpdateTime] = now
+			counter, _ := strconv.Atoi(stored[collectionUpdateCounter])
+			stored[collectionUpdateCounter] = strconv.Itoa(counter + 1)
+		})
+		if err != nil {
+			c.logger.Error("Failed to store persistent collection",
+				zap.String("tx_id", tx.ID()),
+				zap.String("collection", collection),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// integerDelta returns to - from if both are integers, an empty from
+// counting as 0.
+func integerDelta(from, to string) (int64, bool) {
+	var f int64
+	if from != "" {
+		var err error
+		if f, err = strconv.ParseInt(from, 10, 64); err != nil {
+			return 0, false
+		}
+	}
+	t, err := strconv.ParseInt(to, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return t - f, true
+}
+
+// initcolAction implements the initcol action, initcol:<collection>=<key>,
+// and its setsid:<key> and setuid:<key> shorthands for the session and
+// user collections.
+type initcolAction struct {
+	collection string
+	key        macro.Macro
+}
+
+// Init implements plugintypes.Action.
+func (a *initcolAction) Init(_ plugintypes.RuleMetadata, data string) error {
+	key := data
+	if a.collection == "" {
+		collection, k, ok := strings.Cut(data, "=")
+		if !ok {
+			return errors.New("invalid arguments, expected syntax <collection>=<key>")
+		}
+		a.collection, key = strings.ToLower(strings.TrimSpace(collection)), k
+		valid := false
+		for _, c := range persistentCollections {
+			valid = valid || c == a.collection
+		}
+		if !valid {
+			return fmt.Errorf("invalid collection %q, expected one of %s", a.collection, strings.Join(persistentCollections, ", "))
+		}
+	}
+	if strings.TrimSpace(key) == "" {
+		return errors.New("missing collection key")
+	}
+
+	m, err := macro.NewMacro(key)
+	if err != nil {
+		return err
+	}
+	a.key = m
+	return nil
+}
+
+// Evaluate implements plugintypes.Action. Without a collection backend
+// configured for the handler, it does nothing.
+func (a *initcolAction) Evaluate(r plugintypes.RuleMetadata, tx plugintypes.TransactionState) {
+	v, ok := activeCollections.Load(tx)
+	if !ok {
+		tx.DebugLogger().Debug().
+			Int("rule_id", r.ID()).
+			Str("collection", a.collection).
+			Msg("No collection backend configured, ignoring persistent collection")
+		return
+	}
+	key := a.key.Expand(tx)
+	if key == "" {
+		return
+	}
+	v.(*txCollections).init(tx, a.collection, key)
+}
+
+// Type implements plugintypes.Action.
+func (a *initcolAction) Type() plugintypes.ActionType {
+	return plugintypes.ActionTypeNondisruptive
+}
+
+var _ plugintypes.Action = (*initcolAction)(nil)
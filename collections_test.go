@@ -0,0 +1,163 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// provisionCollections provisions a module with directives and the
+// collections backend described by backend.
+func provisionCollections(t *testing.T, directives, backend string) *corazaModule {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	m := &corazaModule{Directives: directives}
+	if backend != "" {
+		m.CollectionsRaw = json.RawMessage(backend)
+	}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+	return m
+}
+
+const rateLimitDirectives = `SecRuleEngine On
+SecAction "id:1,phase:1,nolog,pass,initcol:ip=%%{REMOTE_ADDR}"
+SecAction "id:2,phase:1,nolog,pass,setvar:tx.ip.hits=+1"
+SecRule TX:ip.hits "@gt %d" "id:3,phase:1,deny,status:429"`
+
+func TestPersistentCollections(t *testing.T) {
+	t.Run("ip", func(t *testing.T) {
+		m := provisionCollections(t, fmt.Sprintf(rateLimitDirectives, 2), `{"backend": "memory", "name": "test-ip"}`)
+		require.Equal(t, http.StatusOK, statusOf(t, m, "/"))
+		require.Equal(t, http.StatusOK, statusOf(t, m, "/"))
+		require.Equal(t, http.StatusTooManyRequests, statusOf(t, m, "/"))
+
+		vars, err := m.collections.Load(context.Background(), "ip", "192.0.2.1")
+		require.NoError(t, err)
+		require.Equal(t, "3", vars["hits"])
+		require.Equal(t, "3", vars[collectionUpdateCounter])
+		require.NotEmpty(t, vars[collectionCreateTime])
+		require.NotContains(t, vars, collectionIsNew)
+		require.NotContains(t, vars, collectionKey)
+	})
+
+	t.Run("shared by name", func(t *testing.T) {
+		backend := `{"backend": "memory", "name": "test-shared"}`
+		a := provisionCollections(t, fmt.Sprintf(rateLimitDirectives, 1), backend)
+		b := provisionCollections(t, fmt.Sprintf(rateLimitDirectives, 1)+"\nSecAction \"id:4,phase:1,nolog,pass\"", backend)
+		require.NotSame(t, a.waf, b.waf)
+		require.Equal(t, http.StatusOK, statusOf(t, a, "/"))
+		require.Equal(t, http.StatusTooManyRequests, statusOf(t, b, "/"))
+	})
+
+	t.Run("session", func(t *testing.T) {
+		m := provisionCollections(t, `SecRuleEngine On
+SecAction "id:1,phase:1,nolog,pass,setsid:%{ARGS.sid}"
+SecRule TX:session.is_new "@eq 1" "id:2,phase:1,nolog,pass,setvar:tx.session.seen=1"
+SecRule TX:session.is_new "@eq 0" "id:3,phase:1,deny,status:403"`, `{"backend": "memory", "name": "test-session"}`)
+		require.Equal(t, http.StatusOK, statusOf(t, m, "/?sid=a"))
+		require.Equal(t, http.StatusForbidden, statusOf(t, m, "/?sid=a"))
+		require.Equal(t, http.StatusOK, statusOf(t, m, "/?sid=b"))
+	})
+
+	t.Run("unchanged records are not stored", func(t *testing.T) {
+		m := provisionCollections(t, `SecRuleEngine On
+SecAction "id:1,phase:1,nolog,pass,setuid:%{ARGS.user}"`, `{"backend": "memory", "name": "test-unchanged"}`)
+		require.Equal(t, http.StatusOK, statusOf(t, m, "/?user=alice"))
+		require.Zero(t, m.collections.(*memoryCollections).store.len())
+	})
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		m := provisionCollections(t, fmt.Sprintf(rateLimitDirectives, 100), `{"backend": "memory", "name": "test-concurrent"}`)
+		const n = 20
+		saves := make([]func(), n)
+		for i := range saves {
+			tx := m.waf.NewTransaction()
+			t.Cleanup(func() { _ = tx.Close() })
+			saves[i] = startCollections(context.Background(), tx, m.collections, m.logger)
+			_, err := processRequest(tx, httptest.NewRequest(http.MethodGet, "/", nil))
+			require.NoError(t, err)
+		}
+
+		// Every transaction loaded the record before any of them stores it.
+		var wg sync.WaitGroup
+		for _, save := range saves {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				save()
+			}()
+		}
+		wg.Wait()
+
+		vars, err := m.collections.Load(context.Background(), "ip", "192.0.2.1")
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(n), vars["hits"])
+		require.Equal(t, strconv.Itoa(n), vars[collectionUpdateCounter])
+	})
+
+	t.Run("without backend", func(t *testing.T) {
+		m := provisionCollections(t, fmt.Sprintf(rateLimitDirectives, 1), "")
+		require.Equal(t, http.StatusOK, statusOf(t, m, "/"))
+		require.Equal(t, http.StatusOK, statusOf(t, m, "/"), "initcol does nothing")
+	})
+}
+
+func TestInitcolAction(t *testing.T) {
+	tests := map[string]struct {
+		action     *initcolAction
+		data       string
+		collection string
+		shouldErr  bool
+	}{
+		"initcol":            {action: &initcolAction{}, data: "IP=%{REMOTE_ADDR}", collection: "ip"},
+		"global":             {action: &initcolAction{}, data: "global=global", collection: "global"},
+		"setsid":             {action: &initcolAction{collection: "session"}, data: "%{REQUEST_COOKIES.sid}", collection: "session"},
+		"unknown collection": {action: &initcolAction{}, data: "tx=1", shouldErr: true},
+		"missing key":        {action: &initcolAction{}, data: "ip=", shouldErr: true},
+		"missing separator":  {action: &initcolAction{}, data: "ip", shouldErr: true},
+		"empty setuid":       {action: &initcolAction{collection: "user"}, data: "", shouldErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.action.Init(nil, test.data)
+			if test.shouldErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.collection, test.action.collection)
+		})
+	}
+}
+
+func TestProvisionCollectionsSettings(t *testing.T) {
+	tests := map[string]*corazaModule{
+		"unknown backend": {Directives: "SecRuleEngine On", CollectionsRaw: json.RawMessage(`{"backend": "redis"}`)},
+		"shadow": {Directives: "SecRuleEngine On", Shadow: &corazaModule{
+			Directives:     "SecRuleEngine On",
+			CollectionsRaw: json.RawMessage(`{"backend": "memory"}`),
+		}},
+	}
+
+	for name, m := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			require.Error(t, m.Provision(ctx))
+		})
+	}
+}
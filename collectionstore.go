@@ -0,0 +1,812 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(memoryCollections{})
+	caddy.RegisterModule(storageCollections{})
+}
+
+const (
+	// defaultCollectionTTL is how long records last without being updated
+	// when no ttl is configured, as SecCollectionTimeout does by default.
+	defaultCollectionTTL = time.Hour
+	// defaultMaxCollectionRecords bounds the memory store when no
+	// max_records is configured.
+	defaultMaxCollectionRecords = 100000
+	// defaultCollectionsPrefix is where the storage store keeps records
+	// when no prefix is configured.
+	defaultCollectionsPrefix = "coraza/collections"
+	// defaultCollectionsTimeout bounds the storage operations of a record
+	// when no timeout is configured.
+	defaultCollectionsTimeout = 5 * time.Second
+	// defaultCollectionsLoadTimeout bounds the loading of a record, which
+	// holds up the request, when no load_timeout is configured.
+	defaultCollectionsLoadTimeout = 100 * time.Millisecond
+	// collectionsCleanupInterval is how often the storage store deletes the
+	// expired records and the ones past max_records.
+	collectionsCleanupInterval = 10 * time.Minute
+	// collectionWriters is the number of records the storage store writes
+	// at once.
+	collectionWriters = 4
+	// maxPendingCollectionRecords is the number of records the storage
+	// store holds updates for before dropping new ones.
+	maxPendingCollectionRecords = 10000
+)
+
+// memoryStores are the memory stores by name, shared by all the WAFs
+// using them and kept across config reloads as long as one config uses
+// them.
+var memoryStores = caddy.NewUsagePool()
+
+// memoryCollections stores persistent collections in memory. Records
+// expire once they have not been updated for TTL, and the least recently
+// used ones are evicted past MaxRecords.
+type memoryCollections struct {
+	// Name identifies the store, the handlers using a memory store with the
+	// same name share its records. Default: default
+	Name string `json:"name,omitempty"`
+	// TTL is how long a record lasts without being updated. Default: 1h
+	TTL caddy.Duration `json:"ttl,omitempty"`
+	// MaxRecords is the number of records kept, across collections.
+	// Default: 100000
+	MaxRecords int `json:"max_records,omitempty"`
+
+	store *memoryStore
+}
+
+// CaddyModule returns the Caddy module information.
+func (memoryCollections) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  collectionsNamespace + ".memory",
+		New: func() caddy.Module { return new(memoryCollections) },
+	}
+}
+
+// Provision implements caddy.Provisioner. The limits of a store are the
+// ones of the config provisioned last.
+func (c *memoryCollections) Provision(_ caddy.Context) error {
+	if c.Name == "" {
+		c.Name = "default"
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("negative ttl")
+	}
+	if c.TTL == 0 {
+		c.TTL = caddy.Duration(defaultCollectionTTL)
+	}
+	if c.MaxRecords < 0 {
+		return fmt.Errorf("negative max_records")
+	}
+	if c.MaxRecords == 0 {
+		c.MaxRecords = defaultMaxCollectionRecords
+	}
+
+	val, _, err := memoryStores.LoadOrNew(c.Name, func() (caddy.Destructor, error) {
+		return newMemoryStore(), nil
+	})
+	if err != nil {
+		return err
+	}
+	c.store = val.(*memoryStore)
+	c.store.setLimits(time.Duration(c.TTL), c.MaxRecords)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (c *memoryCollections) Cleanup() error {
+	if c.store == nil {
+		return nil
+	}
+	_, err := memoryStores.Delete(c.Name)
+	return err
+}
+
+// Load implements CollectionStore.
+func (c *memoryCollections) Load(_ context.Context, collection, key string) (map[string]string, error) {
+	return c.store.load(collection+"\x00"+key, time.Now()), nil
+}
+
+// Update implements CollectionStore.
+func (c *memoryCollections) Update(_ context.Context, collection, key string, update func(map[string]string)) error {
+	c.store.update(collection+"\x00"+key, time.Now(), update)
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	collections memory {
+//	    name <name>
+//	    ttl <duration>
+//	    max_records <n>
+//	}
+func (c *memoryCollections) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume backend name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "name":
+			if !d.Args(&c.Name) {
+				return d.ArgErr()
+			}
+		case "ttl":
+			ttl, err := unmarshalCollectionTTL(d)
+			if err != nil {
+				return err
+			}
+			c.TTL = ttl
+		case "max_records":
+			n, err := unmarshalCollectionMaxRecords(d)
+			if err != nil {
+				return err
+			}
+			c.MaxRecords = n
+		default:
+			return d.Errf("invalid memory collections key %q", d.Val())
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// memoryStore holds records in memory, by least recent use.
+type memoryStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxRecords int
+	records    map[string]*list.Element
+	// lru has the most recently used records at its front.
+	lru *list.List
+}
+
+type memoryRecord struct {
+	id      string
+	vars    map[string]string
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		ttl:        defaultCollectionTTL,
+		maxRecords: defaultMaxCollectionRecords,
+		records:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+func (s *memoryStore) setLimits(ttl time.Duration, maxRecords int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl, s.maxRecords = ttl, maxRecords
+	s.evict()
+}
+
+// get returns the live record id, s.mu must be held.
+func (s *memoryStore) get(id string, now time.Time) *list.Element {
+	e, ok := s.records[id]
+	if !ok {
+		return nil
+	}
+	if !now.Before(e.Value.(*memoryRecord).expires) {
+		s.remove(e)
+		return nil
+	}
+	s.lru.MoveToFront(e)
+	return e
+}
+
+func (s *memoryStore) load(id string, now time.Time) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.get(id, now)
+	if e == nil {
+		return nil
+	}
+	vars := map[string]string{}
+	for k, v := range e.Value.(*memoryRecord).vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+func (s *memoryStore) update(id string, now time.Time, update func(map[string]string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vars := map[string]string{}
+	e := s.get(id, now)
+	if e != nil {
+		for k, v := range e.Value.(*memoryRecord).vars {
+			vars[k] = v
+		}
+	}
+	update(vars)
+
+	switch {
+	case len(vars) == 0:
+		if e != nil {
+			s.remove(e)
+		}
+	case e == nil:
+		s.records[id] = s.lru.PushFront(&memoryRecord{id: id, vars: vars, expires: now.Add(s.ttl)})
+		s.evict()
+	default:
+		r := e.Value.(*memoryRecord)
+		r.vars, r.expires = vars, now.Add(s.ttl)
+	}
+}
+
+// evict removes the least recently used records past the limit, s.mu must
+// be held.
+func (s *memoryStore) evict() {
+	for s.lru.Len() > s.maxRecords {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *memoryStore) remove(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.records, e.Value.(*memoryRecord).id)
+}
+
+// len returns the number of records, expired ones included.
+func (s *memoryStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// Destruct implements caddy.Destructor.
+func (s *memoryStore) Destruct() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.records)
+	s.lru.Init()
+	return nil
+}
+
+// storageCollections stores persistent collections in a Caddy storage,
+// for instances sharing their storage to share their records. Records
+// expire once they have not been updated for TTL, expired records are
+// ignored and replaced when updated.
+//
+// Updates are stored in the background, those of a record waiting to be
+// stored being merged, so that requests never wait for the storage locks.
+// Expired records are deleted periodically, along with the least recently
+// updated ones past MaxRecords.
+type storageCollections struct {
+	// StorageRaw is the storage records are kept in. Default: the storage
+	// of the Caddy config
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	// Prefix is the path records are stored under. Default:
+	// coraza/collections
+	Prefix string `json:"prefix,omitempty"`
+	// TTL is how long a record lasts without being updated. Default: 1h
+	TTL caddy.Duration `json:"ttl,omitempty"`
+	// Timeout is how long storing the updates of a record may take.
+	// Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// LoadTimeout is how long loading a record may take. The request
+	// waits for it, a record that could not be loaded in time is treated
+	// as a new one. Default: 100ms
+	LoadTimeout caddy.Duration `json:"load_timeout,omitempty"`
+	// MaxRecords is the number of records kept under Prefix, across
+	// collections. It is enforced every 10 minutes. Default: 100000
+	MaxRecords int `json:"max_records,omitempty"`
+
+	storage certmagic.Storage
+	logger  *zap.Logger
+	updates *pendingUpdates
+}
+
+// pendingUpdates are the updates a storage store has yet to store.
+type pendingUpdates struct {
+	mu sync.Mutex
+	// byRecord are the updates waiting to be stored, by record path.
+	byRecord map[string][]func(map[string]string)
+	// writing are the records being stored, their new updates wait for
+	// them to be queued again.
+	writing map[string]bool
+	queue   chan string
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// CaddyModule returns the Caddy module information.
+func (storageCollections) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  collectionsNamespace + ".storage",
+		New: func() caddy.Module { return new(storageCollections) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (c *storageCollections) Provision(ctx caddy.Context) error {
+	c.logger = ctx.Logger()
+	if c.Prefix == "" {
+		c.Prefix = defaultCollectionsPrefix
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("negative ttl")
+	}
+	if c.TTL == 0 {
+		c.TTL = caddy.Duration(defaultCollectionTTL)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = caddy.Duration(defaultCollectionsTimeout)
+	}
+	if c.LoadTimeout < 0 {
+		return fmt.Errorf("negative load_timeout")
+	}
+	if c.LoadTimeout == 0 {
+		c.LoadTimeout = caddy.Duration(defaultCollectionsLoadTimeout)
+	}
+	if c.MaxRecords < 0 {
+		return fmt.Errorf("negative max_records")
+	}
+	if c.MaxRecords == 0 {
+		c.MaxRecords = defaultMaxCollectionRecords
+	}
+
+	if c.StorageRaw == nil {
+		c.storage = ctx.Storage()
+	} else {
+		val, err := ctx.LoadModule(c, "StorageRaw")
+		if err != nil {
+			return fmt.Errorf("loading storage module: %v", err)
+		}
+		storage, err := val.(caddy.StorageConverter).CertMagicStorage()
+		if err != nil {
+			return fmt.Errorf("creating storage value: %v", err)
+		}
+		c.storage = storage
+	}
+
+	c.updates = &pendingUpdates{
+		byRecord: map[string][]func(map[string]string){},
+		writing:  map[string]bool{},
+		queue:    make(chan string, maxPendingCollectionRecords),
+		done:     make(chan struct{}),
+	}
+	c.updates.wg.Add(collectionWriters + 1)
+	for range collectionWriters {
+		go c.write()
+	}
+	go c.cleanupPeriodically()
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper. It stops the background work and
+// stores the pending updates, giving them Timeout.
+func (c *storageCollections) Cleanup() error {
+	u := c.updates
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	u.closed = true
+	u.mu.Unlock()
+	close(u.done)
+	u.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout))
+	defer cancel()
+	var errs []error
+	for name, updates := range u.byRecord {
+		if err := c.store(ctx, name, updates); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	clear(u.byRecord)
+	return errors.Join(errs...)
+}
+
+// storedRecord is a record as stored.
+type storedRecord struct {
+	Vars    map[string]string `json:"vars"`
+	Expires time.Time         `json:"expires"`
+}
+
+// recordPath returns where the record of collection under key is stored.
+// Keys are hashed, they are often client provided.
+func (c *storageCollections) recordPath(collection, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(c.Prefix, collection, hex.EncodeToString(sum[:]))
+}
+
+func (c *storageCollections) load(ctx context.Context, name string) (map[string]string, error) {
+	b, err := c.storage.Load(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r storedRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("decoding record %s: %w", name, err)
+	}
+	if !time.Now().Before(r.Expires) {
+		return nil, nil
+	}
+	return r.Vars, nil
+}
+
+// Load implements CollectionStore. The updates of the record waiting to be
+// stored are applied to the stored variables.
+func (c *storageCollections) Load(ctx context.Context, collection, key string) (map[string]string, error) {
+	name := c.recordPath(collection, key)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.LoadTimeout))
+	defer cancel()
+	vars, err := c.load(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.updates.mu.Lock()
+	defer c.updates.mu.Unlock()
+	updates := c.updates.byRecord[name]
+	if len(updates) == 0 {
+		return vars, nil
+	}
+	merged := map[string]string{}
+	for k, v := range vars {
+		merged[k] = v
+	}
+	for _, update := range updates {
+		update(merged)
+	}
+	if len(merged) == 0 {
+		return nil, nil
+	}
+	return merged, nil
+}
+
+// Update implements CollectionStore. The update is queued, it is stored
+// in the background along with the other updates of the record queued
+// meanwhile.
+func (c *storageCollections) Update(_ context.Context, collection, key string, update func(map[string]string)) error {
+	name := c.recordPath(collection, key)
+	u := c.updates
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return fmt.Errorf("storing record %s: store closed", name)
+	}
+	if updates, ok := u.byRecord[name]; ok {
+		u.byRecord[name] = append(updates, update)
+		return nil
+	}
+	if len(u.byRecord) >= maxPendingCollectionRecords {
+		return fmt.Errorf("storing record %s: %d records already waiting to be stored", name, len(u.byRecord))
+	}
+	u.byRecord[name] = []func(map[string]string){update}
+	if !u.writing[name] {
+		u.queue <- name
+	}
+	return nil
+}
+
+// write stores the records queued until the store is closed.
+func (c *storageCollections) write() {
+	u := c.updates
+	defer u.wg.Done()
+	for {
+		select {
+		case <-u.done:
+			return
+		case name := <-u.queue:
+			u.mu.Lock()
+			updates := u.byRecord[name]
+			delete(u.byRecord, name)
+			u.writing[name] = true
+			u.mu.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout))
+			if err := c.store(ctx, name, updates); err != nil {
+				c.logger.Error("Failed to store persistent collection record",
+					zap.String("record", name),
+					zap.Int("updates", len(updates)),
+					zap.Error(err),
+				)
+			}
+			cancel()
+
+			u.mu.Lock()
+			delete(u.writing, name)
+			if _, ok := u.byRecord[name]; ok && !u.closed {
+				u.queue <- name
+			}
+			u.mu.Unlock()
+		}
+	}
+}
+
+// store applies updates to the record stored at name, which is locked in
+// the storage meanwhile.
+func (c *storageCollections) store(ctx context.Context, name string, updates []func(map[string]string)) (err error) {
+	if err := c.storage.Lock(ctx, name); err != nil {
+		return fmt.Errorf("locking record %s: %w", name, err)
+	}
+	defer func() {
+		if uerr := c.storage.Unlock(context.WithoutCancel(ctx), name); uerr != nil {
+			err = errors.Join(err, fmt.Errorf("unlocking record %s: %w", name, uerr))
+		}
+	}()
+
+	vars, err := c.load(ctx, name)
+	if err != nil {
+		return err
+	}
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	for _, update := range updates {
+		update(vars)
+	}
+
+	if len(vars) == 0 {
+		if err := c.storage.Delete(ctx, name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(storedRecord{Vars: vars, Expires: time.Now().Add(time.Duration(c.TTL))})
+	if err != nil {
+		return err
+	}
+	return c.storage.Store(ctx, name, b)
+}
+
+// cleanupPeriodically runs cleanup every collectionsCleanupInterval until
+// the store is closed.
+func (c *storageCollections) cleanupPeriodically() {
+	defer c.updates.wg.Done()
+	ticker := time.NewTicker(collectionsCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.updates.done:
+			return
+		case <-ticker.C:
+			if err := c.cleanup(); err != nil {
+				c.logger.Error("Failed to clean up persistent collections", zap.Error(err))
+			}
+		}
+	}
+}
+
+// cleanup deletes the expired records, then the least recently updated
+// ones past MaxRecords. Records are only loaded when their modification
+// time tells they may have expired.
+func (c *storageCollections) cleanup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout))
+	names, err := c.storage.List(ctx, c.Prefix, true)
+	cancel()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	type record struct {
+		name     string
+		modified time.Time
+	}
+	var live []record
+	expired, evicted := 0, 0
+	now := time.Now()
+	for _, name := range names {
+		select {
+		case <-c.updates.done:
+			return nil
+		default:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout))
+		info, err := c.storage.Stat(ctx, name)
+		if err == nil && info.IsTerminal && !info.Modified.Add(time.Duration(c.TTL)).After(now) {
+			var deleted bool
+			deleted, err = c.deleteRecord(ctx, name, func(r *storedRecord) bool { return !now.Before(r.Expires) })
+			if deleted {
+				expired++
+				cancel()
+				continue
+			}
+		}
+		cancel()
+		if err != nil {
+			c.logger.Warn("Failed to clean up persistent collection record", zap.String("record", name), zap.Error(err))
+		}
+		if err == nil && info.IsTerminal {
+			live = append(live, record{name: name, modified: info.Modified})
+		}
+	}
+
+	if len(live) > c.MaxRecords {
+		slices.SortFunc(live, func(a, b record) int { return a.modified.Compare(b.modified) })
+		for _, r := range live[:len(live)-c.MaxRecords] {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout))
+			deleted, err := c.deleteRecord(ctx, r.name, func(*storedRecord) bool { return true })
+			cancel()
+			if err != nil {
+				c.logger.Warn("Failed to evict persistent collection record", zap.String("record", r.name), zap.Error(err))
+			}
+			if deleted {
+				evicted++
+			}
+		}
+	}
+	if expired > 0 || evicted > 0 {
+		c.logger.Info("Cleaned up persistent collections", zap.Int("expired", expired), zap.Int("evicted", evicted))
+	}
+	return nil
+}
+
+// deleteRecord deletes the record stored at name if remove returns true
+// for it, or if it cannot be decoded. The record is locked meanwhile.
+func (c *storageCollections) deleteRecord(ctx context.Context, name string, remove func(*storedRecord) bool) (deleted bool, err error) {
+	if err := c.storage.Lock(ctx, name); err != nil {
+		return false, fmt.Errorf("locking record %s: %w", name, err)
+	}
+	defer func() {
+		if uerr := c.storage.Unlock(context.WithoutCancel(ctx), name); uerr != nil {
+			err = errors.Join(err, fmt.Errorf("unlocking record %s: %w", name, uerr))
+		}
+	}()
+
+	b, err := c.storage.Load(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var r storedRecord
+	if json.Unmarshal(b, &r) == nil && !remove(&r) {
+		return false, nil
+	}
+	if err := c.storage.Delete(ctx, name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	collections storage {
+//	    storage <module> {
+//	        ...
+//	    }
+//	    prefix <path>
+//	    ttl <duration>
+//	    timeout <duration>
+//	    load_timeout <duration>
+//	    max_records <n>
+//	}
+func (c *storageCollections) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume backend name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "storage":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "caddy.storage."+name)
+			if err != nil {
+				return err
+			}
+			storage, ok := unm.(caddy.StorageConverter)
+			if !ok {
+				return d.Errf("module %s is not a caddy.StorageConverter", name)
+			}
+			c.StorageRaw = caddyconfig.JSONModuleObject(storage, "module", name, nil)
+			continue
+		case "prefix":
+			if !d.Args(&c.Prefix) {
+				return d.ArgErr()
+			}
+		case "ttl":
+			ttl, err := unmarshalCollectionTTL(d)
+			if err != nil {
+				return err
+			}
+			c.TTL = ttl
+		case "timeout", "load_timeout":
+			option := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil || timeout <= 0 {
+				return d.Errf("invalid %s %q, must be a positive duration", option, d.Val())
+			}
+			if option == "timeout" {
+				c.Timeout = caddy.Duration(timeout)
+			} else {
+				c.LoadTimeout = caddy.Duration(timeout)
+			}
+		case "max_records":
+			n, err := unmarshalCollectionMaxRecords(d)
+			if err != nil {
+				return err
+			}
+			c.MaxRecords = n
+		default:
+			return d.Errf("invalid storage collections key %q", d.Val())
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+func unmarshalCollectionTTL(d *caddyfile.Dispenser) (caddy.Duration, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	ttl, err := caddy.ParseDuration(d.Val())
+	if err != nil || ttl <= 0 {
+		return 0, d.Errf("invalid ttl %q, must be a positive duration", d.Val())
+	}
+	return caddy.Duration(ttl), nil
+}
+
+func unmarshalCollectionMaxRecords(d *caddyfile.Dispenser) (int, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	n, err := strconv.Atoi(d.Val())
+	if err != nil || n <= 0 {
+		return 0, d.Errf("invalid max_records %q, must be a positive integer", d.Val())
+	}
+	return n, nil
+}
+
+// Interface guards
+var (
+	_ CollectionStore       = (*memoryCollections)(nil)
+	_ caddy.Provisioner     = (*memoryCollections)(nil)
+	_ caddy.CleanerUpper    = (*memoryCollections)(nil)
+	_ caddyfile.Unmarshaler = (*memoryCollections)(nil)
+	_ caddy.Destructor      = (*memoryStore)(nil)
+	_ CollectionStore       = (*storageCollections)(nil)
+	_ caddy.Provisioner     = (*storageCollections)(nil)
+	_ caddy.CleanerUpper    = (*storageCollections)(nil)
+	_ caddyfile.Unmarshaler = (*storageCollections)(nil)
+)
@@ -0,0 +1,389 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := newMemoryStore()
+	s.setLimits(time.Minute, 2)
+	now := time.Now()
+	set := func(id, value string, at time.Time) {
+		s.update(id, at, func(vars map[string]string) { vars["v"] = value })
+	}
+
+	require.Nil(t, s.load("a", now))
+	set("a", "1", now)
+	require.Equal(t, map[string]string{"v": "1"}, s.load("a", now))
+
+	t.Run("expiry", func(t *testing.T) {
+		require.Nil(t, s.load("a", now.Add(time.Minute)))
+		require.Zero(t, s.len())
+	})
+
+	t.Run("updates extend the ttl", func(t *testing.T) {
+		set("a", "1", now)
+		set("a", "2", now.Add(50*time.Second))
+		require.Equal(t, map[string]string{"v": "2"}, s.load("a", now.Add(100*time.Second)))
+	})
+
+	t.Run("least recently used records are evicted", func(t *testing.T) {
+		set("a", "1", now)
+		set("b", "1", now)
+		s.load("a", now)
+		set("c", "1", now)
+		require.Equal(t, 2, s.len())
+		require.NotNil(t, s.load("a", now))
+		require.Nil(t, s.load("b", now))
+		require.NotNil(t, s.load("c", now))
+	})
+
+	t.Run("emptied records are deleted", func(t *testing.T) {
+		s.update("a", now, func(vars map[string]string) { clear(vars) })
+		require.Nil(t, s.load("a", now))
+		require.Equal(t, 1, s.len())
+	})
+
+	t.Run("loaded variables are copies", func(t *testing.T) {
+		s.load("c", now)["v"] = "changed"
+		require.Equal(t, "1", s.load("c", now)["v"])
+	})
+}
+
+func TestMemoryCollectionsProvision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	a := &memoryCollections{Name: "test-provision"}
+	require.NoError(t, a.Provision(ctx))
+	require.Equal(t, caddy.Duration(defaultCollectionTTL), a.TTL)
+	require.Equal(t, defaultMaxCollectionRecords, a.MaxRecords)
+	require.NoError(t, a.Update(ctx, "ip", "192.0.2.1", func(vars map[string]string) { vars["hits"] = "1" }))
+
+	// A config reload.
+	b := &memoryCollections{Name: "test-provision", MaxRecords: 10}
+	require.NoError(t, b.Provision(ctx))
+	require.NoError(t, a.Cleanup())
+	vars, err := b.Load(ctx, "ip", "192.0.2.1")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"hits": "1"}, vars)
+	require.Equal(t, 10, b.store.maxRecords)
+	require.NoError(t, b.Cleanup())
+
+	require.Error(t, (&memoryCollections{TTL: -1}).Provision(ctx))
+	require.Error(t, (&memoryCollections{MaxRecords: -1}).Provision(ctx))
+}
+
+func TestStorageCollections(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	storage := json.RawMessage(fmt.Sprintf(`{"module": "file_system", "root": %q}`, t.TempDir()))
+	c := &storageCollections{StorageRaw: storage, TTL: caddy.Duration(time.Hour)}
+	require.NoError(t, c.Provision(ctx))
+	t.Cleanup(func() { require.NoError(t, c.Cleanup()) })
+	require.Equal(t, defaultCollectionsPrefix, c.Prefix)
+	require.Equal(t, caddy.Duration(defaultCollectionsTimeout), c.Timeout)
+	require.Equal(t, caddy.Duration(defaultCollectionsLoadTimeout), c.LoadTimeout)
+	require.Equal(t, defaultMaxCollectionRecords, c.MaxRecords)
+
+	vars, err := c.Load(ctx, "ip", "192.0.2.1")
+	require.NoError(t, err)
+	require.Nil(t, vars)
+
+	for i := 1; i <= 2; i++ {
+		require.NoError(t, c.Update(ctx, "ip", "192.0.2.1", func(vars map[string]string) {
+			vars["hits"] = fmt.Sprint(len(vars) + i)
+		}))
+	}
+	vars, err = c.Load(ctx, "ip", "192.0.2.1")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"hits": "3"}, vars)
+	require.Eventually(t, func() bool {
+		vars, err := c.load(ctx, c.recordPath("ip", "192.0.2.1"))
+		return err == nil && vars["hits"] == "3"
+	}, 5*time.Second, 10*time.Millisecond, "updates should be stored in the background")
+
+	other, err := c.Load(ctx, "session", "192.0.2.1")
+	require.NoError(t, err)
+	require.Nil(t, other, "collections are kept apart")
+
+	t.Run("expiry", func(t *testing.T) {
+		expiring := &storageCollections{StorageRaw: storage, TTL: caddy.Duration(time.Nanosecond)}
+		require.NoError(t, expiring.Provision(ctx))
+		require.NoError(t, expiring.Update(ctx, "ip", "192.0.2.2", func(vars map[string]string) { vars["hits"] = "1" }))
+		require.NoError(t, expiring.Cleanup(), "pending updates should be stored on cleanup")
+		time.Sleep(time.Millisecond)
+		vars, err := expiring.Load(ctx, "ip", "192.0.2.2")
+		require.NoError(t, err)
+		require.Nil(t, vars)
+		require.Error(t, expiring.Update(ctx, "ip", "192.0.2.2", func(map[string]string) {}), "a closed store should not queue updates")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, c.Update(ctx, "ip", "192.0.2.1", func(vars map[string]string) { clear(vars) }))
+		require.Eventually(t, func() bool {
+			return !c.storage.Exists(ctx, c.recordPath("ip", "192.0.2.1"))
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+// blockingStorage blocks Lock until released, and Load until the context
+// is done when hung.
+type blockingStorage struct {
+	certmagic.Storage
+	release chan struct{}
+	hung    bool
+	stores  atomic.Int32
+}
+
+func (s *blockingStorage) Lock(ctx context.Context, name string) error {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.Storage.Lock(ctx, name)
+}
+
+func (s *blockingStorage) Load(ctx context.Context, name string) ([]byte, error) {
+	if s.hung {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return s.Storage.Load(ctx, name)
+}
+
+func (s *blockingStorage) Store(ctx context.Context, name string, value []byte) error {
+	s.stores.Add(1)
+	return s.Storage.Store(ctx, name, value)
+}
+
+func TestStorageCollectionsBackground(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	provision := func(t *testing.T, c *storageCollections) *blockingStorage {
+		t.Helper()
+		c.StorageRaw = json.RawMessage(fmt.Sprintf(`{"module": "file_system", "root": %q}`, t.TempDir()))
+		require.NoError(t, c.Provision(ctx))
+		s := &blockingStorage{Storage: c.storage, release: make(chan struct{})}
+		c.storage = s
+		return s
+	}
+	increment := func(vars map[string]string) {
+		n, _ := strconv.Atoi(vars["hits"])
+		vars["hits"] = strconv.Itoa(n + 1)
+	}
+
+	t.Run("updates are merged", func(t *testing.T) {
+		c := &storageCollections{}
+		s := provision(t, c)
+		t.Cleanup(func() { require.NoError(t, c.Cleanup()) })
+
+		// The first update waits for the lock, the next ones for it to be
+		// stored.
+		require.NoError(t, c.Update(ctx, "ip", "192.0.2.1", increment))
+		require.Eventually(t, func() bool {
+			c.updates.mu.Lock()
+			defer c.updates.mu.Unlock()
+			return c.updates.writing[c.recordPath("ip", "192.0.2.1")]
+		}, 5*time.Second, time.Millisecond)
+		for range 3 {
+			require.NoError(t, c.Update(ctx, "ip", "192.0.2.1", increment))
+		}
+		vars, err := c.Load(ctx, "ip", "192.0.2.1")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"hits": "3"}, vars, "updates waiting to be stored should be loaded")
+
+		close(s.release)
+		require.Eventually(t, func() bool {
+			vars, err := c.load(ctx, c.recordPath("ip", "192.0.2.1"))
+			return err == nil && vars["hits"] == "4"
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, int32(2), s.stores.Load())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		c := &storageCollections{Timeout: caddy.Duration(20 * time.Millisecond), LoadTimeout: caddy.Duration(10 * time.Millisecond)}
+		s := provision(t, c)
+		s.hung = true
+
+		start := time.Now()
+		_, err := c.Load(ctx, "ip", "192.0.2.1")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, time.Since(start), time.Second)
+
+		reqCtx, cancelReq := context.WithCancel(ctx)
+		cancelReq()
+		_, err = c.Load(reqCtx, "ip", "192.0.2.1")
+		require.ErrorIs(t, err, context.Canceled, "loads should stop with the request")
+
+		close(s.release)
+		require.NoError(t, c.Update(ctx, "ip", "192.0.2.1", increment), "updates should not wait for the storage")
+		require.Eventually(t, func() bool {
+			c.updates.mu.Lock()
+			defer c.updates.mu.Unlock()
+			return len(c.updates.byRecord) == 0 && len(c.updates.writing) == 0
+		}, 5*time.Second, 10*time.Millisecond, "writers should give up on a hung storage")
+		require.NoError(t, c.Cleanup())
+	})
+}
+
+func TestStorageCollectionsCleanup(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	root := t.TempDir()
+	storage := json.RawMessage(fmt.Sprintf(`{"module": "file_system", "root": %q}`, root))
+	c := &storageCollections{
+		StorageRaw: storage,
+		TTL:        caddy.Duration(time.Minute),
+		MaxRecords: 2,
+	}
+	require.NoError(t, c.Provision(ctx))
+	t.Cleanup(func() { require.NoError(t, c.Cleanup()) })
+
+	now := time.Now()
+	put := func(key string, expires time.Time, modified time.Time) string {
+		t.Helper()
+		name := c.recordPath("ip", key)
+		b, err := json.Marshal(storedRecord{Vars: map[string]string{"hits": "1"}, Expires: expires})
+		require.NoError(t, err)
+		require.NoError(t, c.storage.Store(ctx, name, b))
+		require.NoError(t, os.Chtimes(filepath.Join(root, name), modified, modified))
+		return name
+	}
+	expired := put("expired", now.Add(-time.Second), now.Add(-2*time.Minute))
+	// Updated by another instance since its modification time was read.
+	extended := put("extended", now.Add(time.Minute), now.Add(-70*time.Second))
+	oldest := put("oldest", now.Add(time.Minute), now.Add(-90*time.Second))
+	recent := put("recent", now.Add(time.Minute), now)
+	corrupted := c.recordPath("ip", "corrupted")
+	require.NoError(t, c.storage.Store(ctx, corrupted, []byte("{")))
+	require.NoError(t, os.Chtimes(filepath.Join(root, corrupted), now.Add(-2*time.Minute), now.Add(-2*time.Minute)))
+
+	require.NoError(t, c.cleanup())
+	require.False(t, c.storage.Exists(ctx, expired))
+	require.False(t, c.storage.Exists(ctx, corrupted))
+	require.False(t, c.storage.Exists(ctx, oldest), "the least recently updated records should be evicted past max_records")
+	require.True(t, c.storage.Exists(ctx, extended))
+	require.True(t, c.storage.Exists(ctx, recent))
+
+	empty := &storageCollections{Prefix: "unused", StorageRaw: storage}
+	require.NoError(t, empty.Provision(ctx))
+	t.Cleanup(func() { require.NoError(t, empty.Cleanup()) })
+	require.NoError(t, empty.cleanup())
+}
+
+func TestUnmarshalCollections(t *testing.T) {
+	tests := map[string]struct {
+		input     string
+		want      string
+		shouldErr bool
+	}{
+		"memory": {
+			input: `coraza_waf {
+				collections memory {
+					name shared
+					ttl 10m
+					max_records 500
+				}
+			}`,
+			want: `{"backend":"memory","name":"shared","ttl":600000000000,"max_records":500}`,
+		},
+		"memory defaults": {
+			input: `coraza_waf {
+				collections memory
+			}`,
+			want: `{"backend":"memory"}`,
+		},
+		"storage": {
+			input: `coraza_waf {
+				collections storage {
+					storage file_system {
+						root /var/lib/coraza
+					}
+					prefix waf
+					ttl 1h
+					timeout 2s
+					load_timeout 50ms
+					max_records 5000
+				}
+			}`,
+			want: `{"backend":"storage","storage":{"module":"file_system","root":"/var/lib/coraza"},"prefix":"waf","ttl":3600000000000,"timeout":2000000000,"load_timeout":50000000,"max_records":5000}`,
+		},
+		"unknown backend": {
+			input:     `coraza_waf { collections redis }`,
+			shouldErr: true,
+		},
+		"invalid ttl": {
+			input: `coraza_waf {
+				collections memory {
+					ttl -1s
+				}
+			}`,
+			shouldErr: true,
+		},
+		"invalid max_records": {
+			input: `coraza_waf {
+				collections memory {
+					max_records lots
+				}
+			}`,
+			shouldErr: true,
+		},
+		"invalid timeout": {
+			input: `coraza_waf {
+				collections storage {
+					timeout 0s
+				}
+			}`,
+			shouldErr: true,
+		},
+		"invalid load_timeout": {
+			input: `coraza_waf {
+				collections storage {
+					load_timeout soon
+				}
+			}`,
+			shouldErr: true,
+		},
+		"unknown option": {
+			input: `coraza_waf {
+				collections storage {
+					bucket waf
+				}
+			}`,
+			shouldErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &corazaModule{}
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.input))
+			if test.shouldErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.JSONEq(t, test.want, string(m.CollectionsRaw))
+		})
+	}
+}
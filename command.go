@@ -0,0 +1,330 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "coraza",
+		Usage: "<command>",
+		Short: "Tools for the Coraza WAF handler",
+		Long: `
+Tools to inspect the Coraza WAF handlers (http.handlers.waf) defined in a
+config file, without starting a server.
+
+Every command takes the config file as argument. If it is not in Caddy's
+native JSON format, the adapter can be specified with --adapter. When no
+file is given, the Caddyfile in the current directory is used.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			check := &cobra.Command{
+				Use:   "check [<config>] [--adapter <name>]",
+				Short: "Compiles the rules of every WAF handler and prints rule counts per phase",
+				Long: `
+Compiles the rules of every WAF handler found in the config and prints the
+number of rules per phase. Exits with a non-zero status if any of them
+fails to compile.`,
+				Args: cobra.MaximumNArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdCheck),
+			}
+			check.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+
+			rules := &cobra.Command{
+				Use:   "rules [<config>] [--adapter <name>]",
+				Short: "Lists the rules of every WAF handler",
+				Long: `
+Lists every rule of every WAF handler found in the config, along with its
+phase, tags and the file it is defined in.`,
+				Args: cobra.MaximumNArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdRules),
+			}
+			rules.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+
+			cmd.AddCommand(check, rules, newEvalCommand())
+		},
+	})
+}
+
+func cmdCheck(fl caddycmd.Flags) (int, error) {
+	handlers, err := loadWAFHandlers(fl.Arg(0), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return checkWAFHandlers(os.Stdout, handlers)
+}
+
+func cmdRules(fl caddycmd.Flags) (int, error) {
+	handlers, err := loadWAFHandlers(fl.Arg(0), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return listWAFRules(os.Stdout, handlers)
+}
+
+// wafHandler is a WAF handler found in a JSON config.
+type wafHandler struct {
+	// path is the location of the handler in the config, e.g.
+	// apps.http.servers.srv0.routes[0].handle[0]
+	path string
+	// hosts are the hosts matched by the routes leading to the handler.
+	hosts  []string
+	module *corazaModule
+}
+
+// String returns a human friendly name for the handler.
+func (h wafHandler) String() string {
+	if len(h.hosts) == 0 {
+		return h.path
+	}
+	return fmt.Sprintf("%s (%s)", h.path, strings.Join(h.hosts, ", "))
+}
+
+// loadWAFHandlers loads and adapts the given config file and returns the WAF
+// handlers it defines.
+func loadWAFHandlers(configFile, adapter string) ([]wafHandler, error) {
+	config, _, _, err := caddycmd.LoadConfig(configFile, adapter)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, fmt.Errorf("no config file to load")
+	}
+	return findWAFHandlers(config)
+}
+
+// findWAFHandlers walks a JSON config looking for WAF handlers.
+func findWAFHandlers(config []byte) ([]wafHandler, error) {
+	var root any
+	if err := json.Unmarshal(config, &root); err != nil {
+		return nil, fmt.Errorf("decoding config: %v", err)
+	}
+
+	var handlers []wafHandler
+	var walk func(node any, path string, hosts []string) error
+	walk = func(node any, path string, hosts []string) error {
+		switch n := node.(type) {
+		case map[string]any:
+			if n["handler"] == "waf" {
+				raw, err := json.Marshal(n)
+				if err != nil {
+					return err
+				}
+				m := new(corazaModule)
+				if err := json.Unmarshal(raw, m); err != nil {
+					return fmt.Errorf("%s: decoding WAF handler: %v", path, err)
+				}
+				handlers = append(handlers, wafHandler{path: path, hosts: hosts, module: m})
+				return nil
+			}
+
+			hosts = appendMatchedHosts(hosts, n["match"])
+			keys := make([]string, 0, len(n))
+			for k := range n {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				p := k
+				if path != "" {
+					p = path + "." + k
+				}
+				if err := walk(n[k], p, hosts); err != nil {
+					return err
+				}
+			}
+		case []any:
+			for i, v := range n {
+				if err := walk(v, path+"["+strconv.Itoa(i)+"]", hosts); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := walk(root, "", nil); err != nil {
+		return nil, err
+	}
+
+	profiles, err := findWAFProfiles(root)
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range handlers {
+		if h.module.Use == "" {
+			continue
+		}
+		p, ok := profiles[h.module.Use]
+		if !ok || p == nil {
+			return nil, fmt.Errorf("%s: unknown WAF profile %q", h.path, h.module.Use)
+		}
+		// The handler keeps its own exclusions on top of the profile.
+		resolved := *p
+		resolved.Exclusions = h.module.Exclusions
+		handlers[i].module = &resolved
+	}
+	return handlers, nil
+}
+
+// findWAFProfiles returns the profiles defined in the coraza app of a JSON
+// config.
+func findWAFProfiles(root any) (map[string]*corazaModule, error) {
+	r, _ := root.(map[string]any)
+	apps, _ := r["apps"].(map[string]any)
+	raw, ok := apps["coraza"]
+	if !ok {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	app := new(App)
+	if err := json.Unmarshal(data, app); err != nil {
+		return nil, fmt.Errorf("apps.coraza: decoding coraza app: %v", err)
+	}
+	return app.Profiles, nil
+}
+
+// appendMatchedHosts appends the hosts matched by a route's matcher sets.
+func appendMatchedHosts(hosts []string, match any) []string {
+	sets, ok := match.([]any)
+	if !ok {
+		return hosts
+	}
+	var matched []string
+	for _, set := range sets {
+		s, ok := set.(map[string]any)
+		if !ok {
+			continue
+		}
+		hs, _ := s["host"].([]any)
+		for _, h := range hs {
+			if h, ok := h.(string); ok {
+				matched = append(matched, h)
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return hosts
+	}
+	// Routes are nested, the innermost hosts are the most relevant.
+	return matched
+}
+
+// compile builds the WAF of the handler outside of the pool and provisions
+// its exclusions. The shadow rule set, if any, is compiled too but only
+// its errors are reported.
+func (h wafHandler) compile() (*compiledWAF, error) {
+	if h.module.Shadow != nil {
+		h.module.Shadow.detectionOnly = true
+		shadow, err := wafHandler{module: h.module.Shadow}.compile()
+		if err != nil {
+			return nil, fmt.Errorf("shadow: %w", err)
+		}
+		_ = shadow.Close()
+	}
+
+	h.module.logger = zap.NewNop()
+	if err := h.module.expandPlaceholders(); err != nil {
+		return nil, err
+	}
+	if len(h.module.Exclusions) > 0 {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		defer cancel()
+		for i, e := range h.module.Exclusions {
+			if err := e.provision(ctx); err != nil {
+				return nil, fmt.Errorf("exclusion %d: %w", i, err)
+			}
+		}
+	}
+	if h.module.BlockResponse != nil {
+		if err := h.module.BlockResponse.provision(); err != nil {
+			return nil, fmt.Errorf("block_response: %w", err)
+		}
+	}
+	waf, err := h.module.buildWAF()
+	if err != nil {
+		return nil, err
+	}
+	return waf.(*compiledWAF), nil
+}
+
+// checkWAFHandlers compiles every handler and prints the number of rules per
+// phase.
+func checkWAFHandlers(w io.Writer, handlers []wafHandler) (int, error) {
+	if len(handlers) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no WAF handler found in config")
+	}
+
+	failed := 0
+	for _, h := range handlers {
+		waf, err := h.compile()
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "%s: FAILED\n  %v\n", h, err)
+			continue
+		}
+
+		rules := withoutMarkers(waf.rules)
+		perPhase := map[string]int{}
+		for _, r := range rules {
+			perPhase[phaseName(r.Phase())]++
+		}
+		fmt.Fprintf(w, "%s: OK, %d rules\n", h, len(rules))
+		for _, phase := range []string{"request_headers", "request_body", "response_headers", "response_body", "logging"} {
+			fmt.Fprintf(w, "  %-17s %d\n", phase, perPhase[phase])
+		}
+		_ = waf.Close()
+	}
+
+	if failed > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d of %d WAF handlers failed to compile", failed, len(handlers))
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// listWAFRules prints the rules of every handler.
+func listWAFRules(w io.Writer, handlers []wafHandler) (int, error) {
+	if len(handlers) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no WAF handler found in config")
+	}
+
+	for i, h := range handlers {
+		waf, err := h.compile()
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("%s: %v", h, err)
+		}
+
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s:\n", h)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tPHASE\tFILE\tTAGS")
+		for _, r := range withoutMarkers(waf.rules) {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", r.ID(), phaseName(r.Phase()), r.File(), strings.Join(r.Tags(), ","))
+		}
+		if err := tw.Flush(); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		_ = waf.Close()
+	}
+	return caddy.ExitCodeSuccess, nil
+}
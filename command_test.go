@@ -0,0 +1,136 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCaddyfile(t *testing.T, content string) string {
+	t.Helper()
+	caddyfile := filepath.Join(t.TempDir(), "Caddyfile")
+	require.NoError(t, os.WriteFile(caddyfile, []byte(content), 0644))
+	return caddyfile
+}
+
+func TestFindWAFHandlers(t *testing.T) {
+	caddyfile := writeCaddyfile(t, `{
+		order coraza_waf first
+	}
+
+	example.com {
+		coraza_waf {
+			directives `+"`"+`SecRuleEngine On`+"`"+`
+		}
+		respond "ok"
+	}
+
+	:8080 {
+		coraza_waf {
+			load_owasp_crs
+		}
+		respond "ok"
+	}`)
+
+	handlers, err := loadWAFHandlers(caddyfile, "caddyfile")
+	require.NoError(t, err)
+	require.Len(t, handlers, 2)
+
+	var hosts [][]string
+	for _, h := range handlers {
+		require.Contains(t, h.path, "apps.http.servers.")
+		hosts = append(hosts, h.hosts)
+	}
+	require.Contains(t, hosts, []string{"example.com"})
+	require.Contains(t, hosts, []string(nil))
+}
+
+func TestCheckWAFHandlers(t *testing.T) {
+	handlers, err := findWAFHandlers([]byte(`{
+		"apps": {"http": {"servers": {"srv0": {"routes": [
+			{
+				"match": [{"host": ["example.com"]}],
+				"handle": [{
+					"handler": "waf",
+					"directives": "SecRule REQUEST_URI \"/a\" \"id:1,phase:1,deny\"\nSecMarker END\nSecRule RESPONSE_BODY \"leak\" \"id:2,phase:4,deny\""
+				}]
+			}
+		]}}}}
+	}`))
+	require.NoError(t, err)
+	require.Len(t, handlers, 1)
+	require.Equal(t, "apps.http.servers.srv0.routes[0].handle[0] (example.com)", handlers[0].String())
+
+	var out bytes.Buffer
+	code, err := checkWAFHandlers(&out, handlers)
+	require.NoError(t, err)
+	require.Equal(t, caddy.ExitCodeSuccess, code)
+	require.Contains(t, out.String(), "apps.http.servers.srv0.routes[0].handle[0] (example.com): OK, 2 rules")
+	require.Regexp(t, `request_headers\s+1\n`, out.String(), "SecMarkers are not rules")
+	require.Regexp(t, `response_body\s+1\n`, out.String())
+
+	handlers[0].module.Directives = `SecRule REQUEST_URI "/a" "id:1,phase:1,notanaction"`
+	out.Reset()
+	code, err = checkWAFHandlers(&out, handlers)
+	require.Error(t, err)
+	require.Equal(t, caddy.ExitCodeFailedStartup, code)
+	require.Contains(t, out.String(), "FAILED")
+	require.Contains(t, out.String(), "directives:1 (rule id 1)")
+
+	handlers[0].module.Directives = `SecRule REQUEST_URI "/a" "id:1,phase:1,deny"`
+	handlers[0].module.Shadow = &corazaModule{Directives: `SecRule REQUEST_URI "/b" "id:3,phase:1,notanaction"`}
+	out.Reset()
+	code, err = checkWAFHandlers(&out, handlers)
+	require.Error(t, err, "a broken shadow rule set should fail the check")
+	require.Equal(t, caddy.ExitCodeFailedStartup, code)
+	require.Contains(t, out.String(), "shadow: directives:1 (rule id 3)")
+}
+
+func TestListWAFRules(t *testing.T) {
+	handlers, err := findWAFHandlers([]byte(`{
+		"handler": "waf",
+		"directives": "SecRule REQUEST_URI \"/a\" \"id:1,phase:1,deny,tag:'attack-test',tag:'custom'\""
+	}`))
+	require.NoError(t, err)
+	require.Len(t, handlers, 1)
+
+	var out bytes.Buffer
+	code, err := listWAFRules(&out, handlers)
+	require.NoError(t, err)
+	require.Equal(t, caddy.ExitCodeSuccess, code)
+	require.Regexp(t, `1\s+request_headers\s+_inline_\s+attack-test,custom`, out.String())
+}
+
+func TestCheckWAFHandlersWithoutHandlers(t *testing.T) {
+	_, err := checkWAFHandlers(&bytes.Buffer{}, nil)
+	require.Error(t, err)
+}
+
+func TestFindWAFHandlersResolvesProfiles(t *testing.T) {
+	config := []byte(`{
+		"apps": {
+			"coraza": {"profiles": {"strict": {"directives": "SecRule REQUEST_URI \"/a\" \"id:1,phase:1,deny\""}}},
+			"http": {"servers": {"srv0": {"routes": [
+				{"handle": [{"handler": "waf", "use": "strict"}]}
+			]}}}
+		}
+	}`)
+	handlers, err := findWAFHandlers(config)
+	require.NoError(t, err)
+	require.Len(t, handlers, 1)
+
+	var out bytes.Buffer
+	_, err = checkWAFHandlers(&out, handlers)
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "OK, 1 rules")
+
+	_, err = findWAFHandlers([]byte(`{"handler": "waf", "use": "api"}`))
+	require.ErrorContains(t, err, `unknown WAF profile "api"`)
+}
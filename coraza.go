@@ -5,23 +5,27 @@ package coraza
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	coreruleset "github.com/corazawaf/coraza-coreruleset/v4"
 	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental"
 	"github.com/corazawaf/coraza/v3/types"
-	"github.com/jcchavezs/mergefs"
-	mergefsio "github.com/jcchavezs/mergefs/io"
 	"go.uber.org/zap"
 )
 
@@ -40,30 +44,200 @@ func init() {
 // It implements caddy.Destructor so the pool can clean it up when all
 // references are released.
 type pooledWAF struct {
-	waf coraza.WAF
+	key string
+	// mu guards waf, which Destruct clears while the admin API may be
+	// reading it.
+	mu    sync.Mutex
+	waf   coraza.WAF
+	stats wafStats
+	// crsVersion is the version of the embedded OWASP Core Rule Set the
+	// WAF loads, if any.
+	crsVersion string
+	overrides  *wafOverrides
+	// source is what waf was built from, for rebuilds.
+	source wafSource
 }
 
 func (p *pooledWAF) Destruct() error {
+	forgetBuild(p.key)
+	p.overrides.close()
+	p.mu.Lock()
+	waf := p.waf
+	p.waf = nil
+	p.mu.Unlock()
 	var err error
-	if c, ok := p.waf.(io.Closer); ok {
+	if c, ok := waf.(io.Closer); ok {
 		if cerr := c.Close(); cerr != nil {
 			err = fmt.Errorf("closing WAF: %w", cerr)
 		}
 	}
-	p.waf = nil
 	return err
 }
 
+// current returns the WAF of p, nil once p was destructed.
+func (p *pooledWAF) current() coraza.WAF {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waf
+}
+
+// wafSource is the part of a module's configuration a WAF is built from.
+// Pool entries own a copy, so that the WAF can be rebuilt in the
+// background long after the module that created the entry is gone.
+type wafSource struct {
+	include       []string
+	directives    string
+	loadOWASPCRS  bool
+	crs           *crsSettings
+	ruleEngine    string
+	detectionOnly bool
+	poolKey       string
+	logger        *zap.Logger
+}
+
+// wafSource returns a copy of the configuration m builds its WAF from.
+func (m *corazaModule) wafSource() wafSource {
+	var crs *crsSettings
+	if m.CRS != nil {
+		c := *m.CRS
+		c.AllowedMethods = slices.Clone(c.AllowedMethods)
+		c.AllowedContentTypes = slices.Clone(c.AllowedContentTypes)
+		c.RestrictedExtensions = slices.Clone(c.RestrictedExtensions)
+		crs = &c
+	}
+	return wafSource{
+		include:       slices.Clone(m.Include),
+		directives:    m.Directives,
+		loadOWASPCRS:  m.LoadOWASPCRS,
+		crs:           crs,
+		ruleEngine:    m.ruleEngine,
+		detectionOnly: m.detectionOnly,
+		poolKey:       m.poolKey,
+		logger:        m.logger,
+	}
+}
+
+// module returns a throwaway module configured with s only.
+func (s wafSource) module() *corazaModule {
+	return &corazaModule{
+		Include:       s.include,
+		Directives:    s.directives,
+		LoadOWASPCRS:  s.loadOWASPCRS,
+		CRS:           s.crs,
+		ruleEngine:    s.ruleEngine,
+		detectionOnly: s.detectionOnly,
+		poolKey:       s.poolKey,
+		logger:        s.logger,
+	}
+}
+
+// build compiles a new WAF out of s.
+func (s wafSource) build() (coraza.WAF, error) {
+	return s.module().buildWAF()
+}
+
+// includesDigest returns the digest of the rule files s references.
+func (s wafSource) includesDigest() []byte {
+	return s.module().includesDigest()
+}
+
 // corazaModule is a Web Application Firewall implementation for Caddy.
 type corazaModule struct {
 	// deprecated
-	Include      []string `json:"include"`
-	Directives   string   `json:"directives"`
-	LoadOWASPCRS bool     `json:"load_owasp_crs"`
-
-	logger  *zap.Logger
-	waf     coraza.WAF
-	poolKey string
+	Include []string `json:"include"`
+	// Directives are the SecLang directives of the WAF. Global
+	// placeholders such as {env.*} and {file.*} are expanded when the
+	// module is provisioned, {time.*} placeholders are rejected.
+	Directives   string `json:"directives"`
+	LoadOWASPCRS bool   `json:"load_owasp_crs"`
+
+	// CRS tunes the OWASP Core Rule Set loaded with load_owasp_crs. The
+	// settings are turned into setup actions defined before the
+	// directives, which must not set the same variables.
+	CRS *crsSettings `json:"crs,omitempty"`
+
+	// Watch enables rebuilding the WAF in the background whenever one of
+	// the rule files referenced by the directives changes, without a
+	// config reload. If the new rules fail to compile, the previous WAF
+	// stays in service.
+	Watch bool `json:"watch,omitempty"`
+	// WatchInterval is how often rule files are checked for changes.
+	// Default: 2s
+	WatchInterval caddy.Duration `json:"watch_interval,omitempty"`
+
+	// Use is the name of a profile defined in the coraza app whose WAF
+	// this handler shares. It cannot be combined with the options above.
+	Use string `json:"use,omitempty"`
+
+	// TransactionID is where transaction IDs come from: "random",
+	// "uuidv7", "caddy_uuid" to reuse {http.request.uuid} and join WAF logs
+	// with access logs, or "header" to trust the ID set by a proxy in
+	// TransactionIDHeader. When the source has no valid ID, a random one
+	// is used. Default: random
+	TransactionID string `json:"transaction_id,omitempty"`
+	// TransactionIDHeader is the request header holding the transaction
+	// ID, for the "header" source.
+	TransactionIDHeader string `json:"transaction_id_header,omitempty"`
+	// TransactionIDResponseHeader is a response header the transaction ID
+	// is echoed in, even when the request is blocked.
+	TransactionIDResponseHeader string `json:"transaction_id_response_header,omitempty"`
+
+	// BlockResponse is the response to denied requests. When unset, the
+	// handler returns an error carrying the status code of the deny action
+	// to Caddy, for handle_errors routes to respond.
+	BlockResponse *blockResponse `json:"block_response,omitempty"`
+
+	// SkipMatchersRaw selects requests the WAF does not inspect at all,
+	// such as static assets. Matching requests are passed to the next
+	// handler without a transaction. Matcher sets are OR'ed, matchers
+	// within a set are AND'ed together.
+	SkipMatchersRaw caddyhttp.RawMatcherSets `json:"skip_matchers,omitempty" caddy:"namespace=http.matchers"`
+
+	// Exclusions disable rules for the requests matching Caddy request
+	// matchers, on top of the rules the WAF was built with.
+	Exclusions []*ruleExclusion `json:"exclusions,omitempty"`
+
+	// Shadow is a candidate rule set run in detection only mode on the
+	// same transactions as the rules above. Requests it would have blocked
+	// while the WAF let them through, and the other way around, are
+	// logged. Its transactions are identified by the ID of the enforcing
+	// ones followed by "-shadow".
+	Shadow *corazaModule `json:"shadow,omitempty"`
+
+	// SampleRate is the fraction of requests the rules are evaluated for,
+	// between 0 and 1. The other requests still get a transaction ID and
+	// are counted, but go through untouched. Default: 1
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	// SampleBy is what the sampling decision is based on: "request" hashes
+	// the method, host and URI of the request, or its transaction ID when
+	// it is taken from a header, so a retried request gets the same
+	// decision. "client_ip" inspects either all or none of the requests of
+	// a client. Default: request
+	SampleBy string `json:"sample_by,omitempty"`
+
+	// CollectionsRaw is the backend storing the persistent collections
+	// loaded by the initcol, setsid and setuid actions. Without one, these
+	// actions do nothing.
+	CollectionsRaw json.RawMessage `json:"collections,omitempty" caddy:"namespace=http.handlers.waf.collections inline_key=backend"`
+
+	// detectionOnly forces the rule engine to DetectionOnly, for shadow
+	// rule sets.
+	detectionOnly bool
+	// ruleEngine forces the rule engine to the given mode, for runtime
+	// overrides.
+	ruleEngine string
+
+	skipMatchers caddyhttp.MatcherSets
+	collections  CollectionStore
+
+	logger    *zap.Logger
+	waf       coraza.WAF
+	stats     *wafStats
+	overrides *wafOverrides
+	poolKey   string
+	// app is the coraza app holding the WAF of the module, nil if the
+	// module holds a pool reference of its own.
+	app *App
 }
 
 // CaddyModule returns the Caddy module information.
@@ -77,34 +251,193 @@ func (corazaModule) CaddyModule() caddy.ModuleInfo {
 // Provision implements caddy.Provisioner.
 func (m *corazaModule) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger(m)
+	if err := registerMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("registering metrics: %v", err)
+	}
+	if err := m.validateSampling(); err != nil {
+		return err
+	}
+	if err := m.validateTransactionID(); err != nil {
+		return err
+	}
+	if m.BlockResponse != nil {
+		if err := m.BlockResponse.provision(); err != nil {
+			return fmt.Errorf("block_response: %w", err)
+		}
+	}
+	if m.SkipMatchersRaw != nil {
+		matchers, err := ctx.LoadModule(m, "SkipMatchersRaw")
+		if err != nil {
+			return fmt.Errorf("loading skip matchers: %v", err)
+		}
+		if err := m.skipMatchers.FromInterface(matchers); err != nil {
+			return err
+		}
+	}
+	if m.CollectionsRaw != nil {
+		val, err := ctx.LoadModule(m, "CollectionsRaw")
+		if err != nil {
+			return fmt.Errorf("loading collections backend: %v", err)
+		}
+		m.collections = val.(CollectionStore)
+	}
+	for i, e := range m.Exclusions {
+		if err := e.provision(ctx); err != nil {
+			return fmt.Errorf("exclusion %d: %w", i, err)
+		}
+	}
+
+	if m.Shadow != nil {
+		if m.Shadow.Shadow != nil {
+			return errors.New("shadow: a shadow rule set cannot have a shadow")
+		}
+		if m.Shadow.hasHandlerSettings() {
+			return errors.New("shadow: handler settings such as sample_rate, skip, transaction_id, block_response and collections are set on the enforcing handler")
+		}
+		m.Shadow.detectionOnly = true
+		if err := m.Shadow.Provision(ctx); err != nil {
+			return fmt.Errorf("shadow: %w", err)
+		}
+	}
+
+	if m.Use != "" {
+		return m.useProfile(ctx)
+	}
+	// The key must tell apart the same directives expanded differently.
+	if err := m.expandPlaceholders(); err != nil {
+		return err
+	}
 	m.poolKey = m.computePoolKey()
 
+	app, err := configApp(ctx)
+	if err != nil {
+		return err
+	}
+	var pooled *pooledWAF
+	if app != nil {
+		pooled, err = app.loadWAF(m)
+		m.app = app
+	} else {
+		pooled, err = m.loadPooledWAF()
+	}
+	if err != nil {
+		return err
+	}
+	m.waf, m.stats, m.overrides = pooled.current(), &pooled.stats, pooled.overrides
+	if app == nil {
+		// Outside of a config, there is nothing left that could fail.
+		auditLogger.Store(m.logger)
+	}
+	return nil
+}
+
+// loadPooledWAF returns the WAF of the pool entry for the module's
+// configuration, building it first if needed.
+func (m *corazaModule) loadPooledWAF() (*pooledWAF, error) {
 	val, loaded, err := wafPool.LoadOrNew(m.poolKey, func() (caddy.Destructor, error) {
-		waf, err := m.buildWAF()
-		if err != nil {
-			return nil, err
-		}
-		return &pooledWAF{waf: waf}, nil
+		return newPooledWAF(m)
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	m.waf = val.(*pooledWAF).waf
+	pooled := val.(*pooledWAF)
 	if loaded {
 		m.logger.Info("reusing existing WAF instance from pool")
+		pooled.overrides.reload()
 	}
-	return nil
+	return pooled, nil
+}
+
+// newPooledWAF builds the WAF of m, ready to be stored in the pool.
+func newPooledWAF(m *corazaModule) (*pooledWAF, error) {
+	source := m.wafSource()
+	waf, err := source.build()
+	if err != nil {
+		return nil, err
+	}
+	overrides := newWAFOverrides(source)
+	if m.Watch {
+		waf = newReloadableWAF(waf, source, time.Duration(m.WatchInterval), overrides.rebuild)
+	}
+	pooled := &pooledWAF{key: m.poolKey, waf: waf, source: source, overrides: overrides}
+	if m.LoadOWASPCRS {
+		pooled.crsVersion = crsVersion()
+	}
+	return pooled, nil
+}
+
+// lookupPooledWAF returns the pool entry stored under key, if any, without
+// taking a reference.
+func lookupPooledWAF(key string) *pooledWAF {
+	var pooled *pooledWAF
+	wafPool.Range(func(k, value any) bool {
+		if k == key {
+			pooled = value.(*pooledWAF)
+			return false
+		}
+		return true
+	})
+	return pooled
 }
 
-// buildWAF creates a new coraza.WAF from the module's configuration.
+// hasHandlerSettings reports whether m sets options that only apply to
+// the handler serving requests, not to the rule set itself.
+func (m *corazaModule) hasHandlerSettings() bool {
+	return m.SampleRate != 0 || m.SampleBy != "" || m.SkipMatchersRaw != nil ||
+		m.TransactionID != "" || m.TransactionIDHeader != "" || m.TransactionIDResponseHeader != "" ||
+		m.BlockResponse != nil || m.CollectionsRaw != nil
+}
+
+// buildWAF creates a new coraza.WAF from the module's configuration, after
+// registering the plugins provided by Caddy modules. Compilation errors are
+// reported along with the location of the directive that caused them.
 func (m *corazaModule) buildWAF() (coraza.WAF, error) {
+	if err := registerPlugins(); err != nil {
+		return nil, err
+	}
+
+	config, err := m.wafConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	var rules []types.RuleMetadata
+	waf, err := coraza.NewWAF(experimental.WAFConfigWithRuleObserver(config, func(rule types.RuleMetadata) {
+		rules = append(rules, rule)
+	}))
+	if err != nil {
+		return nil, m.locateError(config, err)
+	}
+	duration := time.Since(start)
+	if m.poolKey != "" {
+		observeBuild(m.poolKey, duration, len(rules))
+	}
+	compiled := &compiledWAF{WAF: waf, rules: rules, builtAt: start, buildDuration: duration}
+	if m.logsInterruptions() {
+		compiled.logsInterruptions = true
+		interruptionFormatWAFs.Add(1)
+	}
+	return compiled, nil
+}
+
+// wafConfig translates the module's configuration into a coraza.WAFConfig.
+func (m *corazaModule) wafConfig() (coraza.WAFConfig, error) {
 	config := coraza.NewWAFConfig().
 		WithErrorCallback(newErrorCb(m.logger)).
 		WithDebugLogger(newLogger(m.logger))
 
 	if m.LoadOWASPCRS {
-		config = config.WithRootFS(mergefs.Merge(coreruleset.FS, mergefsio.OSFS))
+		config = config.WithRootFS(ruleFS(true))
+	}
+
+	crs, err := m.crsDirectives()
+	if err != nil {
+		return nil, err
+	}
+	if crs != "" {
+		config = config.WithDirectives(crs)
 	}
 
 	if m.Directives != "" {
@@ -132,12 +465,24 @@ func (m *corazaModule) buildWAF() (coraza.WAF, error) {
 		}
 	}
 
-	return coraza.NewWAF(config)
+	if m.ruleEngine != "" {
+		config = config.WithDirectives("SecRuleEngine " + m.ruleEngine)
+	}
+	if m.detectionOnly {
+		// Last, so that it wins over whatever the directives set.
+		config = config.WithDirectives("SecRuleEngine DetectionOnly")
+	}
+
+	return config, nil
 }
 
 // computePoolKey returns a deterministic key derived from the configuration
 // fields that affect WAF construction. Two modules with identical configs
 // will produce the same key, enabling WAF reuse across reloads.
+//
+// The contents of every file pulled in through Include directives are part
+// of the key, so editing a rule file and forcing a reload builds a new WAF
+// instead of reusing the stale one.
 func (m *corazaModule) computePoolKey() string {
 	h := sha256.New()
 	h.Write([]byte(m.Directives))
@@ -154,31 +499,162 @@ func (m *corazaModule) computePoolKey() string {
 	if m.LoadOWASPCRS {
 		h.Write([]byte("crs"))
 	}
+
+	// Invalid settings are reported when the WAF gets built.
+	crs, _ := m.crsDirectives()
+	h.Write([]byte(crs))
+	h.Write([]byte{0})
+
+	if m.Watch {
+		fmt.Fprintf(h, "watch:%d", m.WatchInterval)
+	}
+
+	if m.detectionOnly {
+		h.Write([]byte("detection_only"))
+	}
+
+	h.Write(m.includesDigest())
 	return fmt.Sprintf("coraza-waf-%x", h.Sum(nil))
 }
 
-// Validate implements caddy.Validator.
+// includesDigest returns a digest of the paths and contents of every rule
+// file referenced by the configuration, following nested Include directives
+// and expanding globs. Files that cannot be read are accounted for by path
+// only, the error is reported when the WAF gets built. So are the files of
+// the embedded CRS, which only change along with the binary.
+func (m *corazaModule) includesDigest() []byte {
+	h := sha256.New()
+	w := &directiveWalker{
+		root:         ruleFS(m.LoadOWASPCRS),
+		skipEmbedded: true,
+		onFile: func(f includedFile) {
+			h.Write([]byte(f.path))
+			h.Write([]byte{0})
+			if f.embedded {
+				h.Write([]byte("embedded"))
+			} else if f.data == nil {
+				h.Write([]byte("missing"))
+			} else {
+				sum := sha256.Sum256(f.data)
+				h.Write(sum[:])
+			}
+		},
+	}
+
+	// Walking errors are deliberately ignored here, whatever could be read
+	// so far is still a valid input for the key.
+	_ = w.walkString(m.Directives)
+	for _, inc := range m.Include {
+		_ = w.walkInclude(inc, "")
+	}
+	return h.Sum(nil)
+}
+
+// Validate implements caddy.Validator. Within a config, Provision already
+// compiled the rules into the coraza app of the config, which only
+// registers them in the pool once the config starts, so that validating a
+// config leaves the pool alone. Modules that were not provisioned get
+// their rules compiled into a throwaway WAF.
 func (m *corazaModule) Validate() error {
+	if m.waf != nil {
+		return nil
+	}
+
+	if m.Shadow != nil {
+		if err := m.Shadow.Validate(); err != nil {
+			return fmt.Errorf("shadow: %w", err)
+		}
+	}
+
+	if m.Use != "" {
+		// The profile is validated by the coraza app.
+		return nil
+	}
+
+	if m.logger == nil {
+		m.logger = zap.NewNop()
+	}
+	if err := m.expandPlaceholders(); err != nil {
+		return err
+	}
+
+	waf, err := m.buildWAF()
+	if err != nil {
+		return err
+	}
+	if c, ok := waf.(io.Closer); ok {
+		return c.Close()
+	}
 	return nil
 }
 
 // Cleanup implements caddy.CleanerUpper.
 func (m *corazaModule) Cleanup() error {
-	_, err := wafPool.Delete(m.poolKey)
-	return err
+	var err error
+	if m.Shadow != nil {
+		if serr := m.Shadow.Cleanup(); serr != nil {
+			err = fmt.Errorf("shadow: %w", serr)
+		}
+	}
+	if m.poolKey == "" || m.app != nil {
+		// Either not provisioned, or sharing a WAF released by the coraza
+		// app.
+		return err
+	}
+	_, derr := wafPool.Delete(m.poolKey)
+	return errors.Join(err, derr)
 }
 
 var errInterruptionTriggered = errors.New("interruption triggered")
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (m corazaModule) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	id := randomString(16)
-	tx := m.waf.NewTransactionWithID(id)
+	// Skipped requests are not even given a transaction.
+	if len(m.skipMatchers) > 0 {
+		skip, err := m.skipMatchers.AnyMatchWithError(r)
+		if err != nil {
+			return caddyhttp.HandlerError{
+				StatusCode: http.StatusInternalServerError,
+				Err:        err,
+			}
+		}
+		if skip {
+			return next.ServeHTTP(w, r)
+		}
+	}
+
+	id := m.newTransactionID(r)
+	if m.TransactionIDResponseHeader != "" {
+		w.Header().Set(m.TransactionIDResponseHeader, id)
+	}
+	serverName := serverName(r)
+	if !m.sampled(r, id) {
+		m.stats.countTransaction(true)
+		observeTransaction(serverName, false)
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		repl.Set("http.transaction_id", id)
+		return next.ServeHTTP(w, r)
+	}
+	m.stats.countTransaction(false)
+	observeTransaction(serverName, true)
+
+	tx, release := m.overrides.newTransaction(m.waf, id, r)
+	saveCollections := startCollections(r.Context(), tx, m.collections, m.logger)
+	var spans *phaseSpans
 	defer func() {
-		tx.ProcessLogging()
+		if tx.IsInterrupted() {
+			m.stats.countInterruption()
+		}
+		observeInterruption(serverName, tx)
+		endLogging := spans.start(types.PhaseLogging)
+		processLogging(tx)
+		endLogging(nil)
+		saveCollections()
+		observePhases(serverName, tx)
 		if err := tx.Close(); err != nil {
 			m.logger.Warn("Failed to close the transaction", zap.String("tx_id", tx.ID()), zap.Error(err))
 		}
+		release()
 	}()
 
 	// Early return, Coraza is not going to process any rule
@@ -188,36 +664,72 @@ func (m corazaModule) ServeHTTP(w http.ResponseWriter, r *http.Request, next cad
 		return next.ServeHTTP(w, r)
 	}
 
+	spans = newPhaseSpans(r.Context(), tx)
+
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 	repl.Set("http.transaction_id", id)
+	verdict := newWAFVerdict(repl, tx)
+	// Runs before the transaction is closed.
+	defer verdict.freeze(repl)
 
 	server := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
 	caddyhttp.PrepareRequest(r, repl, w, server)
 
+	if err := applyExclusions(m.Exclusions, m.waf, tx, r); err != nil {
+		return caddyhttp.HandlerError{
+			StatusCode: http.StatusInternalServerError,
+			ID:         tx.ID(),
+			Err:        err,
+		}
+	}
+
+	// The shadow rule set goes first so that the enforcing transaction
+	// leaves it the request body.
+	var shadow *shadowTransaction
+	if m.Shadow != nil {
+		shadow = m.Shadow.newShadowTransaction(id, r, m.collections)
+		defer shadow.finish(tx, r, m.logger)
+	}
+
 	// ProcessRequest is just a wrapper around ProcessConnection, ProcessURI,
 	// ProcessRequestHeaders and ProcessRequestBody.
 	// It fails if any of these functions returns an error and it stops on interruption.
-	if it, err := processRequest(tx, r); err != nil {
+	it, buffered, err := processRequestTraced(tx, r, spans)
+	observeBuffered(serverName, "request", buffered)
+	verdict.update(repl)
+	if err != nil {
 		return caddyhttp.HandlerError{
 			StatusCode: http.StatusInternalServerError,
 			ID:         tx.ID(),
 			Err:        err,
 		}
-	} else if it != nil {
+	}
+	if it != nil {
 		m.logger.Error("WAF rule violation detected",
 			zap.String("hostname", r.Host),
 			zap.String("uri", r.RequestURI),
 			zap.String("client_ip", r.RemoteAddr),
 			zap.String("unique_id", tx.ID()),
 		)
-		return caddyhttp.HandlerError{
-			StatusCode: obtainStatusCodeFromInterruptionOrDefault(it, http.StatusOK),
-			ID:         tx.ID(),
-			Err:        errInterruptionTriggered,
-		}
+		return m.interruptRequest(w, r, tx, it)
 	}
 
-	ww, processResponse := wrap(w, r, tx)
+	opts := m.interceptorOptions(r)
+	respond := opts.respond
+	opts.respond = func(w http.ResponseWriter, it *types.Interruption, status int) (bool, error) {
+		verdict.update(repl)
+		return respond(w, it, status)
+	}
+	opts.buffered = func(n int) {
+		observeBuffered(serverName, "response", int64(n))
+	}
+	opts.spans = spans
+	ww, processResponse := wrapWithOptions(w, r, tx, opts)
+	if shadow != nil {
+		// The shadow rule set sees the response as the enforcing one does,
+		// before any interruption of the latter.
+		ww = shadow.wrap(ww, r)
+	}
 
 	// We continue with the other middlewares by catching the response
 	if err := next.ServeHTTP(ww, r); err != nil {
@@ -229,18 +741,155 @@ func (m corazaModule) ServeHTTP(w http.ResponseWriter, r *http.Request, next cad
 
 // Unmarshal Caddyfile implements caddyfile.Unmarshaler.
 func (m *corazaModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return m.unmarshalCaddyfile(d, nil)
+}
+
+// unmarshalCaddyfile parses the coraza_waf directive, resolving named
+// matchers through h when it is not nil.
+func (m *corazaModule) unmarshalCaddyfile(d *caddyfile.Dispenser, h *httpcaddyfile.Helper) error {
 	if !d.Next() {
 		return d.Err("expected token following filter")
 	}
 	m.Include = []string{}
-	for d.NextBlock(0) {
+	return m.unmarshalBlock(d, h)
+}
+
+// unmarshalBlock parses the block of subdirectives configuring the WAF, it
+// is shared by the coraza_waf directive and the profiles of the coraza
+// global option. h is nil when named matchers are not available.
+func (m *corazaModule) unmarshalBlock(d *caddyfile.Dispenser, h *httpcaddyfile.Helper) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		key := d.Val()
 		switch key {
+		case "use":
+			if !d.Args(&m.Use) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "transaction_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.TransactionID = d.Val()
+			switch m.TransactionID {
+			case txIDRandom, txIDUUIDv7, txIDCaddyUUID:
+			case txIDHeader:
+				if !d.Args(&m.TransactionIDHeader) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("invalid transaction ID source %q, must be one of %s, %s, %s or %s",
+					m.TransactionID, txIDRandom, txIDUUIDv7, txIDCaddyUUID, txIDHeader)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "transaction_id_response_header":
+			if !d.Args(&m.TransactionIDResponseHeader) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "block_response":
+			b, err := unmarshalBlockResponse(d)
+			if err != nil {
+				return err
+			}
+			m.BlockResponse = b
+		case "skip":
+			if h == nil {
+				return d.Err("skip is only supported in the coraza_waf directive")
+			}
+			matcherSet, hasMatcher, err := h.MatcherToken()
+			if err != nil {
+				return err
+			}
+			if !hasMatcher {
+				return d.Err("skip requires a matcher")
+			}
+			if matcherSet == nil {
+				return d.Err("skip * would disable the WAF, remove the coraza_waf directive instead")
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.SkipMatchersRaw = append(m.SkipMatchersRaw, matcherSet)
+		case "exclude":
+			e, err := unmarshalExclusion(d, h)
+			if err != nil {
+				return err
+			}
+			m.Exclusions = append(m.Exclusions, e)
+		case "shadow":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if m.Shadow != nil {
+				return d.Err("shadow rule set already defined")
+			}
+			m.Shadow = new(corazaModule)
+			if err := m.Shadow.unmarshalBlock(d, h); err != nil {
+				return err
+			}
+			if m.Shadow.Shadow != nil {
+				return d.Err("a shadow rule set cannot have a shadow")
+			}
+		case "sample_rate":
+			var rate string
+			if !d.Args(&rate) {
+				return d.ArgErr()
+			}
+			v, err := strconv.ParseFloat(rate, 64)
+			if err != nil || v <= 0 || v > 1 {
+				return d.Errf("invalid sample rate %q, must be greater than 0 and at most 1", rate)
+			}
+			m.SampleRate = v
+			if d.NextArg() {
+				m.SampleBy = d.Val()
+				if m.SampleBy != sampleByRequest && m.SampleBy != sampleByClientIP {
+					return d.Errf("invalid sampling key %q, must be %s or %s", m.SampleBy, sampleByRequest, sampleByClientIP)
+				}
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "collections":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			backend := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, collectionsNamespace+"."+backend)
+			if err != nil {
+				return err
+			}
+			m.CollectionsRaw = caddyconfig.JSONModuleObject(unm, "backend", backend, nil)
+		case "crs":
+			if m.CRS == nil {
+				m.CRS = new(crsSettings)
+			}
+			if err := unmarshalCRS(d, m.CRS); err != nil {
+				return err
+			}
 		case "load_owasp_crs":
 			if d.NextArg() {
 				return d.ArgErr()
 			}
 			m.LoadOWASPCRS = true
+		case "watch":
+			m.Watch = true
+			if d.NextArg() {
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid watch interval %q: %v", d.Val(), err)
+				}
+				m.WatchInterval = caddy.Duration(interval)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
 		case "directives", "include":
 			var value string
 			if !d.Args(&value) {
@@ -270,7 +919,7 @@ func (m *corazaModule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 // parseCaddyfile unmarshals tokens from h into a new Middleware.
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var m corazaModule
-	err := m.UnmarshalCaddyfile(h.Dispenser)
+	err := m.unmarshalCaddyfile(h.Dispenser, &h)
 	return m, err
 }
 
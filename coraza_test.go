@@ -6,6 +6,7 @@ package coraza
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -20,6 +21,7 @@ import (
 	"testing"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddytest"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -254,12 +256,72 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 			}`,
 			shouldErr: true,
 		},
+		"valid config for watch": {
+			config: `coraza_waf {
+				watch 5s
+				directives ` + "`Include my-rules.conf`" + `
+			}`,
+		},
+		"invalid config for watch with invalid interval": {
+			config: `coraza_waf {
+				watch soon
+			}`,
+			shouldErr: true,
+		},
+		"invalid config for watch with more than one value": {
+			config: `coraza_waf {
+				watch 5s 10s
+			}`,
+			shouldErr: true,
+		},
 		"invalid config for load_owasp_crs with value": {
 			config: `coraza_waf {
 				load_owasp_crs next_arg
 			}`,
 			shouldErr: true,
 		},
+		"valid config for transaction_id": {
+			config: `coraza_waf {
+				transaction_id header X-Request-Id
+				transaction_id_response_header X-Request-Id
+			}`,
+		},
+		"invalid config for transaction_id header without name": {
+			config: `coraza_waf {
+				transaction_id header
+			}`,
+			shouldErr: true,
+		},
+		"invalid config for unknown transaction_id": {
+			config: `coraza_waf {
+				transaction_id uuidv4
+			}`,
+			shouldErr: true,
+		},
+		"invalid config for transaction_id with extra argument": {
+			config: `coraza_waf {
+				transaction_id uuidv7 X-Request-Id
+			}`,
+			shouldErr: true,
+		},
+		"valid config for sample_rate": {
+			config: `coraza_waf {
+				sample_rate 0.1 client_ip
+				directives ` + "`Include my-rules.conf`" + `
+			}`,
+		},
+		"invalid config for sample_rate out of range": {
+			config: `coraza_waf {
+				sample_rate 1.5
+			}`,
+			shouldErr: true,
+		},
+		"invalid config for sample_rate with invalid key": {
+			config: `coraza_waf {
+				sample_rate 0.5 session
+			}`,
+			shouldErr: true,
+		},
 		"valid config": {
 			config: `coraza_waf {
 				load_owasp_crs
@@ -417,6 +479,30 @@ func TestDestructPropagatesCloseError(t *testing.T) {
 	require.Nil(t, pw.waf, "waf should be nil after Destruct even when Close fails")
 }
 
+func TestDestructWhileListed(t *testing.T) {
+	waf, err := corazaWAF.NewWAF(corazaWAF.NewWAFConfig().WithDirectives("SecRuleEngine On"))
+	require.NoError(t, err)
+	const key = "destruct-while-listed"
+	wafPool.LoadOrStore(key, &pooledWAF{key: key, waf: waf})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = listWAFs()
+			if p, waf := lookupWAF(key); p != nil {
+				_ = describeWAF(p, waf, nil)
+			}
+		}
+	}()
+	_, err = wafPool.Delete(key)
+	require.NoError(t, err)
+	<-done
+
+	p, _ := lookupWAF(key)
+	require.Nil(t, p, "destructed WAFs are not listed")
+}
+
 func TestUsagePoolReuse(t *testing.T) {
 	// Simulate two modules with the same config — they should share a WAF.
 	m1 := &corazaModule{
@@ -438,6 +524,23 @@ func TestUsagePoolReuse(t *testing.T) {
 		"different configs must produce different pool keys")
 }
 
+func TestPoolKeyTracksIncludedFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	ruleFile := filepath.Join(tmpDir, "rules.conf")
+	require.NoError(t, os.WriteFile(ruleFile, []byte(`SecRule REQUEST_URI "/a" "id:1,phase:1,deny"`), 0644))
+
+	m := &corazaModule{Directives: "Include " + filepath.Join(tmpDir, "*.conf")}
+	key := m.computePoolKey()
+	require.Equal(t, key, m.computePoolKey(), "unchanged files must produce the same pool key")
+
+	require.NoError(t, os.WriteFile(ruleFile, []byte(`SecRule REQUEST_URI "/b" "id:1,phase:1,deny"`), 0644))
+	editedKey := m.computePoolKey()
+	require.NotEqual(t, key, editedKey, "editing an included file must change the pool key")
+
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "more.conf"), []byte(`SecRule REQUEST_URI "/c" "id:2,phase:1,deny"`), 0644))
+	require.NotEqual(t, editedKey, m.computePoolKey(), "a new file matching the glob must change the pool key")
+}
+
 func TestNewErrorCb(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -731,3 +834,127 @@ func TestServeHTTP_txCloseErrorIsLogged(t *testing.T) {
 	require.NotEmpty(t, entry.ContextMap()["tx_id"], "tx_id field must be present")
 	require.Equal(t, closeErr.Error(), entry.ContextMap()["error"], "error field must match")
 }
+
+// newServeHTTPRequest returns a request carrying what the Caddy server puts
+// in the context of requests before they reach handlers.
+func newServeHTTPRequest(method, target string, body io.Reader) *http.Request {
+	return withServerContext(httptest.NewRequest(method, target, body))
+}
+
+// withServerContext adds to the context of req what the Caddy server puts
+// there before requests reach handlers.
+func withServerContext(req *http.Request) *http.Request {
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+	ctx = context.WithValue(ctx, caddyhttp.ServerCtxKey, &caddyhttp.Server{})
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+	ctx = context.WithValue(ctx, caddyhttp.OriginalRequestCtxKey, *req)
+	return req.WithContext(ctx)
+}
+
+func TestUnmarshalSkip(t *testing.T) {
+	adapt := func(t *testing.T, block string) ([]byte, error) {
+		t.Helper()
+		config := fmt.Sprintf(`{
+			order coraza_waf first
+		}
+
+		:8080 {
+			@static path /static/* *.js
+			coraza_waf {
+				directives `+"`SecRuleEngine On`"+`
+				%s
+			}
+		}`, block)
+		out, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(config), nil)
+		return out, err
+	}
+
+	tests := map[string]struct {
+		block    string
+		wantSets int
+		errMsg   string
+	}{
+		"named matcher": {
+			block:    `skip @static`,
+			wantSets: 1,
+		},
+		"path matcher": {
+			block:    `skip /favicon.ico`,
+			wantSets: 1,
+		},
+		"several matchers": {
+			block: `skip @static
+				skip /favicon.ico`,
+			wantSets: 2,
+		},
+		"without matcher": {
+			block:  `skip`,
+			errMsg: "skip requires a matcher",
+		},
+		"wildcard": {
+			block:  `skip *`,
+			errMsg: "would disable the WAF",
+		},
+		"too many arguments": {
+			block:  `skip @static /favicon.ico`,
+			errMsg: "wrong argument count",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			out, err := adapt(t, test.block)
+			if test.errMsg != "" {
+				require.ErrorContains(t, err, test.errMsg)
+				return
+			}
+			require.NoError(t, err)
+
+			handlers, err := findWAFHandlers(out)
+			require.NoError(t, err)
+			require.Len(t, handlers, 1)
+			require.Len(t, handlers[0].module.SkipMatchersRaw, test.wantSets)
+		})
+	}
+
+	t.Run("not supported without named matchers", func(t *testing.T) {
+		m := &corazaModule{}
+		err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`coraza_waf {
+			skip @static
+		}`))
+		require.ErrorContains(t, err, "only supported in the coraza_waf directive")
+	})
+}
+
+func TestServeHTTPSkipsMatchingRequests(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{
+		Directives: `SecRuleEngine On
+SecRule REQUEST_URI "@contains attack" "id:1,phase:1,deny,status:403"`,
+		SkipMatchersRaw: caddyhttp.RawMatcherSets{
+			{"path": json.RawMessage(`["/static/*"]`)},
+		},
+	}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	req := newServeHTTPRequest(http.MethodGet, "/static/attack.js", nil)
+	require.NoError(t, m.ServeHTTP(httptest.NewRecorder(), req, next))
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	_, ok := repl.GetString("http.transaction_id")
+	require.False(t, ok, "skipped requests do not get a transaction")
+	require.Zero(t, m.stats.transactions.Load())
+
+	err := m.ServeHTTP(httptest.NewRecorder(), newServeHTTPRequest(http.MethodGet, "/api/attack", nil), next)
+	var herr caddyhttp.HandlerError
+	require.ErrorAs(t, err, &herr)
+	require.Equal(t, http.StatusForbidden, herr.StatusCode)
+	require.Equal(t, uint64(1), m.stats.transactions.Load())
+}
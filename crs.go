@@ -0,0 +1,341 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// crsSettingsFile is the name generated setup actions are reported under.
+const crsSettingsFile = "crs settings"
+
+// crsSettings are the most common knobs of the OWASP Core Rule Set. When
+// load_owasp_crs is set, they are turned into the setup actions
+// crs-setup.conf would otherwise have to define.
+type crsSettings struct {
+	// ParanoiaLevel is the blocking paranoia level, from 1 to 4: rules up
+	// to this level contribute to the anomaly score. 0 keeps the default.
+	// Default: 1
+	ParanoiaLevel int `json:"paranoia_level,omitempty"`
+	// DetectionParanoiaLevel runs rules up to this level without them
+	// contributing to the anomaly score. It cannot be lower than the
+	// paranoia level. 0 keeps the default.
+	// Default: the paranoia level
+	DetectionParanoiaLevel int `json:"detection_paranoia_level,omitempty"`
+	// InboundAnomalyThreshold is the request anomaly score from which
+	// requests are blocked.
+	// Default: 5
+	InboundAnomalyThreshold int `json:"inbound_anomaly_threshold,omitempty"`
+	// OutboundAnomalyThreshold is the response anomaly score from which
+	// responses are blocked.
+	// Default: 4
+	OutboundAnomalyThreshold int `json:"outbound_anomaly_threshold,omitempty"`
+	// AllowedMethods are the HTTP methods clients may use.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	// AllowedContentTypes are the request content types clients may send.
+	// They are matched case-insensitively.
+	AllowedContentTypes []string `json:"allowed_content_types,omitempty"`
+	// RestrictedExtensions are the file extensions clients may not request,
+	// e.g. ".bak".
+	RestrictedExtensions []string `json:"restricted_extensions,omitempty"`
+}
+
+// crsSetupAction is a setup action generated out of crsSettings.
+type crsSetupAction struct {
+	id      int
+	setting string
+	vars    map[string]string
+}
+
+// crsTokenRegex matches the values that can be safely written in a setvar.
+var crsTokenRegex = regexp.MustCompile(`^[A-Za-z0-9!#$%&*+.^_|~/-]+$`)
+
+// setupActions validates the settings and returns the actions implementing
+// them, in the order they must be defined.
+func (s *crsSettings) setupActions() ([]crsSetupAction, error) {
+	var (
+		actions []crsSetupAction
+		errs    []error
+	)
+
+	// 0 is the zero value of an unset level, which keeps the default.
+	checkLevel := func(name string, level int) {
+		if level < 0 || level > 4 {
+			errs = append(errs, fmt.Errorf("%s must be between 1 and 4, or 0 for the default, got %d", name, level))
+		}
+	}
+	checkLevel("paranoia_level", s.ParanoiaLevel)
+	checkLevel("detection_paranoia_level", s.DetectionParanoiaLevel)
+	if s.DetectionParanoiaLevel != 0 && s.DetectionParanoiaLevel < max(s.ParanoiaLevel, 1) {
+		errs = append(errs, fmt.Errorf("detection_paranoia_level (%d) cannot be lower than paranoia_level (%d)", s.DetectionParanoiaLevel, max(s.ParanoiaLevel, 1)))
+	}
+	if s.InboundAnomalyThreshold < 0 {
+		errs = append(errs, fmt.Errorf("inbound_anomaly_threshold must be positive, got %d", s.InboundAnomalyThreshold))
+	}
+	if s.OutboundAnomalyThreshold < 0 {
+		errs = append(errs, fmt.Errorf("outbound_anomaly_threshold must be positive, got %d", s.OutboundAnomalyThreshold))
+	}
+
+	checkTokens := func(name string, values []string) {
+		for _, v := range values {
+			if !crsTokenRegex.MatchString(v) {
+				errs = append(errs, fmt.Errorf("invalid %s value %q", name, v))
+			}
+		}
+	}
+	checkTokens("allowed_methods", s.AllowedMethods)
+	checkTokens("allowed_content_types", s.AllowedContentTypes)
+	checkTokens("restricted_extensions", s.RestrictedExtensions)
+	for _, ext := range s.RestrictedExtensions {
+		if strings.Trim(ext, "./") == "" || strings.Contains(strings.TrimSuffix(ext, "/"), "/") {
+			errs = append(errs, fmt.Errorf("invalid restricted_extensions value %q", ext))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if s.ParanoiaLevel != 0 {
+		actions = append(actions, crsSetupAction{
+			id:      900000,
+			setting: "paranoia_level",
+			vars:    map[string]string{"blocking_paranoia_level": strconv.Itoa(s.ParanoiaLevel)},
+		})
+	}
+	if s.DetectionParanoiaLevel != 0 {
+		actions = append(actions, crsSetupAction{
+			id:      900001,
+			setting: "detection_paranoia_level",
+			vars:    map[string]string{"detection_paranoia_level": strconv.Itoa(s.DetectionParanoiaLevel)},
+		})
+	}
+	if s.InboundAnomalyThreshold != 0 || s.OutboundAnomalyThreshold != 0 {
+		a := crsSetupAction{id: 900110, setting: "anomaly thresholds", vars: map[string]string{}}
+		if s.InboundAnomalyThreshold != 0 {
+			a.vars["inbound_anomaly_score_threshold"] = strconv.Itoa(s.InboundAnomalyThreshold)
+		}
+		if s.OutboundAnomalyThreshold != 0 {
+			a.vars["outbound_anomaly_score_threshold"] = strconv.Itoa(s.OutboundAnomalyThreshold)
+		}
+		actions = append(actions, a)
+	}
+	if len(s.AllowedMethods) > 0 {
+		methods := make([]string, len(s.AllowedMethods))
+		for i, m := range s.AllowedMethods {
+			methods[i] = strings.ToUpper(m)
+		}
+		actions = append(actions, crsSetupAction{
+			id:      900200,
+			setting: "allowed_methods",
+			vars:    map[string]string{"allowed_methods": strings.Join(methods, " ")},
+		})
+	}
+	if len(s.AllowedContentTypes) > 0 {
+		// CRS lowercases the content type before looking it up.
+		types := make([]string, len(s.AllowedContentTypes))
+		for i, ct := range s.AllowedContentTypes {
+			types[i] = "|" + strings.ToLower(ct) + "|"
+		}
+		actions = append(actions, crsSetupAction{
+			id:      900220,
+			setting: "allowed_content_types",
+			vars:    map[string]string{"allowed_request_content_type": strings.Join(types, " ")},
+		})
+	}
+	if len(s.RestrictedExtensions) > 0 {
+		exts := make([]string, len(s.RestrictedExtensions))
+		for i, ext := range s.RestrictedExtensions {
+			exts[i] = "." + strings.ToLower(strings.Trim(ext, "./")) + "/"
+		}
+		actions = append(actions, crsSetupAction{
+			id:      900240,
+			setting: "restricted_extensions",
+			vars:    map[string]string{"restricted_extensions": strings.Join(exts, " ")},
+		})
+	}
+	return actions, nil
+}
+
+// String returns the action as a SecAction directive.
+func (a crsSetupAction) String() string {
+	names := make([]string, 0, len(a.vars))
+	for name := range a.vars {
+		names = append(names, name)
+	}
+	// inbound before outbound, like crs-setup.conf.
+	sort.Strings(names)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `SecAction "id:%d,phase:1,pass,t:none,nolog,tag:'OWASP_CRS'`, a.id)
+	for _, name := range names {
+		fmt.Fprintf(&sb, ",setvar:'tx.%s=%s'", name, a.vars[name])
+	}
+	sb.WriteString(`"`)
+	return sb.String()
+}
+
+// crsDirectives returns the setup actions generated out of the CRS settings,
+// or an empty string if there are none.
+func (m *corazaModule) crsDirectives() (string, error) {
+	if m.CRS == nil {
+		return "", nil
+	}
+	if !m.LoadOWASPCRS {
+		return "", errors.New("crs settings require load_owasp_crs")
+	}
+
+	actions, err := m.CRS.setupActions()
+	if err != nil {
+		return "", fmt.Errorf("invalid crs settings: %w", err)
+	}
+	if err := m.checkCRSConflicts(actions); err != nil {
+		return "", err
+	}
+
+	lines := make([]string, len(actions))
+	for i, a := range actions {
+		lines[i] = a.String()
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// checkCRSConflicts makes sure none of the hand-written directives, included
+// files included, defines the same setup action or sets the same variables
+// as the generated actions.
+func (m *corazaModule) checkCRSConflicts(actions []crsSetupAction) error {
+	if len(actions) == 0 {
+		return nil
+	}
+
+	type setvar struct {
+		re      *regexp.Regexp
+		setting string
+	}
+	var setvars []setvar
+	ids := map[int]string{}
+	for _, a := range actions {
+		ids[a.id] = a.setting
+		for name := range a.vars {
+			setvars = append(setvars, setvar{
+				re:      regexp.MustCompile(`(?i)setvar\s*:\s*'?tx\.` + regexp.QuoteMeta(name) + `\s*=`),
+				setting: a.setting,
+			})
+		}
+	}
+
+	var conflict error
+	w := &directiveWalker{
+		root: ruleFS(m.LoadOWASPCRS),
+		onDirective: func(d directive) error {
+			if strings.HasPrefix(d.file, "@") {
+				// Files embedded from coraza-coreruleset, the CRS itself
+				// sets defaults for the variables setup left unset.
+				return nil
+			}
+			var id int
+			if match := ruleIDRegex.FindStringSubmatch(d.text); match != nil {
+				id, _ = strconv.Atoi(match[1])
+			}
+			setting, ok := ids[id]
+			for i := 0; !ok && i < len(setvars); i++ {
+				if setvars[i].re.MatchString(d.text) {
+					setting, ok = setvars[i].setting, true
+				}
+			}
+			if !ok {
+				return nil
+			}
+			conflict = &directiveError{
+				directive: d,
+				ruleID:    id,
+				err:       fmt.Errorf("crs %s conflicts with this directive, remove one of them", setting),
+			}
+			return errStopWalking
+		},
+	}
+	// Walking errors are reported when compiling, only conflicts matter here.
+	if err := w.walkString(m.Directives); err == nil {
+		for _, inc := range m.Include {
+			if err := w.walkInclude(inc, ""); err != nil {
+				break
+			}
+		}
+	}
+	return conflict
+}
+
+// unmarshalCRS parses a crs subdirective. Syntax:
+//
+//	crs {
+//	    paranoia_level             <1-4>
+//	    detection_paranoia_level   <1-4>
+//	    inbound_anomaly_threshold  <score>
+//	    outbound_anomaly_threshold <score>
+//	    allowed_methods            <methods...>
+//	    allowed_content_types      <content_types...>
+//	    restricted_extensions      <extensions...>
+//	}
+func unmarshalCRS(d *caddyfile.Dispenser, s *crsSettings) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		switch key {
+		case "paranoia_level", "detection_paranoia_level", "inbound_anomaly_threshold", "outbound_anomaly_threshold":
+			var value string
+			if !d.Args(&value) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid %s %q", key, value)
+			}
+			if n == 0 && strings.HasSuffix(key, "paranoia_level") {
+				return d.Errf("%s must be between 1 and 4, got 0", key)
+			}
+			switch key {
+			case "paranoia_level":
+				s.ParanoiaLevel = n
+			case "detection_paranoia_level":
+				s.DetectionParanoiaLevel = n
+			case "inbound_anomaly_threshold":
+				s.InboundAnomalyThreshold = n
+			case "outbound_anomaly_threshold":
+				s.OutboundAnomalyThreshold = n
+			}
+		case "allowed_methods", "allowed_content_types", "restricted_extensions":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			switch key {
+			case "allowed_methods":
+				s.AllowedMethods = append(s.AllowedMethods, args...)
+			case "allowed_content_types":
+				s.AllowedContentTypes = append(s.AllowedContentTypes, args...)
+			case "restricted_extensions":
+				s.RestrictedExtensions = append(s.RestrictedExtensions, args...)
+			}
+		default:
+			return d.Errf("invalid crs key %q", key)
+		}
+	}
+
+	if _, err := s.setupActions(); err != nil {
+		return d.Err(err.Error())
+	}
+	return nil
+}
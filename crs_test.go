@@ -0,0 +1,302 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const crsIncludes = `Include @coraza.conf-recommended
+Include @crs-setup.conf.example
+Include @owasp_crs/*.conf
+SecRuleEngine On`
+
+func TestCRSSetupActions(t *testing.T) {
+	tests := map[string]struct {
+		settings  crsSettings
+		want      []string
+		shouldErr bool
+	}{
+		"empty": {},
+		"paranoia levels": {
+			settings: crsSettings{ParanoiaLevel: 2, DetectionParanoiaLevel: 3},
+			want: []string{
+				`SecAction "id:900000,phase:1,pass,t:none,nolog,tag:'OWASP_CRS',setvar:'tx.blocking_paranoia_level=2'"`,
+				`SecAction "id:900001,phase:1,pass,t:none,nolog,tag:'OWASP_CRS',setvar:'tx.detection_paranoia_level=3'"`,
+			},
+		},
+		"anomaly thresholds": {
+			settings: crsSettings{InboundAnomalyThreshold: 10, OutboundAnomalyThreshold: 8},
+			want: []string{
+				`SecAction "id:900110,phase:1,pass,t:none,nolog,tag:'OWASP_CRS',setvar:'tx.inbound_anomaly_score_threshold=10',setvar:'tx.outbound_anomaly_score_threshold=8'"`,
+			},
+		},
+		"inbound anomaly threshold only": {
+			settings: crsSettings{InboundAnomalyThreshold: 10},
+			want: []string{
+				`SecAction "id:900110,phase:1,pass,t:none,nolog,tag:'OWASP_CRS',setvar:'tx.inbound_anomaly_score_threshold=10'"`,
+			},
+		},
+		"lists": {
+			settings: crsSettings{
+				AllowedMethods:       []string{"get", "POST"},
+				AllowedContentTypes:  []string{"application/JSON", "text/plain"},
+				RestrictedExtensions: []string{".bak", "sql", ".old/"},
+			},
+			want: []string{
+				`SecAction "id:900200,phase:1,pass,t:none,nolog,tag:'OWASP_CRS',setvar:'tx.allowed_methods=GET POST'"`,
+				`SecAction "id:900220,phase:1,pass,t:none,nolog,tag:'OWASP_CRS',setvar:'tx.allowed_request_content_type=|application/json| |text/plain|'"`,
+				`SecAction "id:900240,phase:1,pass,t:none,nolog,tag:'OWASP_CRS',setvar:'tx.restricted_extensions=.bak/ .sql/ .old/'"`,
+			},
+		},
+		"paranoia level out of range": {
+			settings:  crsSettings{ParanoiaLevel: 5},
+			shouldErr: true,
+		},
+		"detection lower than blocking": {
+			settings:  crsSettings{ParanoiaLevel: 3, DetectionParanoiaLevel: 2},
+			shouldErr: true,
+		},
+		"negative threshold": {
+			settings:  crsSettings{OutboundAnomalyThreshold: -1},
+			shouldErr: true,
+		},
+		"method with quote": {
+			settings:  crsSettings{AllowedMethods: []string{"GET'"}},
+			shouldErr: true,
+		},
+		"content type with space": {
+			settings:  crsSettings{AllowedContentTypes: []string{"text/plain; charset=utf-8"}},
+			shouldErr: true,
+		},
+		"extension with path": {
+			settings:  crsSettings{RestrictedExtensions: []string{"a/b"}},
+			shouldErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			actions, err := test.settings.setupActions()
+			if test.shouldErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var got []string
+			for _, a := range actions {
+				got = append(got, a.String())
+			}
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestUnmarshalCRS(t *testing.T) {
+	tests := map[string]struct {
+		config    string
+		want      *crsSettings
+		shouldErr bool
+	}{
+		"all settings": {
+			config: `coraza_waf {
+				load_owasp_crs
+				crs {
+					paranoia_level 2
+					detection_paranoia_level 3
+					inbound_anomaly_threshold 10
+					outbound_anomaly_threshold 8
+					allowed_methods GET HEAD
+					allowed_methods POST
+					allowed_content_types application/json
+					restricted_extensions .bak .sql
+				}
+			}`,
+			want: &crsSettings{
+				ParanoiaLevel:            2,
+				DetectionParanoiaLevel:   3,
+				InboundAnomalyThreshold:  10,
+				OutboundAnomalyThreshold: 8,
+				AllowedMethods:           []string{"GET", "HEAD", "POST"},
+				AllowedContentTypes:      []string{"application/json"},
+				RestrictedExtensions:     []string{".bak", ".sql"},
+			},
+		},
+		"invalid number": {
+			config: `coraza_waf {
+				crs {
+					paranoia_level high
+				}
+			}`,
+			shouldErr: true,
+		},
+		"invalid value": {
+			config: `coraza_waf {
+				crs {
+					paranoia_level 7
+				}
+			}`,
+			shouldErr: true,
+		},
+		"explicit zero level": {
+			config: `coraza_waf {
+				crs {
+					detection_paranoia_level 0
+				}
+			}`,
+			shouldErr: true,
+		},
+		"missing value": {
+			config: `coraza_waf {
+				crs {
+					allowed_methods
+				}
+			}`,
+			shouldErr: true,
+		},
+		"unknown key": {
+			config: `coraza_waf {
+				crs {
+					paranoia 2
+				}
+			}`,
+			shouldErr: true,
+		},
+		"argument": {
+			config: `coraza_waf {
+				crs strict
+			}`,
+			shouldErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &corazaModule{}
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.config))
+			if test.shouldErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, m.CRS)
+		})
+	}
+}
+
+func TestCRSDirectivesErrors(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "setup.conf")
+	require.NoError(t, os.WriteFile(ruleFile, []byte(`# tuning
+SecAction "id:1000,phase:1,pass,nolog,setvar:tx.inbound_anomaly_score_threshold=20"
+`), 0644))
+
+	tests := map[string]struct {
+		module corazaModule
+		errMsg string
+	}{
+		"without load_owasp_crs": {
+			module: corazaModule{CRS: &crsSettings{ParanoiaLevel: 2}},
+			errMsg: "crs settings require load_owasp_crs",
+		},
+		"invalid settings": {
+			module: corazaModule{LoadOWASPCRS: true, CRS: &crsSettings{ParanoiaLevel: 9}},
+			errMsg: "invalid crs settings",
+		},
+		"same setup action id": {
+			module: corazaModule{
+				LoadOWASPCRS: true,
+				CRS:          &crsSettings{ParanoiaLevel: 2},
+				Directives:   "SecRuleEngine On\nSecAction \"id:900000,phase:1,pass,nolog,setvar:tx.blocking_paranoia_level=1\"",
+			},
+			errMsg: "directives:2 (rule id 900000): crs paranoia_level conflicts with this directive",
+		},
+		"same variable": {
+			module: corazaModule{
+				LoadOWASPCRS: true,
+				CRS:          &crsSettings{DetectionParanoiaLevel: 2},
+				Directives:   `SecAction "id:1000,phase:1,pass,nolog,setvar:'tx.detection_paranoia_level=4'"`,
+			},
+			errMsg: "crs detection_paranoia_level conflicts",
+		},
+		"variable set in an included file": {
+			module: corazaModule{
+				LoadOWASPCRS: true,
+				CRS:          &crsSettings{InboundAnomalyThreshold: 10},
+				Directives:   "Include " + ruleFile,
+			},
+			errMsg: ruleFile + ":2 (rule id 1000): crs anomaly thresholds conflicts",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := test.module
+			m.logger = zap.NewNop()
+			_, err := m.buildWAF()
+			require.ErrorContains(t, err, test.errMsg)
+		})
+	}
+
+	t.Run("no conflict with the example setup", func(t *testing.T) {
+		m := &corazaModule{
+			LoadOWASPCRS: true,
+			CRS:          &crsSettings{ParanoiaLevel: 2},
+			Directives:   "Include @crs-setup.conf.example",
+		}
+		_, err := m.crsDirectives()
+		require.NoError(t, err)
+	})
+}
+
+func TestCRSSettingsApplied(t *testing.T) {
+	newWAF := func(t *testing.T, settings *crsSettings) *compiledWAF {
+		t.Helper()
+		m := &corazaModule{
+			LoadOWASPCRS: true,
+			CRS:          settings,
+			Directives:   crsIncludes,
+			logger:       zap.NewNop(),
+		}
+		waf, err := m.buildWAF()
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = waf.(*compiledWAF).Close() })
+		return waf.(*compiledWAF)
+	}
+
+	isBlocked := func(t *testing.T, waf *compiledWAF, method string) bool {
+		t.Helper()
+		req := httptest.NewRequest(method, "/", nil)
+		req.Header.Set("User-Agent", "test")
+		req.Header.Set("Accept", "*/*")
+		tx := waf.NewTransaction()
+		defer tx.Close()
+		it, err := processRequest(tx, req)
+		require.NoError(t, err)
+		return it != nil
+	}
+
+	waf := newWAF(t, &crsSettings{AllowedMethods: []string{"GET"}})
+	require.False(t, isBlocked(t, waf, "GET"))
+	require.True(t, isBlocked(t, waf, "HEAD"))
+
+	// The method rule alone no longer reaches the threshold.
+	waf = newWAF(t, &crsSettings{AllowedMethods: []string{"GET"}, InboundAnomalyThreshold: 100})
+	require.False(t, isBlocked(t, waf, "HEAD"))
+}
+
+func TestPoolKeyTracksCRSSettings(t *testing.T) {
+	a := &corazaModule{LoadOWASPCRS: true, CRS: &crsSettings{ParanoiaLevel: 1}}
+	b := &corazaModule{LoadOWASPCRS: true, CRS: &crsSettings{ParanoiaLevel: 2}}
+	c := &corazaModule{LoadOWASPCRS: true}
+	require.NotEqual(t, a.computePoolKey(), b.computePoolKey())
+	require.NotEqual(t, a.computePoolKey(), c.computePoolKey())
+}
@@ -0,0 +1,610 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/spf13/cobra"
+)
+
+const (
+	evalFormatRaw   = "raw"
+	evalFormatJSONL = "jsonl"
+	evalFormatHAR   = "har"
+)
+
+func newEvalCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "eval [<config>] [--adapter <name>] [--input <file>] [--format raw|jsonl|har] [--json]",
+		Short: "Evaluates HTTP requests against the rules of the WAF handlers",
+		Long: `
+Feeds HTTP requests through the rules configured in the config file, without
+starting a server, and prints for each of them the interruption, the matched
+rules and the phase where the evaluation stopped.
+
+Requests are read from --input, or stdin if not set or "-". The format is
+detected from the file extension (.har, .jsonl or .ndjson) unless --format
+is given:
+
+  raw    one or more HTTP/1.x requests as sent on the wire
+  jsonl  one request per line: {"method": "GET", "url": "/",
+         "headers": {"Host": ["example.com"]}, "body": "",
+         "remote_addr": "127.0.0.1:12345", "response": {"status": 200,
+         "headers": {}, "body": ""}}, only url is required
+  har    an HTTP Archive, e.g. exported from the browser dev tools
+
+Responses included in JSONL and HAR inputs are evaluated too, otherwise an
+empty 200 response is used. Each request is evaluated by the handler whose
+hosts match its Host header, falling back to handlers without host
+matchers.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdEval),
+	}
+	cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+	cmd.Flags().StringP("input", "i", "-", "File to read the requests from")
+	cmd.Flags().StringP("format", "f", "", "Format of the input: raw, jsonl or har")
+	cmd.Flags().Bool("json", false, "Print the results as JSON lines")
+	return cmd
+}
+
+func cmdEval(fl caddycmd.Flags) (int, error) {
+	handlers, err := loadWAFHandlers(fl.Arg(0), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	input := fl.String("input")
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	format := fl.String("format")
+	if format == "" {
+		format = evalFormatFromPath(input)
+	}
+
+	exchanges, err := readExchanges(r, format)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	results, err := evalExchanges(handlers, exchanges)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if fl.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		for _, res := range results {
+			if err := enc.Encode(res); err != nil {
+				return caddy.ExitCodeFailedStartup, err
+			}
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	printEvalResults(os.Stdout, results)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// evalFormatFromPath guesses the format of the input from its extension.
+func evalFormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".har":
+		return evalFormatHAR
+	case ".jsonl", ".ndjson":
+		return evalFormatJSONL
+	}
+	return evalFormatRaw
+}
+
+// exchange is a request to evaluate along with the response the upstream
+// sends back for it.
+type exchange struct {
+	req  *http.Request
+	resp *evalResponse
+}
+
+// evalResponse is the response written by the upstream during evaluation.
+type evalResponse struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+}
+
+// jsonlRequest is a request in the JSONL input format.
+type jsonlRequest struct {
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Proto      string              `json:"proto"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+	RemoteAddr string              `json:"remote_addr"`
+	Response   *evalResponse       `json:"response"`
+}
+
+// harLog is the subset of the HTTP Archive format needed to replay requests.
+type harLog struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method      string      `json:"method"`
+				URL         string      `json:"url"`
+				HTTPVersion string      `json:"httpVersion"`
+				Headers     []harHeader `json:"headers"`
+				PostData    *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+			Response *struct {
+				Status  int         `json:"status"`
+				Headers []harHeader `json:"headers"`
+				Content struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// readExchanges reads the requests to evaluate from r.
+func readExchanges(r io.Reader, format string) ([]exchange, error) {
+	switch format {
+	case evalFormatRaw:
+		return readRawExchanges(r)
+	case evalFormatJSONL:
+		return readJSONLExchanges(r)
+	case evalFormatHAR:
+		return readHARExchanges(r)
+	}
+	return nil, fmt.Errorf("unknown input format %q", format)
+}
+
+func readRawExchanges(r io.Reader) ([]exchange, error) {
+	var exchanges []exchange
+	br := bufio.NewReader(r)
+	for {
+		// Blank lines between requests are tolerated.
+		for {
+			b, err := br.Peek(1)
+			if err != nil || (b[0] != '\r' && b[0] != '\n') {
+				break
+			}
+			_, _ = br.ReadByte()
+		}
+		if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+			break
+		}
+
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return nil, fmt.Errorf("reading request #%d: %v", len(exchanges)+1, err)
+		}
+		// The body has to be consumed before reading the next request.
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading body of request #%d: %v", len(exchanges)+1, err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		exchanges = append(exchanges, exchange{req: req})
+	}
+	return exchanges, nil
+}
+
+func readJSONLExchanges(r io.Reader) ([]exchange, error) {
+	var exchanges []exchange
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 32*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var jr jsonlRequest
+		if err := json.Unmarshal(scanner.Bytes(), &jr); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		req, err := newEvalRequest(jr.Method, jr.URL, jr.Proto, jr.Headers, jr.Body)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if jr.RemoteAddr != "" {
+			req.RemoteAddr = jr.RemoteAddr
+		}
+		exchanges = append(exchanges, exchange{req: req, resp: jr.Response})
+	}
+	return exchanges, scanner.Err()
+}
+
+func readHARExchanges(r io.Reader) ([]exchange, error) {
+	var har harLog
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("decoding HAR: %v", err)
+	}
+
+	var exchanges []exchange
+	for i, e := range har.Log.Entries {
+		var body string
+		if e.Request.PostData != nil {
+			body = e.Request.PostData.Text
+		}
+		req, err := newEvalRequest(e.Request.Method, e.Request.URL, e.Request.HTTPVersion, harHeaders(e.Request.Headers), body)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i, err)
+		}
+
+		ex := exchange{req: req}
+		if e.Response != nil && e.Response.Status != 0 {
+			ex.resp = &evalResponse{
+				Status:  e.Response.Status,
+				Headers: harHeaders(e.Response.Headers),
+				Body:    e.Response.Content.Text,
+			}
+		}
+		exchanges = append(exchanges, ex)
+	}
+	return exchanges, nil
+}
+
+func harHeaders(headers []harHeader) map[string][]string {
+	h := map[string][]string{}
+	for _, header := range headers {
+		if strings.HasPrefix(header.Name, ":") {
+			// HTTP/2 pseudo headers
+			if header.Name == ":authority" {
+				h["Host"] = append(h["Host"], header.Value)
+			}
+			continue
+		}
+		h[header.Name] = append(h[header.Name], header.Value)
+	}
+	return h
+}
+
+// newEvalRequest builds a request as a server would receive it.
+func newEvalRequest(method, rawURL, proto string, headers map[string][]string, body string) (*http.Request, error) {
+	if method == "" {
+		method = http.MethodGet
+	}
+	if proto == "" || !strings.HasPrefix(strings.ToUpper(proto), "HTTP/") {
+		proto = "HTTP/1.1"
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req := httptest.NewRequest(method, u.RequestURI(), strings.NewReader(body))
+	req.Proto = strings.ToUpper(proto)
+	req.Host = u.Host
+	req.Header = http.Header{}
+	for k, vs := range headers {
+		if strings.EqualFold(k, "Host") {
+			if req.Host == "" && len(vs) > 0 {
+				req.Host = vs[0]
+			}
+			continue
+		}
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.ContentLength = int64(len(body))
+	return req, nil
+}
+
+// evalResult is the outcome of evaluating a request.
+type evalResult struct {
+	Method       string              `json:"method"`
+	URI          string              `json:"uri"`
+	Host         string              `json:"host,omitempty"`
+	Handler      string              `json:"handler"`
+	Interruption *types.Interruption `json:"interruption,omitempty"`
+	Response     *evalClientResponse `json:"response,omitempty"`
+	Phase        string              `json:"phase"`
+	MatchedRules []evalMatchedRule   `json:"matched_rules"`
+	Error        string              `json:"error,omitempty"`
+}
+
+// evalClientResponse is the response the client gets, as far as the WAF is
+// concerned.
+type evalClientResponse struct {
+	Status  int         `json:"status,omitempty"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+	// HandledByCaddy is set when the interruption is left to the error
+	// handling of Caddy, which writes the response.
+	HandledByCaddy bool `json:"handled_by_caddy,omitempty"`
+	// Dropped is set when the connection is closed without a response.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+type evalMatchedRule struct {
+	ID       int      `json:"id"`
+	Phase    string   `json:"phase"`
+	Severity string   `json:"severity,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	Data     string   `json:"data,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// evalExchanges evaluates every exchange with the matching handler.
+func evalExchanges(handlers []wafHandler, exchanges []exchange) ([]evalResult, error) {
+	compiled := map[int]*compiledWAF{}
+	defer func() {
+		for _, waf := range compiled {
+			_ = waf.Close()
+		}
+	}()
+
+	results := make([]evalResult, 0, len(exchanges))
+	for _, ex := range exchanges {
+		i, err := selectWAFHandler(handlers, ex.req.Host)
+		if err != nil {
+			return nil, err
+		}
+		waf, ok := compiled[i]
+		if !ok {
+			if waf, err = handlers[i].compile(); err != nil {
+				return nil, fmt.Errorf("%s: %v", handlers[i], err)
+			}
+			compiled[i] = waf
+		}
+
+		res := evalExchange(handlers[i].module, waf, ex)
+		res.Handler = handlers[i].String()
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// selectWAFHandler returns the index of the handler serving the given host.
+func selectWAFHandler(handlers []wafHandler, host string) (int, error) {
+	if len(handlers) == 0 {
+		return 0, fmt.Errorf("no WAF handler found in config")
+	}
+
+	host = parseServerName(host)
+	fallback := -1
+	for i, h := range handlers {
+		if len(h.hosts) == 0 {
+			if fallback == -1 {
+				fallback = i
+			}
+			continue
+		}
+		for _, pattern := range h.hosts {
+			if matchHost(pattern, host) {
+				return i, nil
+			}
+		}
+	}
+
+	switch {
+	case fallback != -1:
+		return fallback, nil
+	case len(handlers) == 1:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("no WAF handler serves host %q", host)
+}
+
+// matchHost reports whether host matches pattern, which may contain
+// wildcard labels like the host matcher.
+func matchHost(pattern, host string) bool {
+	if strings.EqualFold(pattern, host) {
+		return true
+	}
+	patternLabels := strings.Split(pattern, ".")
+	hostLabels := strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i := range patternLabels {
+		if patternLabels[i] != "*" && !strings.EqualFold(patternLabels[i], hostLabels[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// evalExchange evaluates a single exchange the same way ServeHTTP does,
+// m being the handler whose rules waf was compiled from.
+func evalExchange(m *corazaModule, waf *compiledWAF, ex exchange) evalResult {
+	// Request matchers expect what the Caddy server puts in the context.
+	ctx := context.WithValue(ex.req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+	req := ex.req.WithContext(ctx)
+	res := evalResult{
+		Method: req.Method,
+		URI:    req.URL.RequestURI(),
+		Host:   req.Host,
+	}
+
+	tx := waf.NewTransactionWithID(randomString(16))
+	defer tx.Close()
+
+	rec := httptest.NewRecorder()
+	var err error
+	res.Response, err = clientResponse(rec, func() error {
+		if err := applyExclusions(m.Exclusions, waf, tx, req); err != nil {
+			return err
+		}
+		it, err := processRequest(tx, req)
+		if err != nil {
+			return err
+		}
+		if it != nil {
+			return m.interruptRequest(rec, req, tx, it)
+		}
+		ww, processResponse := wrapWithOptions(rec, req, tx, m.interceptorOptions(req))
+		writeEvalResponse(ww, ex.resp)
+		return processResponse(tx, req)
+	})
+	if lp, ok := tx.(interface{ LastPhase() types.RulePhase }); ok {
+		res.Phase = phaseName(lp.LastPhase())
+	}
+	processLogging(tx)
+
+	if err != nil {
+		res.Error = err.Error()
+	}
+	res.Interruption = tx.Interruption()
+	for _, mr := range tx.MatchedRules() {
+		r := mr.Rule()
+		res.MatchedRules = append(res.MatchedRules, evalMatchedRule{
+			ID:       r.ID(),
+			Phase:    phaseName(r.Phase()),
+			Severity: severityName(r.Severity()),
+			Message:  mr.Message(),
+			Data:     mr.Data(),
+			Tags:     r.Tags(),
+		})
+	}
+	return res
+}
+
+// clientResponse runs serve, which writes to rec, and returns the response
+// the client gets along with the error serve failed with, if any.
+func clientResponse(rec *httptest.ResponseRecorder, serve func() error) (resp *evalClientResponse, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				panic(v)
+			}
+			resp, err = &evalClientResponse{Dropped: true}, nil
+		}
+	}()
+
+	err = serve()
+	var herr caddyhttp.HandlerError
+	if errors.As(err, &herr) && errors.Is(herr.Err, errInterruptionTriggered) {
+		return &evalClientResponse{Status: herr.StatusCode, HandledByCaddy: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &evalClientResponse{
+		Status:  rec.Code,
+		Headers: rec.Header(),
+		Body:    rec.Body.String(),
+	}, nil
+}
+
+// writeEvalResponse plays the role of the upstream.
+func writeEvalResponse(w http.ResponseWriter, resp *evalResponse) {
+	if resp == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	for k, vs := range resp.Headers {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, resp.Body)
+}
+
+func severityName(s types.RuleSeverity) string {
+	if s < 0 {
+		return ""
+	}
+	return s.String()
+}
+
+func printEvalResults(w io.Writer, results []evalResult) {
+	for i, res := range results {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "#%d %s %s", i+1, res.Method, res.URI)
+		if res.Host != "" {
+			fmt.Fprintf(w, " (host %s)", res.Host)
+		}
+		fmt.Fprintf(w, "\n  handler: %s\n", res.Handler)
+
+		if it := res.Interruption; it != nil {
+			fmt.Fprintf(w, "  interruption: %s by rule %d", it.Action, it.RuleID)
+			if it.Status != 0 {
+				fmt.Fprintf(w, ", status %d", it.Status)
+			}
+			if it.Data != "" {
+				fmt.Fprintf(w, ", data %q", it.Data)
+			}
+			fmt.Fprintln(w)
+		} else {
+			fmt.Fprintln(w, "  interruption: none")
+		}
+		if resp := res.Response; resp != nil {
+			switch {
+			case resp.Dropped:
+				fmt.Fprintln(w, "  response: connection dropped")
+			case resp.HandledByCaddy:
+				fmt.Fprintf(w, "  response: status %d, written by the error handling of Caddy\n", resp.Status)
+			default:
+				fmt.Fprintf(w, "  response: status %d", resp.Status)
+				if location := resp.Headers.Get("Location"); location != "" {
+					fmt.Fprintf(w, ", location %s", location)
+				}
+				fmt.Fprintln(w)
+			}
+		}
+		fmt.Fprintf(w, "  stopped at phase: %s\n", res.Phase)
+		if res.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", res.Error)
+		}
+
+		if len(res.MatchedRules) == 0 {
+			fmt.Fprintln(w, "  matched rules: none")
+			continue
+		}
+		fmt.Fprintln(w, "  matched rules:")
+		for _, mr := range res.MatchedRules {
+			fmt.Fprintf(w, "    %d (%s)", mr.ID, mr.Phase)
+			if mr.Severity != "" {
+				fmt.Fprintf(w, " [%s]", mr.Severity)
+			}
+			if mr.Message != "" {
+				fmt.Fprintf(w, " %s", mr.Message)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
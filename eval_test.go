@@ -0,0 +1,236 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const evalDirectives = `SecRuleEngine On
+SecRequestBodyAccess On
+SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain
+SecRule REQUEST_HEADERS:User-Agent "scanner" "id:4,phase:1,pass,log,msg:'scanner detected'"
+SecRule REQUEST_URI "/blocked" "id:1,phase:1,deny,status:403,msg:'blocked uri'"
+SecRule ARGS_POST:q "attack" "id:2,phase:2,deny,status:403,msg:'attack in body'"
+SecRule RESPONSE_BODY "leak" "id:3,phase:4,deny,status:403,msg:'data leak'"`
+
+func evalHandlers(t *testing.T) []wafHandler {
+	t.Helper()
+	config, err := json.Marshal(map[string]string{"handler": "waf", "directives": evalDirectives})
+	require.NoError(t, err)
+	handlers, err := findWAFHandlers(config)
+	require.NoError(t, err)
+	require.Len(t, handlers, 1)
+	return handlers
+}
+
+func TestEvalRaw(t *testing.T) {
+	input := "GET /blocked HTTP/1.1\r\nHost: example.com\r\nUser-Agent: scanner\r\n\r\n" +
+		"\r\n" +
+		"POST /form HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 8\r\n\r\nq=attack" +
+		"GET /ok HTTP/1.1\r\nHost: example.com\r\n\r\n"
+
+	exchanges, err := readExchanges(strings.NewReader(input), evalFormatRaw)
+	require.NoError(t, err)
+	require.Len(t, exchanges, 3)
+
+	results, err := evalExchanges(evalHandlers(t), exchanges)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	require.NotNil(t, results[0].Interruption)
+	require.Equal(t, 1, results[0].Interruption.RuleID)
+	require.Equal(t, "request_headers", results[0].Phase)
+	var ids []int
+	for _, mr := range results[0].MatchedRules {
+		ids = append(ids, mr.ID)
+	}
+	require.ElementsMatch(t, []int{1, 4}, ids)
+
+	require.NotNil(t, results[1].Interruption)
+	require.Equal(t, 2, results[1].Interruption.RuleID)
+	require.Equal(t, "request_body", results[1].Phase)
+
+	require.Nil(t, results[2].Interruption)
+	require.Empty(t, results[2].MatchedRules)
+}
+
+func TestEvalJSONL(t *testing.T) {
+	input := `{"url": "http://example.com/page", "response": {"status": 200, "headers": {"Content-Type": ["text/plain"]}, "body": "a leak here"}}
+
+{"method": "GET", "url": "/page", "headers": {"Host": ["example.com"]}, "remote_addr": "10.0.0.1:1234"}
+`
+	exchanges, err := readExchanges(strings.NewReader(input), evalFormatJSONL)
+	require.NoError(t, err)
+	require.Len(t, exchanges, 2)
+	require.Equal(t, "example.com", exchanges[0].req.Host)
+	require.Equal(t, "/page", exchanges[0].req.URL.String())
+	require.Equal(t, "10.0.0.1:1234", exchanges[1].req.RemoteAddr)
+
+	results, err := evalExchanges(evalHandlers(t), exchanges)
+	require.NoError(t, err)
+
+	require.NotNil(t, results[0].Interruption)
+	require.Equal(t, 3, results[0].Interruption.RuleID)
+	require.Equal(t, "response_body", results[0].Phase)
+	require.Nil(t, results[1].Interruption)
+}
+
+func TestEvalHAR(t *testing.T) {
+	input := `{"log": {"entries": [{
+		"request": {
+			"method": "POST",
+			"url": "https://example.com/form?x=1",
+			"httpVersion": "HTTP/2",
+			"headers": [
+				{"name": ":authority", "value": "example.com"},
+				{"name": "content-type", "value": "application/x-www-form-urlencoded"}
+			],
+			"postData": {"mimeType": "application/x-www-form-urlencoded", "text": "q=attack"}
+		},
+		"response": {"status": 200, "headers": [], "content": {"text": ""}}
+	}]}}`
+
+	exchanges, err := readExchanges(strings.NewReader(input), evalFormatHAR)
+	require.NoError(t, err)
+	require.Len(t, exchanges, 1)
+	require.Equal(t, "example.com", exchanges[0].req.Host)
+	require.Equal(t, "/form?x=1", exchanges[0].req.URL.RequestURI())
+
+	results, err := evalExchanges(evalHandlers(t), exchanges)
+	require.NoError(t, err)
+	require.NotNil(t, results[0].Interruption)
+	require.Equal(t, 2, results[0].Interruption.RuleID)
+}
+
+func TestSelectWAFHandler(t *testing.T) {
+	handlers := []wafHandler{
+		{path: "a", hosts: []string{"example.com"}},
+		{path: "b", hosts: []string{"*.example.org"}},
+		{path: "c"},
+	}
+
+	tests := map[string]int{
+		"example.com":     0,
+		"EXAMPLE.com:443": 0,
+		"www.example.org": 1,
+		"example.org":     2,
+		"":                2,
+	}
+	for host, expected := range tests {
+		i, err := selectWAFHandler(handlers, host)
+		require.NoError(t, err)
+		require.Equal(t, expected, i, host)
+	}
+
+	_, err := selectWAFHandler(handlers[:2], "unknown.net")
+	require.Error(t, err)
+}
+
+func TestPrintEvalResults(t *testing.T) {
+	exchanges, err := readExchanges(strings.NewReader("GET /blocked HTTP/1.1\r\nHost: example.com\r\n\r\n"), evalFormatRaw)
+	require.NoError(t, err)
+	results, err := evalExchanges(evalHandlers(t), exchanges)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	printEvalResults(&out, results)
+	require.Contains(t, out.String(), "#1 GET /blocked (host example.com)")
+	require.Contains(t, out.String(), "interruption: deny by rule 1, status 403")
+	require.Contains(t, out.String(), "response: status 403, written by the error handling of Caddy")
+	require.Contains(t, out.String(), "stopped at phase: request_headers")
+	require.Contains(t, out.String(), "1 (request_headers) blocked uri")
+}
+
+func TestEvalFormatFromPath(t *testing.T) {
+	require.Equal(t, evalFormatHAR, evalFormatFromPath("export.HAR"))
+	require.Equal(t, evalFormatJSONL, evalFormatFromPath("requests.jsonl"))
+	require.Equal(t, evalFormatJSONL, evalFormatFromPath("requests.ndjson"))
+	require.Equal(t, evalFormatRaw, evalFormatFromPath("-"))
+	require.Equal(t, evalFormatRaw, evalFormatFromPath("request.txt"))
+}
+
+func TestEvalAppliesExclusions(t *testing.T) {
+	config, err := json.Marshal(map[string]any{
+		"handler":    "waf",
+		"directives": `SecRule REQUEST_URI "@contains attack" "id:100,phase:1,deny,status:403"`,
+		"exclusions": []map[string]any{{
+			"match": []map[string]any{{"path": []string{"/admin/*"}}},
+			"rules": []string{"100"},
+		}},
+	})
+	require.NoError(t, err)
+	handlers, err := findWAFHandlers(config)
+	require.NoError(t, err)
+
+	exchanges, err := readExchanges(strings.NewReader(
+		"GET /admin/attack HTTP/1.1\r\nHost: example.com\r\n\r\n"+
+			"GET /public/attack HTTP/1.1\r\nHost: example.com\r\n\r\n"), evalFormatRaw)
+	require.NoError(t, err)
+
+	results, err := evalExchanges(handlers, exchanges)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Nil(t, results[0].Interruption)
+	require.NotNil(t, results[1].Interruption)
+	require.Equal(t, 100, results[1].Interruption.RuleID)
+}
+
+func TestEvalRespondsLikeTheHandler(t *testing.T) {
+	config, err := json.Marshal(map[string]any{
+		"handler": "waf",
+		"directives": `SecRuleEngine On
+SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain
+SecRule REQUEST_URI "/denied" "id:1,phase:1,deny,status:403"
+SecRule REQUEST_URI "/moved" "id:2,phase:1,redirect:https://example.org/"
+SecRule REQUEST_URI "/dropped" "id:3,phase:1,drop"
+SecRule RESPONSE_BODY "leak" "id:4,phase:4,deny,status:403"`,
+		"block_response": map[string]any{
+			"status":       418,
+			"content_type": "text/plain",
+			"body":         "blocked",
+		},
+	})
+	require.NoError(t, err)
+	handlers, err := findWAFHandlers(config)
+	require.NoError(t, err)
+
+	exchanges, err := readExchanges(strings.NewReader(
+		"GET /denied HTTP/1.1\r\nHost: example.com\r\n\r\n"+
+			"GET /moved HTTP/1.1\r\nHost: example.com\r\n\r\n"+
+			"GET /dropped HTTP/1.1\r\nHost: example.com\r\n\r\n"+
+			"GET /fine HTTP/1.1\r\nHost: example.com\r\n\r\n"), evalFormatRaw)
+	require.NoError(t, err)
+	exchanges = append(exchanges, exchanges[3])
+	exchanges[4].resp = &evalResponse{Status: http.StatusOK, Headers: http.Header{"Content-Type": {"text/plain"}}, Body: "a leak"}
+
+	results, err := evalExchanges(handlers, exchanges)
+	require.NoError(t, err)
+	require.Len(t, results, 5)
+
+	denied := results[0].Response
+	require.Equal(t, 418, denied.Status)
+	require.Equal(t, "blocked", denied.Body)
+	require.Equal(t, "text/plain", denied.Headers.Get("Content-Type"))
+
+	require.Equal(t, http.StatusFound, results[1].Response.Status)
+	require.Equal(t, "https://example.org/", results[1].Response.Headers.Get("Location"))
+
+	require.True(t, results[2].Response.Dropped)
+
+	require.Equal(t, http.StatusOK, results[3].Response.Status)
+	require.Nil(t, results[3].Interruption)
+
+	require.Equal(t, 418, results[4].Response.Status, "response phases should use the block response too")
+	require.Equal(t, "blocked", results[4].Response.Body)
+	require.Empty(t, results[4].Error)
+}
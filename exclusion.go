@@ -0,0 +1,179 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+// ruleExclusion disables rules for the requests matching a set of Caddy
+// request matchers, the equivalent of a SecRule calling ctl:ruleRemoveById
+// or ctl:ruleRemoveByTag.
+type ruleExclusion struct {
+	// MatcherSetsRaw selects the requests the exclusion applies to. Matcher
+	// sets are OR'ed, matchers within a set are AND'ed together.
+	MatcherSetsRaw caddyhttp.RawMatcherSets `json:"match,omitempty" caddy:"namespace=http.matchers"`
+	// Rules are the IDs of the rules to disable, either a single ID such as
+	// "942100" or an inclusive range such as "942200-942299".
+	Rules []string `json:"rules,omitempty"`
+	// Tags disables every rule having any of these tags.
+	Tags []string `json:"tags,omitempty"`
+
+	matcherSets caddyhttp.MatcherSets
+	ranges      []ruleRange
+}
+
+// ruleRange is an inclusive range of rule IDs.
+type ruleRange struct {
+	start, end int
+}
+
+// parseRuleRange parses a rule ID or a range of rule IDs.
+func parseRuleRange(s string) (ruleRange, error) {
+	start, end, isRange := strings.Cut(s, "-")
+	first, err := strconv.Atoi(start)
+	if err != nil || first <= 0 {
+		return ruleRange{}, fmt.Errorf("invalid rule ID %q", s)
+	}
+	if !isRange {
+		return ruleRange{first, first}, nil
+	}
+	last, err := strconv.Atoi(end)
+	if err != nil || last < first {
+		return ruleRange{}, fmt.Errorf("invalid rule ID range %q", s)
+	}
+	return ruleRange{first, last}, nil
+}
+
+// provision loads the matchers and parses the rule IDs of the exclusion.
+func (e *ruleExclusion) provision(ctx caddy.Context) error {
+	if len(e.Rules) == 0 && len(e.Tags) == 0 {
+		return fmt.Errorf("no rules or tags to exclude")
+	}
+
+	for _, r := range e.Rules {
+		rr, err := parseRuleRange(r)
+		if err != nil {
+			return err
+		}
+		e.ranges = append(e.ranges, rr)
+	}
+
+	matchers, err := ctx.LoadModule(e, "MatcherSetsRaw")
+	if err != nil {
+		return fmt.Errorf("loading matchers: %v", err)
+	}
+	return e.matcherSets.FromInterface(matchers)
+}
+
+// ruleRemover is implemented by Coraza transactions, it allows disabling
+// rules for a single transaction.
+type ruleRemover interface {
+	RemoveRuleByID(id int)
+	RemoveRuleByIDRange(start, end int)
+}
+
+// applyExclusions disables in tx the rules excluded for r. Rules excluded by
+// tag are looked up among the rules waf was compiled with.
+func applyExclusions(exclusions []*ruleExclusion, waf coraza.WAF, tx types.Transaction, r *http.Request) error {
+	remover, ok := tx.(ruleRemover)
+	if !ok {
+		return nil
+	}
+
+	for _, e := range exclusions {
+		match, err := e.matcherSets.AnyMatchWithError(r)
+		if err != nil {
+			return err
+		}
+		if !match {
+			continue
+		}
+
+		for _, rr := range e.ranges {
+			if rr.start == rr.end {
+				remover.RemoveRuleByID(rr.start)
+			} else {
+				remover.RemoveRuleByIDRange(rr.start, rr.end)
+			}
+		}
+		if len(e.Tags) == 0 {
+			continue
+		}
+		if cw := compiled(waf); cw != nil {
+			for _, tag := range e.Tags {
+				for _, id := range cw.ruleIDsWithTag(tag) {
+					remover.RemoveRuleByID(id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalExclusion parses an exclude subdirective. Syntax:
+//
+//	exclude <matcher> {
+//	    rules <id|start-end>...
+//	    tags  <tag>...
+//	}
+func unmarshalExclusion(d *caddyfile.Dispenser, h *httpcaddyfile.Helper) (*ruleExclusion, error) {
+	if h == nil {
+		return nil, d.Err("exclude is only supported in the coraza_waf directive")
+	}
+
+	matcherSet, hasMatcher, err := h.MatcherToken()
+	if err != nil {
+		return nil, err
+	}
+	if !hasMatcher {
+		return nil, d.Err("exclude requires a matcher")
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	e := new(ruleExclusion)
+	if matcherSet != nil {
+		e.MatcherSetsRaw = caddyhttp.RawMatcherSets{matcherSet}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "rules":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return nil, d.ArgErr()
+			}
+			for _, arg := range args {
+				if _, err := parseRuleRange(arg); err != nil {
+					return nil, d.Err(err.Error())
+				}
+			}
+			e.Rules = append(e.Rules, args...)
+		case "tags":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return nil, d.ArgErr()
+			}
+			e.Tags = append(e.Tags, args...)
+		default:
+			return nil, d.Errf("invalid exclude key %q", d.Val())
+		}
+	}
+
+	if len(e.Rules) == 0 && len(e.Tags) == 0 {
+		return nil, d.Err("exclude requires rules or tags")
+	}
+	return e, nil
+}
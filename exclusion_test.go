@@ -0,0 +1,268 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const exclusionDirectives = `SecRuleEngine On
+SecRule REQUEST_URI "@contains attack" "id:942100,phase:1,deny,status:403"
+SecRule REQUEST_URI "@contains attack" "id:942210,phase:1,deny,status:403"
+SecRule REQUEST_URI "@contains attack" "id:950000,phase:1,deny,status:403,tag:'attack-sqli'"
+SecRule REQUEST_URI "@contains attack" "id:960000,phase:1,deny,status:403"`
+
+func TestParseRuleRange(t *testing.T) {
+	tests := map[string]struct {
+		input     string
+		want      ruleRange
+		shouldErr bool
+	}{
+		"single id":       {input: "942100", want: ruleRange{942100, 942100}},
+		"range":           {input: "942200-942299", want: ruleRange{942200, 942299}},
+		"not a number":    {input: "abc", shouldErr: true},
+		"zero":            {input: "0", shouldErr: true},
+		"reversed range":  {input: "942299-942200", shouldErr: true},
+		"incomplete":      {input: "942200-", shouldErr: true},
+		"negative number": {input: "-1", shouldErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseRuleRange(test.input)
+			if test.shouldErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestUnmarshalExclusion(t *testing.T) {
+	adapt := func(t *testing.T, block string) ([]byte, error) {
+		t.Helper()
+		config := fmt.Sprintf(`{
+			order coraza_waf first
+		}
+
+		:8080 {
+			@admin path /admin*
+			coraza_waf {
+				%s
+			}
+		}`, block)
+		out, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(config), nil)
+		return out, err
+	}
+
+	tests := map[string]struct {
+		block  string
+		errMsg string
+	}{
+		"rules and tags": {
+			block: `exclude @admin {
+				rules 942100 942200-942299
+				tags attack-sqli
+			}`,
+		},
+		"path matcher": {
+			block: `exclude /admin* {
+				rules 942100
+			}`,
+		},
+		"without matcher": {
+			block: `exclude {
+				rules 942100
+			}`,
+			errMsg: "exclude requires a matcher",
+		},
+		"without rules or tags": {
+			block:  `exclude @admin`,
+			errMsg: "exclude requires rules or tags",
+		},
+		"invalid rule id": {
+			block: `exclude @admin {
+				rules 942100-1
+			}`,
+			errMsg: "invalid rule ID range",
+		},
+		"rules without values": {
+			block: `exclude @admin {
+				rules
+			}`,
+			errMsg: "wrong argument count",
+		},
+		"unknown key": {
+			block: `exclude @admin {
+				ids 942100
+			}`,
+			errMsg: "invalid exclude key",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			out, err := adapt(t, test.block)
+			if test.errMsg != "" {
+				require.ErrorContains(t, err, test.errMsg)
+				return
+			}
+			require.NoError(t, err)
+
+			handlers, err := findWAFHandlers(out)
+			require.NoError(t, err)
+			require.Len(t, handlers, 1)
+			require.Len(t, handlers[0].module.Exclusions, 1)
+			require.Len(t, handlers[0].module.Exclusions[0].MatcherSetsRaw, 1)
+			require.Contains(t, string(handlers[0].module.Exclusions[0].MatcherSetsRaw[0]["path"]), "/admin*")
+		})
+	}
+
+	t.Run("rules and tags are stored", func(t *testing.T) {
+		out, err := adapt(t, `exclude @admin {
+			rules 942100 942200-942299
+			tags attack-sqli
+		}`)
+		require.NoError(t, err)
+		handlers, err := findWAFHandlers(out)
+		require.NoError(t, err)
+		e := handlers[0].module.Exclusions[0]
+		require.Equal(t, []string{"942100", "942200-942299"}, e.Rules)
+		require.Equal(t, []string{"attack-sqli"}, e.Tags)
+	})
+
+	t.Run("not supported without named matchers", func(t *testing.T) {
+		m := &corazaModule{}
+		err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`coraza_waf {
+			exclude @admin {
+				rules 942100
+			}
+		}`))
+		require.ErrorContains(t, err, "only supported in the coraza_waf directive")
+	})
+}
+
+func TestApplyExclusions(t *testing.T) {
+	m := &corazaModule{Directives: exclusionDirectives, logger: zap.NewNop()}
+	waf, err := m.buildWAF()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = waf.(*compiledWAF).Close() })
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	newExclusion := func(t *testing.T, e *ruleExclusion) *ruleExclusion {
+		t.Helper()
+		e.MatcherSetsRaw = caddyhttp.RawMatcherSets{{"path": json.RawMessage(`["/admin/*"]`)}}
+		require.NoError(t, e.provision(ctx))
+		return e
+	}
+
+	newRequest := func(path string) *http.Request {
+		req := httptest.NewRequest("GET", path, nil)
+		c := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+		return req.WithContext(c)
+	}
+
+	tests := map[string]struct {
+		exclusions []*ruleExclusion
+		path       string
+		wantRuleID int
+	}{
+		"no exclusion": {
+			path:       "/admin/attack",
+			wantRuleID: 942100,
+		},
+		"single id": {
+			exclusions: []*ruleExclusion{newExclusion(t, &ruleExclusion{Rules: []string{"942100"}})},
+			path:       "/admin/attack",
+			wantRuleID: 942210,
+		},
+		"id range": {
+			exclusions: []*ruleExclusion{newExclusion(t, &ruleExclusion{Rules: []string{"942100", "942200-942299"}})},
+			path:       "/admin/attack",
+			wantRuleID: 950000,
+		},
+		"tags": {
+			exclusions: []*ruleExclusion{newExclusion(t, &ruleExclusion{
+				Rules: []string{"942100-942299"},
+				Tags:  []string{"attack-sqli"},
+			})},
+			path:       "/admin/attack",
+			wantRuleID: 960000,
+		},
+		"not matching": {
+			exclusions: []*ruleExclusion{newExclusion(t, &ruleExclusion{Rules: []string{"942100"}})},
+			path:       "/public/attack",
+			wantRuleID: 942100,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := newRequest(test.path)
+			tx := waf.NewTransaction()
+			defer tx.Close()
+
+			require.NoError(t, applyExclusions(test.exclusions, waf, tx, req))
+			it, err := processRequest(tx, req)
+			require.NoError(t, err)
+			require.NotNil(t, it)
+			require.Equal(t, test.wantRuleID, it.RuleID)
+		})
+	}
+}
+
+func TestProvisionExclusionWithoutRules(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &corazaModule{
+		Directives: "SecRuleEngine On",
+		Exclusions: []*ruleExclusion{{}},
+	}
+	require.ErrorContains(t, m.Provision(ctx), "exclusion 0")
+}
+
+func TestExclusionsE2E(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(`{
+		admin localhost:%d
+		auto_https off
+		order coraza_waf first
+	}
+
+	:8080 {
+		@admin path /admin/*
+		coraza_waf {
+			directives `+"`%s`"+`
+			exclude @admin {
+				rules 942100 942200-942299
+				tags attack-sqli
+			}
+		}
+		respond "ok"
+	}`, caddytest.Default.AdminPort, strings.ReplaceAll(exclusionDirectives, `"id:960000,phase:1,deny,status:403"`, `"id:960000,phase:1,pass"`)), "caddyfile")
+
+	tester.AssertGetResponse(baseURL+"/admin/attack", 200, "ok")
+
+	req, _ := http.NewRequest("GET", baseURL+"/public/attack", nil)
+	tester.AssertResponseCode(req, 403)
+}
@@ -15,6 +15,15 @@ import (
 // Copied from https://github.com/corazawaf/coraza/blob/main/http/middleware.go
 
 func processRequest(tx types.Transaction, req *http.Request) (*types.Interruption, error) {
+	it, _, err := processRequestTraced(tx, req, nil)
+	return it, err
+}
+
+// processRequestTraced is processRequest tracing the phases with spans, it
+// also returns the number of bytes of the request body buffered for
+// inspection.
+func processRequestTraced(tx types.Transaction, req *http.Request, spans *phaseSpans) (*types.Interruption, int64, error) {
+	endHeaders := spans.start(types.PhaseRequestHeaders)
 
 	client, cport := getClientAddress(req)
 
@@ -46,27 +55,37 @@ func processRequest(tx types.Transaction, req *http.Request) (*types.Interruptio
 	}
 
 	in = tx.ProcessRequestHeaders()
+	endHeaders(nil)
 	if in != nil {
-		return in, nil
+		return in, 0, nil
 	}
 
+	var buffered int64
+	endBody := spans.start(types.PhaseRequestBody)
+
 	if tx.IsRequestBodyAccessible() {
 		// We only do body buffering if the transaction requires request
 		// body inspection, otherwise we just let the request follow its
 		// regular flow.
 		if req.Body != nil && req.Body != http.NoBody {
-			it, _, err := tx.ReadRequestBodyFrom(req.Body)
+			it, n, err := tx.ReadRequestBodyFrom(req.Body)
+			buffered = int64(n)
 			if err != nil {
-				return nil, fmt.Errorf("failed to append request body: %s", err.Error())
+				err = fmt.Errorf("failed to append request body: %s", err.Error())
+				endBody(err)
+				return nil, buffered, err
 			}
 
 			if it != nil {
-				return it, nil
+				endBody(nil)
+				return it, buffered, nil
 			}
 
 			rbr, err := tx.RequestBodyReader()
 			if err != nil {
-				return nil, fmt.Errorf("failed to get the request body: %s", err.Error())
+				err = fmt.Errorf("failed to get the request body: %s", err.Error())
+				endBody(err)
+				return nil, buffered, err
 			}
 
 			// Adds all remaining bytes beyond the coraza limit to its buffer
@@ -95,7 +114,9 @@ func processRequest(tx types.Transaction, req *http.Request) (*types.Interruptio
 		}
 	}
 
-	return tx.ProcessRequestBody()
+	it, err := tx.ProcessRequestBody()
+	endBody(err)
+	return it, buffered, err
 }
 
 // parseServerName parses r.Host in order to retrieve the virtual host.
@@ -0,0 +1,191 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	coreruleset "github.com/corazawaf/coraza-coreruleset/v4"
+	"github.com/jcchavezs/mergefs"
+	mergefsio "github.com/jcchavezs/mergefs/io"
+)
+
+// maxIncludeRecursion mirrors the limit enforced by the Coraza parser.
+const maxIncludeRecursion = 100
+
+// inlineFile is the name Coraza gives to directives not read from a file.
+const inlineFile = "_inline_"
+
+// directive is a single logical SecLang directive along with the location
+// where it starts.
+type directive struct {
+	text string
+	file string
+	line int
+}
+
+// includedFile is a rule file read while walking the directives. data is nil
+// when the file could not be read, or is embedded and skipped.
+type includedFile struct {
+	path string
+	data []byte
+	// embedded is set for the files of the embedded CRS, whose paths
+	// start with @.
+	embedded bool
+}
+
+// directiveWalker walks SecLang directives following the same rules as the
+// Coraza parser, descending into the files referenced by Include directives.
+// It lets the module know which files a rule set depends on without having
+// to compile it.
+type directiveWalker struct {
+	root fs.FS
+
+	// onDirective is called for every directive, Include ones included.
+	onDirective func(directive) error
+	// onFile is called for every file an Include directive resolves to.
+	onFile func(includedFile)
+	// onGlob is called for every Include pattern containing a wildcard.
+	onGlob func(pattern string)
+	// skipEmbedded skips reading the files of the embedded CRS, which
+	// cannot change while Caddy runs.
+	skipEmbedded bool
+
+	includeCount int
+}
+
+// ruleFS returns the filesystem Include directives are resolved against.
+func ruleFS(loadOWASPCRS bool) fs.FS {
+	if loadOWASPCRS {
+		return mergefs.Merge(coreruleset.FS, mergefsio.OSFS)
+	}
+	return mergefsio.OSFS
+}
+
+// walkString walks directives passed inline, e.g. the directives field.
+func (w *directiveWalker) walkString(data string) error {
+	return w.walk(data, inlineFile, "")
+}
+
+// walkInclude resolves an Include argument relative to dir and walks every
+// file it points to.
+func (w *directiveWalker) walkInclude(pattern, dir string) error {
+	var files []string
+	if strings.Contains(pattern, "*") {
+		if w.onGlob != nil {
+			w.onGlob(pattern)
+		}
+		var err error
+		if files, err = fs.Glob(w.root, pattern); err != nil {
+			return fmt.Errorf("failed to glob: %s", err.Error())
+		}
+	} else {
+		files = append(files, pattern)
+	}
+
+	for _, file := range files {
+		file = strings.TrimSpace(file)
+		if !strings.HasPrefix(file, "/") {
+			file = filepath.Join(dir, file)
+		}
+
+		embedded := strings.HasPrefix(file, "@")
+		if embedded && w.skipEmbedded {
+			if w.onFile != nil {
+				w.onFile(includedFile{path: file, embedded: true})
+			}
+			continue
+		}
+		data, err := fs.ReadFile(w.root, file)
+		if w.onFile != nil {
+			w.onFile(includedFile{path: file, data: data, embedded: embedded})
+		}
+		if err != nil {
+			// The parser is the one reporting missing files, we only
+			// care about what can be read.
+			continue
+		}
+
+		if err := w.walk(string(data), file, filepath.Dir(file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk splits data into logical directives the same way Coraza does: comments
+// are skipped, lines ending in a backslash are joined and backtick blocks are
+// kept together.
+func (w *directiveWalker) walk(data, file, dir string) error {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	var (
+		buf         strings.Builder
+		inBackticks bool
+		lineNumber  int
+		startLine   int
+	)
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if buf.Len() == 0 {
+			startLine = lineNumber
+		}
+
+		if !inBackticks && line[len(line)-1] == '`' {
+			inBackticks = true
+		} else if inBackticks && line[0] == '`' {
+			inBackticks = false
+		}
+
+		if inBackticks {
+			buf.WriteString(line)
+			buf.WriteString("\n")
+			continue
+		}
+
+		if line[len(line)-1] == '\\' {
+			buf.WriteString(strings.TrimSuffix(line, "\\"))
+			continue
+		}
+
+		buf.WriteString(line)
+		d := directive{text: buf.String(), file: file, line: startLine}
+		buf.Reset()
+		if err := w.visit(d, dir); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (w *directiveWalker) visit(d directive, dir string) error {
+	if w.onDirective != nil {
+		if err := w.onDirective(d); err != nil {
+			return err
+		}
+	}
+
+	name, opts, _ := strings.Cut(d.text, " ")
+	if !strings.EqualFold(name, "include") {
+		return nil
+	}
+
+	if w.includeCount >= maxIncludeRecursion {
+		return errors.New("too many included files")
+	}
+	w.includeCount++
+
+	if len(opts) >= 3 && opts[0] == '"' && opts[len(opts)-1] == '"' {
+		opts = strings.Trim(opts, `"`)
+	}
+	return w.walkInclude(opts, dir)
+}
@@ -0,0 +1,99 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectiveWalker(t *testing.T) {
+	tmpDir := t.TempDir()
+	nestedDir := filepath.Join(tmpDir, "nested")
+	require.NoError(t, os.Mkdir(nestedDir, 0755))
+
+	require.NoError(t, os.WriteFile(filepath.Join(nestedDir, "a.conf"), []byte(`
+# a comment
+SecRule REQUEST_URI "/a" \
+	"id:1,phase:1,deny"
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(nestedDir, "b.conf"), []byte(`SecRule REQUEST_URI "/b" "id:2,phase:1,deny"`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "main.conf"), []byte(`
+SecRuleEngine On
+Include "`+filepath.Join(nestedDir, "*.conf")+`"
+`), 0644))
+
+	var (
+		directives []directive
+		files      []string
+		globs      []string
+	)
+	w := &directiveWalker{
+		root: ruleFS(false),
+		onDirective: func(d directive) error {
+			directives = append(directives, d)
+			return nil
+		},
+		onFile: func(f includedFile) {
+			files = append(files, f.path)
+		},
+		onGlob: func(pattern string) {
+			globs = append(globs, pattern)
+		},
+	}
+
+	require.NoError(t, w.walkString("SecDebugLogLevel 3\nInclude "+filepath.Join(tmpDir, "main.conf")))
+
+	require.Equal(t, []string{
+		filepath.Join(tmpDir, "main.conf"),
+		filepath.Join(nestedDir, "a.conf"),
+		filepath.Join(nestedDir, "b.conf"),
+	}, files)
+	require.Equal(t, []string{filepath.Join(nestedDir, "*.conf")}, globs)
+
+	require.Len(t, directives, 6)
+	require.Equal(t, directive{text: "SecDebugLogLevel 3", file: inlineFile, line: 1}, directives[0])
+	require.Equal(t, directive{text: "SecRuleEngine On", file: filepath.Join(tmpDir, "main.conf"), line: 2}, directives[2])
+	require.Equal(t, directive{
+		text: `SecRule REQUEST_URI "/a" "id:1,phase:1,deny"`,
+		file: filepath.Join(nestedDir, "a.conf"),
+		line: 3,
+	}, directives[4])
+}
+
+func TestDirectiveWalkerMissingFile(t *testing.T) {
+	var files []includedFile
+	w := &directiveWalker{
+		root:   ruleFS(false),
+		onFile: func(f includedFile) { files = append(files, f) },
+	}
+
+	require.NoError(t, w.walkString("Include /does/not/exist.conf"))
+	require.Len(t, files, 1)
+	require.Equal(t, "/does/not/exist.conf", files[0].path)
+	require.Nil(t, files[0].data)
+}
+
+func TestDirectiveWalkerCoreRuleset(t *testing.T) {
+	var files []string
+	w := &directiveWalker{
+		root:   ruleFS(true),
+		onFile: func(f includedFile) { files = append(files, f.path) },
+	}
+
+	require.NoError(t, w.walkString("Include @owasp_crs/*.conf"))
+	require.NotEmpty(t, files)
+	require.Contains(t, files, "@owasp_crs/REQUEST-901-INITIALIZATION.conf")
+}
+
+func TestDirectiveWalkerRecursionLimit(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "loop.conf")
+	require.NoError(t, os.WriteFile(ruleFile, []byte("Include "+ruleFile), 0644))
+
+	w := &directiveWalker{root: ruleFS(false)}
+	require.Error(t, w.walkString("Include "+ruleFile))
+}
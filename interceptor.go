@@ -24,6 +24,26 @@ type rwInterceptor struct {
 	isWriteHeaderFlush            bool
 	wroteHeader                   bool
 	wroteBufferedBodyToDownstream bool
+	opts                          interceptorOptions
+}
+
+// interruptionResponder writes the response of an interruption whose
+// status code is status. It reports false when it leaves the interruption
+// to the default handling.
+type interruptionResponder func(w http.ResponseWriter, it *types.Interruption, status int) (bool, error)
+
+// interceptorOptions customize the responses of interrupted transactions.
+type interceptorOptions struct {
+	// keepHeaders are not removed from interrupted responses.
+	keepHeaders []string
+	// respond writes the response of interruptions, by default only the
+	// status code is sent.
+	respond interruptionResponder
+	// buffered is told how many bytes of the response body are buffered
+	// for inspection.
+	buffered func(n int)
+	// spans traces the response phases.
+	spans *phaseSpans
 }
 
 // WriteHeader records the status code to be sent right before the moment
@@ -42,10 +62,12 @@ func (i *rwInterceptor) WriteHeader(statusCode int) {
 
 	i.statusCode = statusCode
 
-	if it := i.tx.ProcessResponseHeaders(statusCode, i.proto); it != nil {
-		i.cleanHeaders()
-		i.statusCode = obtainStatusCodeFromInterruptionOrDefault(it, i.statusCode)
-		i.flushWriteHeader()
+	end := i.opts.spans.start(types.PhaseResponseHeaders)
+	it := i.tx.ProcessResponseHeaders(statusCode, i.proto)
+	end(nil)
+	if it != nil {
+		// There is nowhere to report a failure to write the response.
+		_ = i.interrupt(it)
 		return
 	}
 
@@ -65,10 +87,36 @@ func (i *rwInterceptor) flushWriteHeader() {
 	}
 }
 
-// cleanHeaders removes all headers from the response
+// interrupt replaces the response with the one of the interruption.
+func (i *rwInterceptor) interrupt(it *types.Interruption) error {
+	// if there is an interruption we must clean the headers and override the status code
+	i.cleanHeaders()
+	i.overrideWriteHeader(obtainStatusCodeFromInterruptionOrDefault(it, i.statusCode))
+	if i.opts.respond != nil && !i.isWriteHeaderFlush {
+		handled, err := i.opts.respond(i.w, it, i.statusCode)
+		if handled {
+			i.isWriteHeaderFlush = true
+			return err
+		}
+	}
+	i.flushWriteHeader()
+	return nil
+}
+
+// cleanHeaders removes all headers from the response, but keepHeaders
 func (i *rwInterceptor) cleanHeaders() {
-	for k := range i.w.Header() {
-		i.w.Header().Del(k)
+	h := i.w.Header()
+	kept := make(map[string][]string, len(i.opts.keepHeaders))
+	for _, k := range i.opts.keepHeaders {
+		if v := h.Values(k); len(v) > 0 {
+			kept[k] = v
+		}
+	}
+	for k := range h {
+		h.Del(k)
+	}
+	for k, v := range kept {
+		h[http.CanonicalHeaderKey(k)] = v
 	}
 }
 
@@ -92,18 +140,25 @@ func (i *rwInterceptor) Write(b []byte) (int, error) {
 	if !i.wroteHeader {
 		// if no header has been wrote at this point we aim to return 200
 		i.WriteHeader(http.StatusOK)
+		if i.tx.IsInterrupted() {
+			// the response headers triggered an interruption, whose
+			// response has already been written.
+			return len(b), nil
+		}
 	}
 
 	if i.tx.IsResponseBodyAccessible() && i.tx.IsResponseBodyProcessable() && !i.wroteBufferedBodyToDownstream {
 		// we only buffer the response body if we are going to access
 		// to it, otherwise we just send it to the response writer.
 		it, n, err := i.tx.WriteResponseBody(b)
+		if i.opts.buffered != nil {
+			i.opts.buffered(n)
+		}
 		if it != nil {
-			// if there is an interruption we must clean the headers and override the status code
-			i.cleanHeaders()
-			i.overrideWriteHeader(obtainStatusCodeFromInterruptionOrDefault(it, i.statusCode))
 			// We only flush the status code after an interruption.
-			i.flushWriteHeader()
+			if err := i.interrupt(it); err != nil {
+				return 0, err
+			}
 
 			// We return the number of bytes as according to the interface io.Writer
 			// if we don't return an error, the number of bytes written is len(p).
@@ -206,8 +261,16 @@ var _ responseWriter = (*rwInterceptor)(nil)
 func wrap(w http.ResponseWriter, r *http.Request, tx types.Transaction) (
 	http.ResponseWriter,
 	func(types.Transaction, *http.Request) error,
+) {
+	return wrapWithOptions(w, r, tx, interceptorOptions{})
+}
+
+// wrapWithOptions is wrap with customized responses for interruptions.
+func wrapWithOptions(w http.ResponseWriter, r *http.Request, tx types.Transaction, opts interceptorOptions) (
+	http.ResponseWriter,
+	func(types.Transaction, *http.Request) error,
 ) { // nolint:gocyclo
-	i := &rwInterceptor{w: w, tx: tx, proto: r.Proto, statusCode: 200}
+	i := &rwInterceptor{w: w, tx: tx, proto: r.Proto, statusCode: 200, opts: opts}
 
 	responseProcessor := func(tx types.Transaction, r *http.Request) error {
 		// We look for interruptions triggered at phase 3 (response headers)
@@ -218,7 +281,10 @@ func wrap(w http.ResponseWriter, r *http.Request, tx types.Transaction) (
 		}
 
 		if tx.IsResponseBodyAccessible() && tx.IsResponseBodyProcessable() && !i.wroteBufferedBodyToDownstream {
-			if it, err := tx.ProcessResponseBody(); err != nil {
+			end := opts.spans.start(types.PhaseResponseBody)
+			it, err := tx.ProcessResponseBody()
+			end(err)
+			if err != nil {
 				i.overrideWriteHeader(http.StatusInternalServerError)
 				i.flushWriteHeader()
 
@@ -231,6 +297,12 @@ func wrap(w http.ResponseWriter, r *http.Request, tx types.Transaction) (
 				// if there is an interruption we must clean the headers and override the status code
 				i.cleanHeaders()
 				code := obtainStatusCodeFromInterruptionOrDefault(it, i.statusCode)
+				if opts.respond != nil {
+					if handled, err := opts.respond(i.w, it, code); handled {
+						i.isWriteHeaderFlush = true
+						return err
+					}
+				}
 				i.overrideWriteHeader(code)
 				i.flushWriteHeader()
 
@@ -249,9 +321,15 @@ func wrap(w http.ResponseWriter, r *http.Request, tx types.Transaction) (
 		return nil
 	}
 
+	return preserveInterfaces(i, i.w), responseProcessor
+}
+
+// preserveInterfaces returns rw along with the optional http interfaces
+// implemented by w, the writer it wraps.
+func preserveInterfaces(rw responseWriter, w http.ResponseWriter) http.ResponseWriter {
 	var (
-		hijacker, isHijacker = i.w.(http.Hijacker)
-		pusher, isPusher     = i.w.(http.Pusher)
+		hijacker, isHijacker = w.(http.Hijacker)
+		pusher, isPusher     = w.(http.Pusher)
 	)
 
 	switch {
@@ -259,34 +337,43 @@ func wrap(w http.ResponseWriter, r *http.Request, tx types.Transaction) (
 		return struct {
 			responseWriter
 			http.Pusher
-		}{i, pusher}, responseProcessor
+		}{rw, pusher}
 	case isHijacker && !isPusher:
 		return struct {
 			responseWriter
 			http.Hijacker
-		}{i, hijacker}, responseProcessor
+		}{rw, hijacker}
 	case isHijacker && isPusher:
 		return struct {
 			responseWriter
 			http.Hijacker
 			http.Pusher
-		}{i, hijacker, pusher}, responseProcessor
+		}{rw, hijacker, pusher}
 	default:
 		return struct {
 			responseWriter
-		}{i}, responseProcessor
+		}{rw}
 	}
 }
 
 // obtainStatusCodeFromInterruptionOrDefault returns the desired status code derived from the interruption
-// on a "deny" action or a default value.
+// on a "deny" or "redirect" action or a default value.
 func obtainStatusCodeFromInterruptionOrDefault(it *types.Interruption, defaultStatusCode int) int {
-	if it.Action == "deny" {
+	switch it.Action {
+	case "deny":
 		statusCode := it.Status
 		if statusCode == 0 {
 			statusCode = 403
 		}
 
+		return statusCode
+	case "redirect":
+		// Coraza only keeps the status of the rule if it is a redirection.
+		statusCode := it.Status
+		if statusCode == 0 {
+			statusCode = http.StatusFound
+		}
+
 		return statusCode
 	}
 
@@ -77,7 +77,9 @@ func TestObtainStatusCode(t *testing.T) {
 	}{
 		{"deny with explicit status", "deny", 503, 200, 503},
 		{"deny with zero status defaults to 403", "deny", 0, 200, 403},
-		{"non-deny returns default", "redirect", 302, 200, 200},
+		{"redirect with explicit status", "redirect", 307, 200, 307},
+		{"redirect with zero status defaults to 302", "redirect", 0, 200, 302},
+		{"other actions return default", "drop", 0, 200, 200},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,173 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// wafMetrics are shared by every WAF handler and registered in the metrics
+// registry of each config load, like the metrics of Caddy's handlers.
+var wafMetrics = struct {
+	transactions  *prometheus.CounterVec
+	interruptions *prometheus.CounterVec
+	phaseDuration *prometheus.HistogramVec
+	bufferedBytes *prometheus.CounterVec
+	buildDuration *prometheus.GaugeVec
+	rules         *prometheus.GaugeVec
+}{
+	transactions: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "waf",
+		Name:      "transactions_total",
+		Help:      "Number of requests handled by the WAF, whether they were inspected or left out by sampling.",
+	}, []string{"server", "inspected"}),
+	interruptions: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "waf",
+		Name:      "interruptions_total",
+		Help:      "Number of transactions interrupted by the WAF.",
+	}, []string{"server", "rule_id", "phase", "action"}),
+	phaseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "caddy",
+		Subsystem: "waf",
+		Name:      "phase_duration_seconds",
+		Help:      "Time spent evaluating the rules of each phase.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"server", "phase"}),
+	bufferedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "waf",
+		Name:      "buffered_bytes_total",
+		Help:      "Bytes of request and response bodies buffered for inspection.",
+	}, []string{"server", "direction"}),
+	buildDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "waf",
+		Name:      "build_duration_seconds",
+		Help:      "Time it took to compile the rules of a pooled WAF.",
+	}, []string{"pool_key"}),
+	rules: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "waf",
+		Name:      "rules",
+		Help:      "Number of rules of a pooled WAF.",
+	}, []string{"pool_key"}),
+}
+
+// registerMetrics registers the WAF metrics in registry. They may already
+// be registered by another handler of the same config.
+func registerMetrics(registry *prometheus.Registry) error {
+	if registry == nil {
+		return nil
+	}
+	for _, c := range []prometheus.Collector{
+		wafMetrics.transactions,
+		wafMetrics.interruptions,
+		wafMetrics.phaseDuration,
+		wafMetrics.bufferedBytes,
+		wafMetrics.buildDuration,
+		wafMetrics.rules,
+	} {
+		if err := registry.Register(c); err != nil && !errors.As(err, new(prometheus.AlreadyRegisteredError)) {
+			return err
+		}
+	}
+	return nil
+}
+
+// serverName returns the name of the Caddy server handling r.
+func serverName(r *http.Request) string {
+	if s, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok {
+		return s.Name()
+	}
+	return ""
+}
+
+// observeTransaction records a request handled by the WAF.
+func observeTransaction(server string, inspected bool) {
+	wafMetrics.transactions.WithLabelValues(server, strconv.FormatBool(inspected)).Inc()
+}
+
+// observeBuffered records n bytes of a body buffered for inspection,
+// direction is either request or response.
+func observeBuffered(server, direction string, n int64) {
+	if n > 0 {
+		wafMetrics.bufferedBytes.WithLabelValues(server, direction).Add(float64(n))
+	}
+}
+
+// observeBuild records the build of the WAF stored under poolKey.
+func observeBuild(poolKey string, duration time.Duration, rules int) {
+	wafMetrics.buildDuration.WithLabelValues(poolKey).Set(duration.Seconds())
+	wafMetrics.rules.WithLabelValues(poolKey).Set(float64(rules))
+}
+
+// forgetBuild removes the metrics of a WAF released from the pool.
+func forgetBuild(poolKey string) {
+	wafMetrics.buildDuration.DeleteLabelValues(poolKey)
+	wafMetrics.rules.DeleteLabelValues(poolKey)
+}
+
+// observeInterruption records the interruption of tx, if any. It must be
+// called before the logging phase, which would become the last phase.
+func observeInterruption(server string, tx types.Transaction) {
+	it := tx.Interruption()
+	if it == nil {
+		return
+	}
+	phase := "unknown"
+	if lp, ok := tx.(interface{ LastPhase() types.RulePhase }); ok {
+		phase = phaseName(lp.LastPhase())
+	}
+	wafMetrics.interruptions.WithLabelValues(server, strconv.Itoa(it.RuleID), phase, it.Action).Inc()
+}
+
+// observePhases records how long the rules of every phase tx went through
+// took to evaluate, as measured by Coraza.
+func observePhases(server string, tx types.Transaction) {
+	sw, ok := tx.(interface{ GetStopWatch() string })
+	if !ok {
+		return
+	}
+	for phase, d := range parseStopWatch(sw.GetStopWatch()) {
+		if d > 0 {
+			wafMetrics.phaseDuration.WithLabelValues(server, phaseName(phase)).Observe(d.Seconds())
+		}
+	}
+}
+
+// parseStopWatch parses the per phase durations out of the output of
+// GetStopWatch, "<start> <elapsed>; combined=<ns>, p1=<ns>, ..., p5=<ns>".
+func parseStopWatch(sw string) map[types.RulePhase]time.Duration {
+	_, fields, ok := strings.Cut(sw, "; ")
+	if !ok {
+		return nil
+	}
+	durations := make(map[types.RulePhase]time.Duration, 5)
+	for _, field := range strings.Split(fields, ", ") {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || len(name) != 2 || name[0] != 'p' {
+			continue
+		}
+		phase, err := strconv.Atoi(name[1:])
+		if err != nil {
+			continue
+		}
+		ns, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		durations[types.RulePhase(phase)] = time.Duration(ns)
+	}
+	return durations
+}
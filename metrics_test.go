@@ -0,0 +1,121 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStopWatch(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		want  map[types.RulePhase]time.Duration
+	}{
+		"all phases": {
+			input: "1700000000000000000 1500; combined=1200, p1=100, p2=200, p3=300, p4=400, p5=200",
+			want: map[types.RulePhase]time.Duration{
+				types.PhaseRequestHeaders:  100,
+				types.PhaseRequestBody:     200,
+				types.PhaseResponseHeaders: 300,
+				types.PhaseResponseBody:    400,
+				types.PhaseLogging:         200,
+			},
+		},
+		"malformed values": {
+			input: "1700000000000000000 1500; combined=10, p1=abc, p2=10, px=3",
+			want: map[types.RulePhase]time.Duration{
+				types.PhaseRequestBody: 10,
+			},
+		},
+		"no phases": {
+			input: "1700000000000000000 1500",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := parseStopWatch(test.input)
+			if test.want == nil {
+				require.Empty(t, got)
+				return
+			}
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registerMetrics(registry))
+	// Every handler of a config registers the metrics.
+	require.NoError(t, registerMetrics(registry))
+	require.NoError(t, registerMetrics(nil))
+}
+
+func TestServeHTTPMetrics(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{Directives: `SecRuleEngine On
+SecRequestBodyAccess On
+SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain
+SecRule REQUEST_URI "@contains attack" "id:101,phase:1,deny,status:403"
+SecRule REQUEST_BODY "@contains attack" "id:102,phase:2,deny,status:403"`}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	require.Greater(t, testutil.ToFloat64(wafMetrics.rules.WithLabelValues(m.poolKey)), float64(0))
+	require.Greater(t, testutil.ToFloat64(wafMetrics.buildDuration.WithLabelValues(m.poolKey)), float64(0))
+
+	inspected := wafMetrics.transactions.WithLabelValues("", "true")
+	headers := wafMetrics.interruptions.WithLabelValues("", "101", "request_headers", "deny")
+	body := wafMetrics.interruptions.WithLabelValues("", "102", "request_body", "deny")
+	requestBytes := wafMetrics.bufferedBytes.WithLabelValues("", "request")
+	responseBytes := wafMetrics.bufferedBytes.WithLabelValues("", "response")
+	beforeInspected := testutil.ToFloat64(inspected)
+	beforeHeaders := testutil.ToFloat64(headers)
+	beforeBody := testutil.ToFloat64(body)
+	beforeRequestBytes := testutil.ToFloat64(requestBytes)
+	beforeResponseBytes := testutil.ToFloat64(responseBytes)
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		_, err := w.Write([]byte("hello"))
+		return err
+	})
+
+	post := func(body string) *http.Request {
+		req := newServeHTTPRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	require.Error(t, m.ServeHTTP(httptest.NewRecorder(), newServeHTTPRequest(http.MethodGet, "/attack", nil), next))
+	require.Error(t, m.ServeHTTP(httptest.NewRecorder(), post("q=attack"), next))
+	require.NoError(t, m.ServeHTTP(httptest.NewRecorder(), post("q=fine"), next))
+
+	require.Equal(t, float64(3), testutil.ToFloat64(inspected)-beforeInspected)
+	require.Equal(t, float64(1), testutil.ToFloat64(headers)-beforeHeaders)
+	require.Equal(t, float64(1), testutil.ToFloat64(body)-beforeBody)
+	require.Equal(t, float64(len("q=attack")+len("q=fine")), testutil.ToFloat64(requestBytes)-beforeRequestBytes)
+	require.Equal(t, float64(len("hello")), testutil.ToFloat64(responseBytes)-beforeResponseBytes)
+	require.Positive(t, testutil.CollectAndCount(wafMetrics.phaseDuration))
+
+	poolKey := m.poolKey
+	require.NoError(t, m.Cleanup())
+	// The gauges of released WAFs are removed.
+	require.False(t, wafMetrics.rules.DeleteLabelValues(poolKey))
+}
@@ -0,0 +1,606 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+	"go.uber.org/zap"
+)
+
+// wafOverrides are the changes made at runtime, through the admin API, to
+// how a pooled WAF evaluates requests: its rule engine can be switched
+// between On and DetectionOnly, and rules can be disabled. They apply to the
+// transactions created after them, for all the sites sharing the WAF or
+// those of a server or host only, and are dropped when a new config starts
+// unless they are set to persist.
+type wafOverrides struct {
+	// source is what the WAF was built from, the rule engine overrides
+	// are compiled out of it.
+	source wafSource
+	logger *zap.Logger
+
+	// mu serializes the changes, state is swapped on each of them so
+	// that transactions read it without locking.
+	mu    sync.Mutex
+	state atomic.Pointer[overrideState]
+	// timer removes the overrides once they expire.
+	timer *time.Timer
+}
+
+// overrideScope selects the requests an override applies to, those served
+// by a server of the http app, for a host, or both. The zero scope applies
+// to every site using the WAF.
+type overrideScope struct {
+	// Server is the name of the server in the http app, e.g. srv0.
+	Server string `json:"server,omitempty"`
+	// Host is the host requests are made for, without port.
+	Host string `json:"host,omitempty"`
+}
+
+// normalize returns s with its host in the form matches compares it in.
+func (s overrideScope) normalize() overrideScope {
+	s.Host = strings.ToLower(s.Host)
+	return s
+}
+
+// matches reports whether requests made to server for host are in s.
+func (s overrideScope) matches(server, host string) bool {
+	return (s.Server == "" || s.Server == server) && (s.Host == "" || s.Host == host)
+}
+
+// specificity ranks scopes so that the most specific rule engine override
+// wins, hosts being more specific than servers.
+func (s overrideScope) specificity() int {
+	n := 0
+	if s.Server != "" {
+		n++
+	}
+	if s.Host != "" {
+		n += 2
+	}
+	return n
+}
+
+// requestScope returns the server and host r is served by.
+func requestScope(r *http.Request) (server, host string) {
+	if srv, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok {
+		server = srv.Name()
+	}
+	host = r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return server, strings.ToLower(host)
+}
+
+// overrideState is a snapshot of the overrides of a WAF, it is never
+// modified once stored.
+type overrideState struct {
+	engines map[overrideScope]*engineOverride
+	rules   map[ruleOverrideKey]ruleOverride
+}
+
+// engineFor returns the engine override of the most specific scope
+// matching server and host, nil if there is none or s is nil.
+func (s *overrideState) engineFor(server, host string, now time.Time) *engineOverride {
+	if s == nil {
+		return nil
+	}
+	var override *engineOverride
+	best := -1
+	for scope, e := range s.engines {
+		if expired(e.expires, now) || !scope.matches(server, host) {
+			continue
+		}
+		if n := scope.specificity(); n > best {
+			override, best = e, n
+		}
+	}
+	return override
+}
+
+type engineOverride struct {
+	mode string
+	// waf is the WAF compiled with the rule engine set to mode.
+	waf     *wafGeneration
+	expires time.Time
+	persist bool
+}
+
+type ruleOverrideKey struct {
+	id    int
+	scope overrideScope
+}
+
+type ruleOverride struct {
+	expires time.Time
+	persist bool
+}
+
+// overrideRuleEngines are the rule engine modes the engine can be switched
+// to.
+var overrideRuleEngines = []string{"On", "DetectionOnly"}
+
+// newWAFOverrides returns the overrides of the WAF built from source, with
+// none set.
+func newWAFOverrides(source wafSource) *wafOverrides {
+	return &wafOverrides{
+		source: source,
+		logger: source.logger.With(zap.String("pool_key", source.poolKey)),
+	}
+}
+
+// build compiles the WAF with its rule engine forced to engine. Rebuilding
+// it when watched rule files change is up to the watcher of the pooled
+// WAF, see rebuild.
+func (o *wafOverrides) build(engine string) (coraza.WAF, error) {
+	source := o.source
+	source.ruleEngine = engine
+	// Keeps the variant out of the build metrics of the pooled WAF.
+	source.poolKey = ""
+	return source.build()
+}
+
+// expired reports whether an override expiring at expires no longer
+// applies at now.
+func expired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+// expiry returns when an override set at now for ttl expires, the zero
+// time if it doesn't.
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// newTransaction creates a transaction for r with the overrides applied,
+// from the WAF compiled for the overridden rule engine if any. release
+// must be called once the transaction is done, for the WAF it was created
+// from to be closed if it gets replaced meanwhile. It is safe to call on a
+// nil receiver, waf is used as is then.
+func (o *wafOverrides) newTransaction(waf coraza.WAF, id string, r *http.Request) (tx types.Transaction, release func()) {
+	var s *overrideState
+	if o != nil {
+		s = o.state.Load()
+	}
+	if s == nil {
+		waf, release := acquireWAF(waf)
+		return waf.NewTransactionWithID(id), release
+	}
+
+	now := time.Now()
+	server, host := requestScope(r)
+	for {
+		override := s.engineFor(server, host, now)
+		if override == nil {
+			var w coraza.WAF
+			w, release = acquireWAF(waf)
+			tx = w.NewTransactionWithID(id)
+			break
+		}
+		if override.waf.acquire() {
+			tx, release = override.waf.waf.NewTransactionWithID(id), override.waf.release
+			break
+		}
+		// The override was replaced since the state was loaded.
+		s = o.state.Load()
+	}
+
+	if remover, ok := tx.(ruleRemover); ok && s != nil {
+		for k, rule := range s.rules {
+			if !expired(rule.expires, now) && k.scope.matches(server, host) {
+				remover.RemoveRuleByID(k.id)
+			}
+		}
+	}
+	return tx, release
+}
+
+// setEngine switches the rule engine of the sites in scope to mode for
+// ttl, or until removed if ttl is zero.
+func (o *wafOverrides) setEngine(scope overrideScope, mode string, ttl time.Duration, persist bool) error {
+	valid := false
+	for _, m := range overrideRuleEngines {
+		valid = valid || m == mode
+	}
+	if !valid {
+		return fmt.Errorf("invalid rule engine %q, expected one of %v", mode, overrideRuleEngines)
+	}
+
+	// Compiled outside of the lock, it can take a while.
+	waf, err := o.build(mode)
+	if err != nil {
+		return fmt.Errorf("compiling the WAF with the rule engine %s: %w", mode, err)
+	}
+
+	scope = scope.normalize()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.clone()
+	old := s.engines[scope]
+	s.engines[scope] = &engineOverride{mode: mode, waf: newWAFGeneration(waf, o.logger), expires: expiry(time.Now(), ttl), persist: persist}
+	o.store(s)
+	closeWAF(old, o.logger)
+
+	o.logger.Warn("WAF rule engine overridden",
+		zap.String("rule_engine", mode),
+		zap.String("server", scope.Server),
+		zap.String("host", scope.Host),
+		zap.Duration("ttl", ttl),
+		zap.Bool("persist", persist),
+	)
+	return nil
+}
+
+// clearEngine restores the rule engine of the configuration for the sites
+// in scope.
+func (o *wafOverrides) clearEngine(scope overrideScope) {
+	scope = scope.normalize()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.clone()
+	old := s.engines[scope]
+	if old == nil {
+		return
+	}
+	delete(s.engines, scope)
+	o.store(s)
+	closeWAF(old, o.logger)
+	o.logger.Info("WAF rule engine override removed",
+		zap.String("rule_engine", old.mode),
+		zap.String("server", scope.Server),
+		zap.String("host", scope.Host),
+	)
+}
+
+// clear removes every override.
+func (o *wafOverrides) clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	old := o.state.Load()
+	if old == nil {
+		return
+	}
+	o.store(&overrideState{})
+	for _, e := range old.engines {
+		closeWAF(e, o.logger)
+	}
+	o.logger.Info("WAF overrides removed")
+}
+
+// disableRules disables the rules with the given IDs for the sites in
+// scope for ttl, or until enabled again if ttl is zero.
+func (o *wafOverrides) disableRules(scope overrideScope, ids []int, ttl time.Duration, persist bool) {
+	scope = scope.normalize()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.clone()
+	expires := expiry(time.Now(), ttl)
+	for _, id := range ids {
+		s.rules[ruleOverrideKey{id: id, scope: scope}] = ruleOverride{expires: expires, persist: persist}
+	}
+	o.store(s)
+	o.logger.Warn("WAF rules disabled",
+		zap.Ints("rule_ids", ids),
+		zap.String("server", scope.Server),
+		zap.String("host", scope.Host),
+		zap.Duration("ttl", ttl),
+		zap.Bool("persist", persist),
+	)
+}
+
+// enableRules enables again the rules with the given IDs for the sites in
+// scope, all the ones disabled for them if ids is empty.
+func (o *wafOverrides) enableRules(scope overrideScope, ids []int) {
+	scope = scope.normalize()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.clone()
+	if len(ids) == 0 {
+		for k := range s.rules {
+			if k.scope == scope {
+				ids = append(ids, k.id)
+			}
+		}
+		sort.Ints(ids)
+	}
+	var enabled []int
+	for _, id := range ids {
+		k := ruleOverrideKey{id: id, scope: scope}
+		if _, ok := s.rules[k]; ok {
+			delete(s.rules, k)
+			enabled = append(enabled, id)
+		}
+	}
+	if len(enabled) == 0 {
+		return
+	}
+	o.store(s)
+	o.logger.Info("WAF rules enabled",
+		zap.Ints("rule_ids", enabled),
+		zap.String("server", scope.Server),
+		zap.String("host", scope.Host),
+	)
+}
+
+// reload drops the overrides not set to persist, it is called once a new
+// config using the WAF started.
+func (o *wafOverrides) reload() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.clone()
+	var (
+		dropped []string
+		old     []*engineOverride
+	)
+	for scope, e := range s.engines {
+		if !e.persist {
+			delete(s.engines, scope)
+			old = append(old, e)
+		}
+	}
+	if len(old) > 0 {
+		dropped = append(dropped, "rule_engine")
+	}
+	var ids []int
+	for k, r := range s.rules {
+		if !r.persist {
+			delete(s.rules, k)
+			ids = append(ids, k.id)
+		}
+	}
+	if len(ids) > 0 {
+		dropped = append(dropped, "rules")
+	}
+	if len(dropped) == 0 {
+		return
+	}
+	o.store(s)
+	for _, e := range old {
+		closeWAF(e, o.logger)
+	}
+	sort.Ints(ids)
+	o.logger.Info("WAF overrides dropped on config reload",
+		zap.Strings("overrides", dropped),
+		zap.Ints("rule_ids", ids),
+	)
+}
+
+// rebuild compiles the rule engine overrides again, it is called by the
+// watcher of the pooled WAF once the rule files changed. Overrides that
+// fail to compile keep their previous WAF.
+func (o *wafOverrides) rebuild() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	cur := o.state.Load()
+	if cur == nil || len(cur.engines) == 0 {
+		return
+	}
+
+	s := o.clone()
+	var old []*engineOverride
+	for scope, e := range s.engines {
+		waf, err := o.build(e.mode)
+		if err != nil {
+			o.logger.Error("Failed to rebuild the WAF of the rule engine override, keeping the previous one",
+				zap.String("rule_engine", e.mode), zap.Error(err))
+			continue
+		}
+		rebuilt := *e
+		rebuilt.waf = newWAFGeneration(waf, o.logger)
+		s.engines[scope] = &rebuilt
+		old = append(old, e)
+	}
+	o.store(s)
+	for _, e := range old {
+		closeWAF(e, o.logger)
+	}
+}
+
+// expire drops the overrides that expired.
+func (o *wafOverrides) expire() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.clone()
+	now := time.Now()
+	var old []*engineOverride
+	for scope, e := range s.engines {
+		if expired(e.expires, now) {
+			delete(s.engines, scope)
+			old = append(old, e)
+		}
+	}
+	var ids []int
+	for k, r := range s.rules {
+		if expired(r.expires, now) {
+			delete(s.rules, k)
+			ids = append(ids, k.id)
+		}
+	}
+	if len(old) == 0 && len(ids) == 0 {
+		o.schedule(o.state.Load())
+		return
+	}
+	o.store(s)
+	for _, e := range old {
+		closeWAF(e, o.logger)
+		o.logger.Info("WAF rule engine override expired", zap.String("rule_engine", e.mode))
+	}
+	if len(ids) > 0 {
+		sort.Ints(ids)
+		o.logger.Info("WAF rules enabled after their override expired", zap.Ints("rule_ids", ids))
+	}
+}
+
+// close drops every override, once the WAF is destructed. It is a no-op
+// on a nil receiver.
+func (o *wafOverrides) close() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	if s := o.state.Swap(nil); s != nil {
+		for _, e := range s.engines {
+			closeWAF(e, o.logger)
+		}
+	}
+}
+
+// clone returns a copy of the current state to modify, o.mu must be held.
+func (o *wafOverrides) clone() *overrideState {
+	s := &overrideState{
+		engines: map[overrideScope]*engineOverride{},
+		rules:   map[ruleOverrideKey]ruleOverride{},
+	}
+	if cur := o.state.Load(); cur != nil {
+		maps.Copy(s.engines, cur.engines)
+		maps.Copy(s.rules, cur.rules)
+	}
+	return s
+}
+
+// store makes s the current state, o.mu must be held.
+func (o *wafOverrides) store(s *overrideState) {
+	if len(s.engines) == 0 && len(s.rules) == 0 {
+		s = nil
+	}
+	o.state.Store(s)
+	o.schedule(s)
+}
+
+// schedule arms the timer for the earliest expiry of s, o.mu must be held.
+func (o *wafOverrides) schedule(s *overrideState) {
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	if s == nil {
+		return
+	}
+	var next time.Time
+	earliest := func(t time.Time) {
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	for _, e := range s.engines {
+		earliest(e.expires)
+	}
+	for _, r := range s.rules {
+		earliest(r.expires)
+	}
+	if !next.IsZero() {
+		o.timer = time.AfterFunc(time.Until(next), o.expire)
+	}
+}
+
+// closeWAF closes the WAF compiled for e, if any, once the transactions in
+// flight created from it are done.
+func closeWAF(e *engineOverride, logger *zap.Logger) {
+	if e == nil {
+		return
+	}
+	if err := e.waf.retire(); err != nil {
+		logger.Warn("Failed to close the WAF of the rule engine override", zap.Error(err))
+	}
+}
+
+// overridesInfo describes the overrides of a WAF in the admin API.
+type overridesInfo struct {
+	RuleEngines   []engineOverrideInfo `json:"rule_engines,omitempty"`
+	DisabledRules []disabledRuleInfo   `json:"disabled_rules,omitempty"`
+}
+
+type engineOverrideInfo struct {
+	overrideScope
+	Mode    string     `json:"mode"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Persist bool       `json:"persist,omitempty"`
+}
+
+type disabledRuleInfo struct {
+	ID int `json:"id"`
+	overrideScope
+	Expires *time.Time `json:"expires,omitempty"`
+	Persist bool       `json:"persist,omitempty"`
+}
+
+// info describes the overrides in effect, nil if there is none.
+func (o *wafOverrides) info() *overridesInfo {
+	if o == nil {
+		return nil
+	}
+	s := o.state.Load()
+	if s == nil {
+		return nil
+	}
+
+	expiresAt := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	now := time.Now()
+	info := &overridesInfo{}
+	for scope, e := range s.engines {
+		if !expired(e.expires, now) {
+			info.RuleEngines = append(info.RuleEngines, engineOverrideInfo{
+				overrideScope: scope,
+				Mode:          e.mode,
+				Expires:       expiresAt(e.expires),
+				Persist:       e.persist,
+			})
+		}
+	}
+	for k, r := range s.rules {
+		if !expired(r.expires, now) {
+			info.DisabledRules = append(info.DisabledRules, disabledRuleInfo{
+				ID:            k.id,
+				overrideScope: k.scope,
+				Expires:       expiresAt(r.expires),
+				Persist:       r.persist,
+			})
+		}
+	}
+	sort.Slice(info.RuleEngines, func(i, j int) bool {
+		return scopeLess(info.RuleEngines[i].overrideScope, info.RuleEngines[j].overrideScope)
+	})
+	sort.Slice(info.DisabledRules, func(i, j int) bool {
+		a, b := info.DisabledRules[i], info.DisabledRules[j]
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return scopeLess(a.overrideScope, b.overrideScope)
+	})
+	if len(info.RuleEngines) == 0 && len(info.DisabledRules) == 0 {
+		return nil
+	}
+	return info
+}
+
+func scopeLess(a, b overrideScope) bool {
+	if a.Server != b.Server {
+		return a.Server < b.Server
+	}
+	return a.Host < b.Host
+}
@@ -0,0 +1,195 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+)
+
+const overridesDirectives = `SecRuleEngine On
+SecRule ARGS:q "@contains attack" "id:101,phase:1,deny,status:403"
+SecRule ARGS:q "@contains exploit" "id:102,phase:1,deny,status:403"`
+
+// provisionOverrides provisions a module with overridesDirectives.
+func provisionOverrides(t *testing.T) *corazaModule {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	m := &corazaModule{Directives: overridesDirectives}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+	return m
+}
+
+// statusOf returns the status m responds to target with.
+func statusOf(t *testing.T, m *corazaModule, target string) int {
+	t.Helper()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	err := m.ServeHTTP(httptest.NewRecorder(), newServeHTTPRequest(http.MethodGet, target, nil), next)
+	var herr caddyhttp.HandlerError
+	if errors.As(err, &herr) {
+		return herr.StatusCode
+	}
+	require.NoError(t, err)
+	return http.StatusOK
+}
+
+func TestEngineOverride(t *testing.T) {
+	m := provisionOverrides(t)
+	require.Equal(t, http.StatusForbidden, statusOf(t, m, "/?q=attack"))
+
+	require.NoError(t, m.overrides.setEngine(overrideScope{}, "DetectionOnly", 0, false))
+	require.Equal(t, http.StatusOK, statusOf(t, m, "/?q=attack"))
+	require.Equal(t, &overridesInfo{RuleEngines: []engineOverrideInfo{{Mode: "DetectionOnly"}}}, m.overrides.info())
+
+	m.overrides.clearEngine(overrideScope{})
+	require.Equal(t, http.StatusForbidden, statusOf(t, m, "/?q=attack"))
+	require.Nil(t, m.overrides.info())
+
+	require.Error(t, m.overrides.setEngine(overrideScope{}, "Off", 0, false))
+	require.Error(t, m.overrides.setEngine(overrideScope{}, "detectiononly", 0, false))
+}
+
+func TestDisabledRulesOverride(t *testing.T) {
+	m := provisionOverrides(t)
+
+	m.overrides.disableRules(overrideScope{}, []int{101}, 0, false)
+	require.Equal(t, http.StatusOK, statusOf(t, m, "/?q=attack"))
+	require.Equal(t, http.StatusForbidden, statusOf(t, m, "/?q=exploit"))
+
+	m.overrides.disableRules(overrideScope{}, []int{102}, 0, true)
+	require.Equal(t, http.StatusOK, statusOf(t, m, "/?q=exploit"))
+	require.Equal(t, &overridesInfo{DisabledRules: []disabledRuleInfo{{ID: 101}, {ID: 102, Persist: true}}}, m.overrides.info())
+
+	m.overrides.enableRules(overrideScope{}, []int{101})
+	require.Equal(t, http.StatusForbidden, statusOf(t, m, "/?q=attack"))
+	m.overrides.enableRules(overrideScope{}, nil)
+	require.Equal(t, http.StatusForbidden, statusOf(t, m, "/?q=exploit"))
+	require.Nil(t, m.overrides.info())
+}
+
+func TestScopedOverrides(t *testing.T) {
+	m := provisionOverrides(t)
+	statusOfHost := func(host string) int {
+		t.Helper()
+		req := newServeHTTPRequest(http.MethodGet, "/?q=attack", nil)
+		req.Host = host
+		err := m.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			return nil
+		}))
+		var herr caddyhttp.HandlerError
+		if errors.As(err, &herr) {
+			return herr.StatusCode
+		}
+		require.NoError(t, err)
+		return http.StatusOK
+	}
+
+	require.NoError(t, m.overrides.setEngine(overrideScope{Host: "A.example.com"}, "DetectionOnly", 0, false))
+	require.Equal(t, http.StatusOK, statusOfHost("a.example.com:8443"))
+	require.Equal(t, http.StatusForbidden, statusOfHost("b.example.com"))
+
+	// The most specific engine override wins.
+	require.NoError(t, m.overrides.setEngine(overrideScope{}, "DetectionOnly", 0, false))
+	require.NoError(t, m.overrides.setEngine(overrideScope{Host: "a.example.com"}, "On", 0, false))
+	require.Equal(t, http.StatusForbidden, statusOfHost("a.example.com"))
+	require.Equal(t, http.StatusOK, statusOfHost("b.example.com"))
+	m.overrides.clear()
+
+	m.overrides.disableRules(overrideScope{Server: "other"}, []int{101}, 0, false)
+	require.Equal(t, http.StatusForbidden, statusOfHost("a.example.com"))
+	m.overrides.disableRules(overrideScope{Host: "b.example.com"}, []int{101}, 0, false)
+	require.Equal(t, http.StatusForbidden, statusOfHost("a.example.com"))
+	require.Equal(t, http.StatusOK, statusOfHost("b.example.com"))
+	require.Equal(t, &overridesInfo{DisabledRules: []disabledRuleInfo{
+		{ID: 101, overrideScope: overrideScope{Host: "b.example.com"}},
+		{ID: 101, overrideScope: overrideScope{Server: "other"}},
+	}}, m.overrides.info())
+}
+
+func TestOverrideScopeMatches(t *testing.T) {
+	tests := []struct {
+		scope        overrideScope
+		server, host string
+		want         bool
+	}{
+		{overrideScope{}, "srv0", "example.com", true},
+		{overrideScope{Server: "srv0"}, "srv0", "example.com", true},
+		{overrideScope{Server: "srv0"}, "srv1", "example.com", false},
+		{overrideScope{Host: "example.com"}, "srv1", "example.com", true},
+		{overrideScope{Host: "example.com"}, "srv1", "www.example.com", false},
+		{overrideScope{Server: "srv0", Host: "example.com"}, "srv0", "example.com", true},
+		{overrideScope{Server: "srv0", Host: "example.com"}, "srv1", "example.com", false},
+	}
+	for _, tc := range tests {
+		require.Equal(t, tc.want, tc.scope.matches(tc.server, tc.host), "%+v on %s/%s", tc.scope, tc.server, tc.host)
+	}
+}
+
+func TestOverridesRebuild(t *testing.T) {
+	m := provisionOverrides(t)
+	require.NoError(t, m.overrides.setEngine(overrideScope{}, "DetectionOnly", 0, false))
+	before := m.overrides.state.Load().engines[overrideScope{}].waf
+
+	m.overrides.rebuild()
+	after := m.overrides.state.Load().engines[overrideScope{}].waf
+	require.NotSame(t, before, after)
+	require.Equal(t, http.StatusOK, statusOf(t, m, "/?q=attack"))
+	require.Equal(t, &overridesInfo{RuleEngines: []engineOverrideInfo{{Mode: "DetectionOnly"}}}, m.overrides.info())
+}
+
+func TestOverridesExpire(t *testing.T) {
+	m := provisionOverrides(t)
+
+	m.overrides.disableRules(overrideScope{}, []int{101}, 50*time.Millisecond, false)
+	m.overrides.disableRules(overrideScope{}, []int{102}, time.Hour, false)
+	require.NoError(t, m.overrides.setEngine(overrideScope{}, "DetectionOnly", 100*time.Millisecond, false))
+	info := m.overrides.info()
+	require.NotNil(t, info.RuleEngines[0].Expires)
+	require.Len(t, info.DisabledRules, 2)
+
+	require.Eventually(t, func() bool {
+		info := m.overrides.info()
+		return len(info.RuleEngines) == 0 && len(info.DisabledRules) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusForbidden, statusOf(t, m, "/?q=attack"))
+	require.Equal(t, http.StatusOK, statusOf(t, m, "/?q=exploit"))
+}
+
+func TestOverridesReload(t *testing.T) {
+	m := provisionOverrides(t)
+	require.NoError(t, m.overrides.setEngine(overrideScope{}, "DetectionOnly", 0, false))
+	m.overrides.disableRules(overrideScope{}, []int{101}, 0, false)
+	m.overrides.disableRules(overrideScope{}, []int{102}, 0, true)
+
+	// A new config reusing the WAF.
+	reloaded := provisionOverrides(t)
+	require.Same(t, m.overrides, reloaded.overrides)
+	require.Equal(t, &overridesInfo{DisabledRules: []disabledRuleInfo{{ID: 102, Persist: true}}}, reloaded.overrides.info())
+	require.Equal(t, http.StatusForbidden, statusOf(t, reloaded, "/?q=attack"))
+	require.Equal(t, http.StatusOK, statusOf(t, reloaded, "/?q=exploit"))
+
+	require.NoError(t, reloaded.overrides.setEngine(overrideScope{}, "DetectionOnly", 0, true))
+	reloaded = provisionOverrides(t)
+	require.Equal(t, "DetectionOnly", reloaded.overrides.info().RuleEngines[0].Mode)
+	require.Equal(t, http.StatusOK, statusOf(t, reloaded, "/?q=attack"))
+}
+
+func TestOverridesWithoutPool(t *testing.T) {
+	var o *wafOverrides
+	require.Nil(t, o.info())
+	o.close()
+}
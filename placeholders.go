@@ -0,0 +1,195 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+// placeholderRegex matches what may be a Caddy placeholder.
+var placeholderRegex = regexp.MustCompile(`\{([^{}\s]+)\}`)
+
+// expandPlaceholders replaces the global placeholders known to repl, such as
+// {env.*} and {file.*}, in SecLang directives.
+//
+// caddy.Replacer is not used as-is because SecLang is full of braces: regex
+// quantifiers like \d{3} are not known placeholders and are left alone, but
+// the replacer would unescape \{ and \} in regular expressions. Macros like
+// %{tx.score} are skipped for the same reason.
+func expandPlaceholders(directives string, repl *caddy.Replacer) string {
+	matches := placeholderRegex.FindAllStringSubmatchIndex(directives, -1)
+	if len(matches) == 0 {
+		return directives
+	}
+
+	var (
+		sb   strings.Builder
+		last int
+	)
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if escapedPlaceholder(directives, start) {
+			continue
+		}
+		value, ok := repl.GetString(directives[match[2]:match[3]])
+		if !ok {
+			continue
+		}
+		sb.WriteString(directives[last:start])
+		sb.WriteString(value)
+		last = end
+	}
+	sb.WriteString(directives[last:])
+	return sb.String()
+}
+
+// escapedPlaceholder reports whether the braces at start in directives are
+// an escaped brace or a SecLang macro rather than a placeholder.
+func escapedPlaceholder(directives string, start int) bool {
+	return start > 0 && (directives[start-1] == '%' || directives[start-1] == '\\')
+}
+
+// volatilePlaceholderPrefix is the prefix of the global placeholders whose
+// value changes over time.
+const volatilePlaceholderPrefix = "time."
+
+// checkStablePlaceholders returns an error if directives use a placeholder
+// whose value changes over time, such as {time.now}. The expanded directives
+// are part of the pool key, every config reload would build a new WAF.
+func checkStablePlaceholders(directives string) error {
+	for _, match := range placeholderRegex.FindAllStringSubmatchIndex(directives, -1) {
+		if escapedPlaceholder(directives, match[0]) {
+			continue
+		}
+		if name := directives[match[2]:match[3]]; strings.HasPrefix(name, volatilePlaceholderPrefix) {
+			return fmt.Errorf("placeholder {%s} changes over time and cannot be used in directives", name)
+		}
+	}
+	return nil
+}
+
+// expandPlaceholders expands the global placeholders in the directives and
+// in the paths of the deprecated include field of m.
+func (m *corazaModule) expandPlaceholders() error {
+	if err := checkStablePlaceholders(m.Directives); err != nil {
+		return err
+	}
+	for _, inc := range m.Include {
+		if err := checkStablePlaceholders(inc); err != nil {
+			return fmt.Errorf("include: %w", err)
+		}
+	}
+
+	repl := caddy.NewReplacer()
+	m.Directives = expandPlaceholders(m.Directives, repl)
+	for i, inc := range m.Include {
+		m.Include[i] = expandPlaceholders(inc, repl)
+	}
+	return nil
+}
+
+// wafVerdict exposes the outcome of a transaction to other handlers as
+// {http.waf.*} placeholders, for handle_errors, header or log directives:
+//
+//	{http.waf.interrupted}            whether the WAF interrupted the request
+//	{http.waf.action}                 the disruptive action, e.g. deny
+//	{http.waf.status}                 the status code of the interruption
+//	{http.waf.rule_id}                the ID of the interrupting rule
+//	{http.waf.matched_rules}          comma-separated IDs of the matched rules
+//	                                  with a message
+//	{http.waf.inbound_anomaly_score}  the CRS blocking inbound anomaly score
+//	{http.waf.tx.<var>}               a TX variable
+//
+// Transactions are recycled when they are closed, before handle_errors and
+// loggers run, so the values are copied from the transaction by freeze.
+type wafVerdict struct {
+	// tx is read from until freeze is called.
+	tx     types.Transaction
+	txVars map[string]string
+}
+
+// newWAFVerdict adds the placeholders of tx to repl.
+func newWAFVerdict(repl *caddy.Replacer, tx types.Transaction) *wafVerdict {
+	v := &wafVerdict{tx: tx}
+	repl.Map(v.txVariable)
+	return v
+}
+
+// update sets the verdict placeholders from the transaction as it is now.
+func (v *wafVerdict) update(repl *caddy.Replacer) {
+	tx := v.tx
+	if tx == nil {
+		return
+	}
+
+	it := tx.Interruption()
+	repl.Set("http.waf.interrupted", it != nil)
+	if it != nil {
+		repl.Set("http.waf.action", it.Action)
+		repl.Set("http.waf.status", obtainStatusCodeFromInterruptionOrDefault(it, it.Status))
+		repl.Set("http.waf.rule_id", it.RuleID)
+	}
+
+	var ids []string
+	for _, mr := range tx.MatchedRules() {
+		if id := mr.Rule().ID(); id != 0 && mr.Message() != "" {
+			ids = append(ids, strconv.Itoa(id))
+		}
+	}
+	repl.Set("http.waf.matched_rules", strings.Join(ids, ","))
+
+	if score, ok := v.txVariable("http.waf.tx.blocking_inbound_anomaly_score"); ok {
+		repl.Set("http.waf.inbound_anomaly_score", score)
+	}
+}
+
+// freeze updates the placeholders one last time and copies the TX
+// variables, the transaction must not be used afterwards.
+func (v *wafVerdict) freeze(repl *caddy.Replacer) {
+	if v.tx == nil {
+		return
+	}
+	v.update(repl)
+
+	if state, ok := v.tx.(plugintypes.TransactionState); ok {
+		v.txVars = make(map[string]string)
+		for _, md := range state.Variables().TX().FindAll() {
+			if _, seen := v.txVars[md.Key()]; !seen {
+				v.txVars[md.Key()] = md.Value()
+			}
+		}
+	}
+	v.tx = nil
+}
+
+// txVariable is a caddy.ReplacerFunc resolving {http.waf.tx.<var>}.
+func (v *wafVerdict) txVariable(key string) (any, bool) {
+	name, ok := strings.CutPrefix(key, "http.waf.tx.")
+	if !ok || name == "" {
+		return nil, false
+	}
+	// TX variables are case insensitive, Coraza stores them lowercased.
+	name = strings.ToLower(name)
+
+	if v.tx == nil {
+		value, ok := v.txVars[name]
+		return value, ok
+	}
+	state, ok := v.tx.(plugintypes.TransactionState)
+	if !ok {
+		return nil, false
+	}
+	values := state.Variables().TX().Get(name)
+	if len(values) == 0 {
+		return nil, false
+	}
+	return values[0], true
+}
@@ -0,0 +1,251 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandPlaceholders(t *testing.T) {
+	t.Setenv("WAF_ENGINE", "DetectionOnly")
+	secret := filepath.Join(t.TempDir(), "waf_key")
+	require.NoError(t, os.WriteFile(secret, []byte("s3cr3t\n"), 0600))
+
+	tests := map[string]struct {
+		input string
+		want  string
+	}{
+		"no placeholders": {
+			input: `SecRuleEngine On`,
+			want:  `SecRuleEngine On`,
+		},
+		"env": {
+			input: `SecRuleEngine {env.WAF_ENGINE}`,
+			want:  `SecRuleEngine DetectionOnly`,
+		},
+		"unset env": {
+			input: `SecRuleEngine {env.WAF_UNSET_VARIABLE}`,
+			want:  `SecRuleEngine `,
+		},
+		"file": {
+			input: `SecRule REQUEST_HEADERS:X-Key "!@streq {file.` + secret + `}" "id:1,deny"`,
+			want:  `SecRule REQUEST_HEADERS:X-Key "!@streq s3cr3t" "id:1,deny"`,
+		},
+		"regex quantifiers": {
+			input: `SecRule ARGS "@rx ^\d{3}-\d{2,4}$" "id:1,deny"`,
+			want:  `SecRule ARGS "@rx ^\d{3}-\d{2,4}$" "id:1,deny"`,
+		},
+		"escaped braces": {
+			input: `SecRule ARGS "@rx \{env.WAF_ENGINE\}" "id:1,deny"`,
+			want:  `SecRule ARGS "@rx \{env.WAF_ENGINE\}" "id:1,deny"`,
+		},
+		"macros": {
+			input: `SecRule ARGS "@rx a" "id:1,deny,msg:'%{env.WAF_ENGINE} %{tx.anomaly_score}'"`,
+			want:  `SecRule ARGS "@rx a" "id:1,deny,msg:'%{env.WAF_ENGINE} %{tx.anomaly_score}'"`,
+		},
+		"several": {
+			input: "SecRuleEngine {env.WAF_ENGINE}\nSecAction \"id:1,pass,setvar:tx.os={system.os}\"",
+			want:  "SecRuleEngine DetectionOnly\nSecAction \"id:1,pass,setvar:tx.os=" + caddyOS(t) + "\"",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.want, expandPlaceholders(test.input, caddy.NewReplacer()))
+		})
+	}
+}
+
+func caddyOS(t *testing.T) string {
+	t.Helper()
+	os, ok := caddy.NewReplacer().GetString("system.os")
+	require.True(t, ok)
+	return os
+}
+
+func TestProvisionExpandsPlaceholdersBeforePoolKey(t *testing.T) {
+	directives := "SecRuleEngine {env.WAF_ENGINE}\nSecAction \"id:10010,phase:1,pass,nolog\""
+
+	provision := func(t *testing.T, engine string) *corazaModule {
+		t.Helper()
+		t.Setenv("WAF_ENGINE", engine)
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+
+		m := &corazaModule{Directives: directives}
+		require.NoError(t, m.Provision(ctx))
+		t.Cleanup(func() { _ = m.Cleanup() })
+		return m
+	}
+
+	staging := provision(t, "DetectionOnly")
+	production := provision(t, "On")
+
+	require.Contains(t, staging.Directives, "SecRuleEngine DetectionOnly")
+	require.Contains(t, production.Directives, "SecRuleEngine On")
+	require.NotEqual(t, staging.poolKey, production.poolKey)
+	require.NotSame(t, staging.waf, production.waf)
+}
+
+func TestProvisionPlaceholdersInIncludeAndVolatile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "rules.conf"), []byte(`SecRule REQUEST_URI "/a" "id:1,phase:1,deny"`), 0644))
+	t.Setenv("WAF_RULES_DIR", dir)
+
+	newCtx := func(t *testing.T) caddy.Context {
+		t.Helper()
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	t.Run("deprecated include", func(t *testing.T) {
+		m := &corazaModule{Include: []string{"{env.WAF_RULES_DIR}/*.conf"}}
+		require.NoError(t, m.Provision(newCtx(t)))
+		t.Cleanup(func() { _ = m.Cleanup() })
+		require.Equal(t, []string{dir + "/*.conf"}, m.Include)
+	})
+
+	t.Run("volatile placeholders", func(t *testing.T) {
+		m := &corazaModule{Directives: `SecAction "id:1,phase:1,pass,nolog,setvar:tx.loaded={time.now.unix}"`}
+		require.ErrorContains(t, m.Provision(newCtx(t)), "placeholder {time.now.unix} changes over time")
+
+		m = &corazaModule{Include: []string{"/etc/waf/{time.now.year}.conf"}}
+		require.ErrorContains(t, m.Provision(newCtx(t)), "include: placeholder {time.now.year}")
+	})
+
+	t.Run("macros are not placeholders", func(t *testing.T) {
+		require.NoError(t, checkStablePlaceholders(`SecAction "id:1,pass,msg:'%{time.now}'"`))
+	})
+}
+
+const verdictDirectives = `SecRuleEngine On
+SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain
+SecAction "id:10,phase:1,pass,nolog,setvar:tx.blocking_inbound_anomaly_score=0,setvar:tx.Team=payments"
+SecRule ARGS:q "@streq probe" "id:20,phase:1,pass,msg:'Probe',setvar:tx.blocking_inbound_anomaly_score=+3"
+SecRule ARGS:q "@contains attack" "id:30,phase:1,deny,status:418,msg:'Attack',setvar:tx.blocking_inbound_anomaly_score=+5"
+SecRule RESPONSE_BODY "@contains secret" "id:40,phase:4,deny,msg:'Leak'"`
+
+func TestWAFVerdictPlaceholders(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{Directives: verdictDirectives}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	tests := map[string]struct {
+		target string
+		body   string
+		want   map[string]string
+	}{
+		"allowed": {
+			target: "/",
+			body:   "hello",
+			want: map[string]string{
+				"http.waf.interrupted":           "false",
+				"http.waf.action":                "",
+				"http.waf.rule_id":               "",
+				"http.waf.matched_rules":         "",
+				"http.waf.inbound_anomaly_score": "0",
+				"http.waf.tx.team":               "payments",
+				"http.waf.tx.TEAM":               "payments",
+				"http.waf.tx.unknown":            "",
+			},
+		},
+		"matched without interruption": {
+			target: "/?q=probe",
+			body:   "hello",
+			want: map[string]string{
+				"http.waf.interrupted":           "false",
+				"http.waf.matched_rules":         "20",
+				"http.waf.inbound_anomaly_score": "3",
+			},
+		},
+		"interrupted in request": {
+			target: "/?q=attack",
+			want: map[string]string{
+				"http.waf.interrupted":           "true",
+				"http.waf.action":                "deny",
+				"http.waf.status":                "418",
+				"http.waf.rule_id":               "30",
+				"http.waf.matched_rules":         "30",
+				"http.waf.inbound_anomaly_score": "5",
+			},
+		},
+		"interrupted in response": {
+			target: "/",
+			body:   "top secret",
+			want: map[string]string{
+				"http.waf.interrupted":   "true",
+				"http.waf.action":        "deny",
+				"http.waf.status":        "403",
+				"http.waf.rule_id":       "40",
+				"http.waf.matched_rules": "40",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := newServeHTTPRequest(http.MethodGet, test.target, nil)
+			repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+			var seenByNext string
+			_ = m.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				seenByNext = repl.ReplaceAll("{http.waf.interrupted} {http.waf.tx.team}", "")
+				w.Header().Set("Content-Type", "text/plain")
+				_, err := w.Write([]byte(test.body))
+				return err
+			}))
+			if test.body != "" {
+				require.Equal(t, "false payments", seenByNext)
+			}
+
+			// The transaction is closed, the placeholders must still resolve.
+			for key, want := range test.want {
+				got := repl.ReplaceAll("{"+key+"}", "")
+				require.Equal(t, want, got, key)
+			}
+		})
+	}
+}
+
+func TestWAFVerdictPlaceholdersInErrorPage(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(fmt.Sprintf(`{
+		admin localhost:%d
+		auto_https off
+		order coraza_waf first
+	}
+
+	:8080 {
+		coraza_waf {
+			directives `+"`%s`"+`
+		}
+		respond "ok"
+		handle_errors {
+			respond "blocked by rule {http.waf.rule_id}, reference {http.transaction_id}" {err.status_code}
+		}
+	}`, caddytest.Default.AdminPort, verdictDirectives), "caddyfile")
+
+	req, _ := http.NewRequest("GET", baseURL+"/?q=attack", nil)
+	resp := tester.AssertResponseCode(req, 418)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Regexp(t, `^blocked by rule 30, reference [A-Za-z]{16}$`, string(body))
+}
@@ -0,0 +1,108 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+// Module namespaces of the Coraza plugins. The name of a module, i.e. the
+// last label of its ID, is the name rules refer to the plugin with.
+const (
+	operatorsNamespace       = "http.handlers.waf.operators"
+	actionsNamespace         = "http.handlers.waf.actions"
+	transformationsNamespace = "http.handlers.waf.transformations"
+)
+
+// OperatorPlugin is implemented by modules in the http.handlers.waf.operators
+// namespace. For example, the module http.handlers.waf.operators.checkToken
+// is used in rules as @checkToken.
+type OperatorPlugin interface {
+	caddy.Module
+	// NewOperator creates an instance of the operator for a rule.
+	NewOperator(options plugintypes.OperatorOptions) (plugintypes.Operator, error)
+}
+
+// ActionPlugin is implemented by modules in the http.handlers.waf.actions
+// namespace. For example, the module http.handlers.waf.actions.notify is
+// used in rules as notify:<argument>.
+type ActionPlugin interface {
+	caddy.Module
+	// NewAction creates an instance of the action for a rule.
+	NewAction() plugintypes.Action
+}
+
+// TransformationPlugin is implemented by modules in the
+// http.handlers.waf.transformations namespace. For example, the module
+// http.handlers.waf.transformations.rot13 is used in rules as t:rot13.
+type TransformationPlugin interface {
+	caddy.Module
+	// Transform transforms input, reporting whether it changed.
+	Transform(input string) (output string, changed bool, err error)
+}
+
+var (
+	pluginsMu sync.Mutex
+	// registeredPlugins are the IDs of the plugin modules registered into
+	// Coraza so far. Coraza keeps plugins in process-global registries
+	// that are not safe for concurrent use, so every plugin is registered
+	// only once.
+	registeredPlugins = map[caddy.ModuleID]struct{}{}
+)
+
+// registerPlugins registers the operators, actions and transformations
+// provided by Caddy modules into Coraza. Plugins are instantiated once per
+// process, without configuration.
+func registerPlugins() error {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	var errs []error
+	for _, namespace := range []string{operatorsNamespace, actionsNamespace, transformationsNamespace} {
+		for _, info := range caddy.GetModules(namespace) {
+			if _, ok := registeredPlugins[info.ID]; ok {
+				continue
+			}
+			if err := registerPlugin(info); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			registeredPlugins[info.ID] = struct{}{}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// registerPlugin registers the plugin provided by a single module.
+func registerPlugin(info caddy.ModuleInfo) error {
+	name := info.ID.Name()
+	mod := info.New()
+	switch info.ID.Namespace() {
+	case operatorsNamespace:
+		op, ok := mod.(OperatorPlugin)
+		if !ok {
+			return fmt.Errorf("module %s is not a WAF operator", info.ID)
+		}
+		plugins.RegisterOperator(name, op.NewOperator)
+	case actionsNamespace:
+		action, ok := mod.(ActionPlugin)
+		if !ok {
+			return fmt.Errorf("module %s is not a WAF action", info.ID)
+		}
+		plugins.RegisterAction(name, action.NewAction)
+	case transformationsNamespace:
+		t, ok := mod.(TransformationPlugin)
+		if !ok {
+			return fmt.Errorf("module %s is not a WAF transformation", info.ID)
+		}
+		plugins.RegisterTransformation(name, t.Transform)
+	}
+	return nil
+}
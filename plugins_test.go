@@ -0,0 +1,142 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(testPrefixOperator{})
+	caddy.RegisterModule(testCountAction{})
+	caddy.RegisterModule(testReverseTransformation{})
+}
+
+// testPrefixOperator matches inputs starting with its argument.
+type testPrefixOperator struct{}
+
+func (testPrefixOperator) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.waf.operators.testPrefix",
+		New: func() caddy.Module { return new(testPrefixOperator) },
+	}
+}
+
+func (testPrefixOperator) NewOperator(options plugintypes.OperatorOptions) (plugintypes.Operator, error) {
+	return prefixOperator(options.Arguments), nil
+}
+
+type prefixOperator string
+
+func (p prefixOperator) Evaluate(_ plugintypes.TransactionState, input string) bool {
+	return strings.HasPrefix(input, string(p))
+}
+
+// testCountAction counts how many times rules using it matched.
+type testCountAction struct{}
+
+var testCountActionHits atomic.Int32
+
+func (testCountAction) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.waf.actions.testCount",
+		New: func() caddy.Module { return new(testCountAction) },
+	}
+}
+
+func (testCountAction) NewAction() plugintypes.Action { return countAction{} }
+
+type countAction struct{}
+
+func (countAction) Init(plugintypes.RuleMetadata, string) error { return nil }
+func (countAction) Evaluate(plugintypes.RuleMetadata, plugintypes.TransactionState) {
+	testCountActionHits.Add(1)
+}
+func (countAction) Type() plugintypes.ActionType { return plugintypes.ActionTypeNondisruptive }
+
+// testReverseTransformation reverses its input.
+type testReverseTransformation struct{}
+
+func (testReverseTransformation) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.waf.transformations.testReverse",
+		New: func() caddy.Module { return new(testReverseTransformation) },
+	}
+}
+
+func (testReverseTransformation) Transform(input string) (string, bool, error) {
+	r := []rune(input)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	out := string(r)
+	return out, out != input, nil
+}
+
+func TestPluginModules(t *testing.T) {
+	m := &corazaModule{
+		Directives: `SecRuleEngine On
+SecRule ARGS:a "@testPrefix foo" "id:1,phase:1,t:testReverse,testCount,deny,status:403"`,
+		logger: zap.NewNop(),
+	}
+	waf, err := m.buildWAF()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = waf.(*compiledWAF).Close() })
+
+	tests := map[string]struct {
+		query   string
+		blocked bool
+	}{
+		"reversed prefix": {query: "a=xoof", blocked: true},
+		"prefix":          {query: "a=foox", blocked: false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			hits := testCountActionHits.Load()
+			tx := waf.NewTransaction()
+			defer tx.Close()
+
+			it, err := processRequest(tx, httptest.NewRequest("GET", "/?"+test.query, nil))
+			require.NoError(t, err)
+			if !test.blocked {
+				require.Nil(t, it)
+				require.Equal(t, hits, testCountActionHits.Load())
+				return
+			}
+			require.NotNil(t, it)
+			require.Equal(t, 1, it.RuleID)
+			require.Equal(t, hits+1, testCountActionHits.Load())
+		})
+	}
+}
+
+// notAPlugin lives in a plugin namespace without implementing the
+// matching interface.
+type notAPlugin struct{}
+
+func (notAPlugin) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.waf.operators.notAPlugin",
+		New: func() caddy.Module { return new(notAPlugin) },
+	}
+}
+
+func TestRegisterPluginRejectsInvalidModules(t *testing.T) {
+	// Not registered with caddy.RegisterModule, it would make every other
+	// WAF fail to build.
+	for _, ns := range []string{operatorsNamespace, actionsNamespace, transformationsNamespace} {
+		info := notAPlugin{}.CaddyModule()
+		info.ID = caddy.ModuleID(ns + ".notAPlugin")
+		require.ErrorContains(t, registerPlugin(info), "is not a WAF")
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+	"go.uber.org/zap"
+)
+
+// defaultWatchInterval is how often rule files are checked for changes when
+// no watch_interval is configured.
+const defaultWatchInterval = 2 * time.Second
+
+// wafGeneration is a WAF that gets closed once it is retired and the
+// transactions in flight created from it are done, as closing a WAF closes
+// the audit log writers these transactions still log through.
+type wafGeneration struct {
+	waf    coraza.WAF
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	inflight int
+	retired  bool
+}
+
+func newWAFGeneration(waf coraza.WAF, logger *zap.Logger) *wafGeneration {
+	return &wafGeneration{waf: waf, logger: logger}
+}
+
+// acquire holds the WAF for a transaction until release is called. It
+// fails once the WAF is retired, callers load the WAF that replaced it
+// then.
+func (g *wafGeneration) acquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired {
+		return false
+	}
+	g.inflight++
+	return true
+}
+
+// release lets go of a WAF held by acquire.
+func (g *wafGeneration) release() {
+	g.mu.Lock()
+	g.inflight--
+	idle := g.retired && g.inflight == 0
+	g.mu.Unlock()
+	if idle {
+		g.close()
+	}
+}
+
+// retire closes the WAF right away if no transaction holds it, after the
+// last one is released otherwise. It returns the error closing the WAF
+// right away.
+func (g *wafGeneration) retire() error {
+	g.mu.Lock()
+	g.retired = true
+	idle := g.inflight == 0
+	g.mu.Unlock()
+	if !idle {
+		return nil
+	}
+	if c, ok := g.waf.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (g *wafGeneration) close() {
+	if c, ok := g.waf.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			g.logger.Warn("Failed to close a retired WAF", zap.Error(err))
+		}
+	}
+}
+
+// acquirer is implemented by WAFs that must be held by the transactions
+// created from them, see wafGeneration.
+type acquirer interface {
+	acquire() (waf coraza.WAF, release func())
+}
+
+// acquireWAF returns the WAF to create a transaction from, and the function
+// to call once the transaction is done.
+func acquireWAF(waf coraza.WAF) (coraza.WAF, func()) {
+	if a, ok := waf.(acquirer); ok {
+		return a.acquire()
+	}
+	return waf, func() {}
+}
+
+// reloadableWAF is a coraza.WAF that rebuilds itself in the background when
+// any of the rule files referenced by the directives changes. New
+// transactions are always created from the last WAF that compiled
+// successfully, transactions in flight keep using the WAF they started with,
+// which is closed once they are done when they acquired it.
+type reloadableWAF struct {
+	current atomic.Pointer[wafGeneration]
+
+	build    func() (coraza.WAF, error)
+	digest   func() []byte
+	interval time.Duration
+	logger   *zap.Logger
+	// onReload, if set, is called after each successful reload.
+	onReload func()
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// newReloadableWAF starts watching the files referenced by source every
+// interval, waf being the instance built from their current contents.
+// onReload may be nil.
+func newReloadableWAF(waf coraza.WAF, source wafSource, interval time.Duration, onReload func()) *reloadableWAF {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+
+	r := &reloadableWAF{
+		build:    source.build,
+		digest:   source.includesDigest,
+		interval: interval,
+		logger:   source.logger,
+		onReload: onReload,
+		done:     make(chan struct{}),
+	}
+	r.current.Store(newWAFGeneration(waf, source.logger))
+
+	r.wg.Add(1)
+	go r.watch(r.digest())
+	return r
+}
+
+func (r *reloadableWAF) watch(lastDigest []byte) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		digest := r.digest()
+		if bytes.Equal(digest, lastDigest) {
+			continue
+		}
+		// Whatever the outcome, we don't retry until the files change again.
+		lastDigest = digest
+
+		if err := r.reload(); err != nil {
+			r.logger.Error("Failed to reload WAF rules, keeping the previous ones", zap.Error(err))
+			continue
+		}
+		r.logger.Info("WAF rules reloaded after a rule file change")
+		if r.onReload != nil {
+			r.onReload()
+		}
+	}
+}
+
+// reload builds a new WAF and swaps it in for new transactions.
+func (r *reloadableWAF) reload() error {
+	waf, err := r.build()
+	if err != nil {
+		return err
+	}
+
+	old := r.current.Swap(newWAFGeneration(waf, r.logger))
+	if err := old.retire(); err != nil {
+		r.logger.Warn("Failed to close the previous WAF", zap.Error(err))
+	}
+	return nil
+}
+
+// load returns the WAF new transactions are created from.
+func (r *reloadableWAF) load() coraza.WAF {
+	return r.current.Load().waf
+}
+
+// acquire implements acquirer, the WAF it returns is not closed by a
+// reload until release is called.
+func (r *reloadableWAF) acquire() (coraza.WAF, func()) {
+	for {
+		g := r.current.Load()
+		if g.acquire() {
+			return g.waf, g.release
+		}
+	}
+}
+
+// NewTransaction implements coraza.WAF.
+func (r *reloadableWAF) NewTransaction() types.Transaction {
+	return r.load().NewTransaction()
+}
+
+// NewTransactionWithID implements coraza.WAF.
+func (r *reloadableWAF) NewTransactionWithID(id string) types.Transaction {
+	return r.load().NewTransactionWithID(id)
+}
+
+// Close stops watching the rule files and closes the current WAF, once
+// the transactions holding it are done.
+func (r *reloadableWAF) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+
+		err = r.current.Load().retire()
+	})
+	return err
+}
+
+var (
+	_ acquirer   = (*reloadableWAF)(nil)
+	_ coraza.WAF = (*reloadableWAF)(nil)
+	_ io.Closer  = (*reloadableWAF)(nil)
+)
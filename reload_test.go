@@ -0,0 +1,133 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/corazawaf/coraza/v3"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func isURIDenied(waf coraza.WAF, uri string) bool {
+	tx := waf.NewTransaction()
+	defer tx.Close()
+	tx.ProcessURI(uri, "GET", "HTTP/1.1")
+	return tx.ProcessRequestHeaders() != nil
+}
+
+func TestReloadableWAF(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "rules.conf")
+	writeRule := func(rule string) {
+		t.Helper()
+		// Renamed into place so that the watcher never reads a partial file.
+		tmp := ruleFile + ".tmp"
+		require.NoError(t, os.WriteFile(tmp, []byte(rule), 0644))
+		require.NoError(t, os.Rename(tmp, ruleFile))
+	}
+	writeRule(`SecRule REQUEST_URI "/a" "id:1,phase:1,deny"`)
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	m := &corazaModule{
+		Directives:    "SecRuleEngine On\nInclude " + ruleFile,
+		Watch:         true,
+		WatchInterval: caddy.Duration(10 * time.Millisecond),
+		logger:        zap.New(core),
+	}
+	waf, err := m.buildWAF()
+	require.NoError(t, err)
+
+	r := newReloadableWAF(waf, m.wafSource(), time.Duration(m.WatchInterval), nil)
+	t.Cleanup(func() { require.NoError(t, r.Close()) })
+
+	require.True(t, isURIDenied(r, "/a"))
+	require.False(t, isURIDenied(r, "/b"))
+
+	writeRule(`SecRule REQUEST_URI "/b" "id:1,phase:1,deny"`)
+	require.Eventually(t, func() bool {
+		return isURIDenied(r, "/b")
+	}, 5*time.Second, 10*time.Millisecond, "WAF should pick up the edited rule file")
+	require.False(t, isURIDenied(r, "/a"))
+
+	writeRule(`SecRule REQUEST_URI "/c" "id:1,phase:1,unknownaction"`)
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("Failed to reload WAF rules, keeping the previous ones").Len() == 1
+	}, 5*time.Second, 10*time.Millisecond, "broken rules should be reported")
+	require.True(t, isURIDenied(r, "/b"), "previous WAF should stay in service")
+}
+
+func TestReloadableWAFClose(t *testing.T) {
+	m := &corazaModule{
+		Directives: "SecRuleEngine On",
+		Watch:      true,
+		logger:     zap.NewNop(),
+	}
+	waf, err := m.buildWAF()
+	require.NoError(t, err)
+
+	r := newReloadableWAF(waf, m.wafSource(), 0, nil)
+	require.NoError(t, r.Close())
+	require.NoError(t, r.Close(), "closing twice should be a no-op")
+}
+
+func TestProvisionWatch(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{Directives: "SecRuleEngine On", Watch: true}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { require.NoError(t, m.Cleanup()) })
+
+	require.IsType(t, &reloadableWAF{}, m.waf)
+	require.NotEqual(t, (&corazaModule{Directives: "SecRuleEngine On"}).computePoolKey(), m.poolKey,
+		"watching modules must not share a WAF with non watching ones")
+}
+
+func TestReloadWaitsForTransactions(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "rules.conf")
+	require.NoError(t, os.WriteFile(ruleFile, []byte(`SecRule REQUEST_URI "/a" "id:1,phase:1,deny"`), 0644))
+	m := &corazaModule{Directives: "SecRuleEngine On\nInclude " + ruleFile, logger: zap.NewNop()}
+	waf, err := m.buildWAF()
+	require.NoError(t, err)
+	first := &closerWAF{WAF: waf}
+
+	r := newReloadableWAF(first, m.wafSource(), time.Hour, nil)
+	t.Cleanup(func() { require.NoError(t, r.Close()) })
+
+	held, release := acquireWAF(r)
+	require.Same(t, first, held)
+	require.NoError(t, r.reload())
+	require.False(t, first.closed, "the previous WAF should stay open while a transaction holds it")
+	next, releaseNext := acquireWAF(r)
+	require.NotSame(t, first, next)
+	releaseNext()
+
+	release()
+	require.True(t, first.closed)
+}
+
+func TestIncludesDigestSkipsEmbeddedFiles(t *testing.T) {
+	m := &corazaModule{LoadOWASPCRS: true, Directives: "Include @owasp_crs/*.conf"}
+	var read []string
+	w := &directiveWalker{
+		root:         ruleFS(true),
+		skipEmbedded: true,
+		onFile: func(f includedFile) {
+			if f.data != nil {
+				read = append(read, f.path)
+			}
+		},
+	}
+	require.NoError(t, w.walkString(m.Directives))
+	require.Empty(t, read)
+	require.NotEqual(t, (&corazaModule{LoadOWASPCRS: true}).includesDigest(), m.includesDigest())
+}
@@ -0,0 +1,264 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/templates"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+// blockResponse is the response the handler writes itself when a request
+// is denied, instead of returning an error to Caddy's handle_errors routes.
+type blockResponse struct {
+	// Status overrides the status code of the deny action.
+	Status int `json:"status,omitempty"`
+	// ContentType is the Content-Type of the response.
+	ContentType string `json:"content_type,omitempty"`
+	// Body is the body of the response.
+	Body string `json:"body,omitempty"`
+	// BodyFile is a file the body of the response is read from when the
+	// module is provisioned.
+	BodyFile string `json:"body_file,omitempty"`
+	// Headers are added to the response. Their values may contain
+	// placeholders.
+	Headers http.Header `json:"headers,omitempty"`
+	// Templates renders the body as a Caddy template, placeholders are then
+	// available through the placeholder function. Otherwise placeholders
+	// are replaced in the body, except for {file.*}.
+	Templates bool `json:"templates,omitempty"`
+
+	body string
+	root http.FileSystem
+}
+
+// provision loads the body of the response and checks its template.
+func (b *blockResponse) provision() error {
+	if b.Body != "" && b.BodyFile != "" {
+		return fmt.Errorf("body and body_file are mutually exclusive")
+	}
+	if b.Status != 0 && (b.Status < 100 || b.Status > 999) {
+		return fmt.Errorf("invalid status code %d", b.Status)
+	}
+
+	b.body = b.Body
+	b.root = http.Dir(".")
+	if b.BodyFile != "" {
+		content, err := os.ReadFile(b.BodyFile)
+		if err != nil {
+			return fmt.Errorf("reading body_file: %v", err)
+		}
+		b.body = string(content)
+		// Templates include files relative to the body file.
+		b.root = http.Dir(filepath.Dir(b.BodyFile))
+	}
+
+	if b.Templates {
+		tplCtx := &templates.TemplateContext{Root: b.root}
+		if _, err := tplCtx.NewTemplate("block_response").Parse(b.body); err != nil {
+			return fmt.Errorf("parsing body template: %v", err)
+		}
+	}
+	return nil
+}
+
+// write writes the response to a request denied with the given status.
+func (b *blockResponse) write(w http.ResponseWriter, r *http.Request, status int) error {
+	if b.Status != 0 {
+		status = b.Status
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	h := w.Header()
+	for name, values := range b.Headers {
+		h.Del(name)
+		for _, v := range values {
+			h.Add(name, expandPlaceholders(v, repl))
+		}
+	}
+	if b.ContentType != "" {
+		h.Set("Content-Type", b.ContentType)
+	}
+
+	body := []byte(expandPlaceholders(b.body, repl.WithoutFile()))
+	if b.Templates {
+		buf, err := b.render(w, r)
+		if err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	h.Del("Content-Encoding")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	_, err := w.Write(body)
+	return err
+}
+
+// render executes the body template. The result is not scanned for
+// placeholders, so values from the request cannot inject any.
+func (b *blockResponse) render(w http.ResponseWriter, r *http.Request) (*bytes.Buffer, error) {
+	tplCtx := &templates.TemplateContext{
+		Root:       b.root,
+		Req:        r,
+		RespHeader: templates.WrappedHeader{Header: w.Header()},
+	}
+	tpl, err := tplCtx.NewTemplate("block_response").Parse(b.body)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := tpl.Execute(buf, tplCtx); err != nil {
+		return nil, fmt.Errorf("rendering the block response: %v", err)
+	}
+	return buf, nil
+}
+
+// interruptRequest responds to an interruption of the request phases of
+// tx. The interruptions respondInterruption does not handle are left to
+// the error handling of Caddy, with the status of the interruption.
+func (m *corazaModule) interruptRequest(w http.ResponseWriter, r *http.Request, tx types.Transaction, it *types.Interruption) error {
+	status := obtainStatusCodeFromInterruptionOrDefault(it, http.StatusOK)
+	if handled, err := m.respondInterruption(w, r, it, status); handled {
+		return err
+	}
+	return caddyhttp.HandlerError{
+		StatusCode: status,
+		ID:         tx.ID(),
+		Err:        errInterruptionTriggered,
+	}
+}
+
+// interceptorOptions returns the options of the response interceptor of
+// r, which respond to interruptions of the response phases the way
+// interruptRequest does.
+func (m *corazaModule) interceptorOptions(r *http.Request) interceptorOptions {
+	opts := interceptorOptions{
+		respond: func(w http.ResponseWriter, it *types.Interruption, status int) (bool, error) {
+			return m.respondInterruption(w, r, it, status)
+		},
+	}
+	if m.TransactionIDResponseHeader != "" {
+		opts.keepHeaders = []string{m.TransactionIDResponseHeader}
+	}
+	return opts
+}
+
+// respondInterruption writes the response of an interruption of the
+// transaction of r: redirections, dropped connections, and denials when a
+// block response is configured.
+func (m *corazaModule) respondInterruption(w http.ResponseWriter, r *http.Request, it *types.Interruption, status int) (bool, error) {
+	switch it.Action {
+	case "drop":
+		dropConnection(w, r)
+		return true, nil
+	case "deny":
+		if m.BlockResponse != nil {
+			return true, m.BlockResponse.write(w, r, status)
+		}
+	case "redirect":
+		writeRedirect(w, it.Data, status)
+		return true, nil
+	}
+	return false, nil
+}
+
+// dropConnection closes the client connection without a response. HTTP/1
+// connections are hijacked and closed. HTTP/2 and HTTP/3 streams are reset
+// by aborting the handler, like Caddy's abort directive does, which is also
+// the fallback when the connection cannot be hijacked.
+func dropConnection(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor == 1 {
+		if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			_ = conn.Close()
+			return
+		}
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// writeRedirect sends the client to location, without a body.
+func writeRedirect(w http.ResponseWriter, location string, status int) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Encoding")
+	h.Set("Content-Length", "0")
+	h.Set("Location", location)
+	w.WriteHeader(status)
+}
+
+// unmarshalBlockResponse parses a block_response subdirective. Syntax:
+//
+//	block_response {
+//	    status       <code>
+//	    content_type <type>
+//	    body         <text>
+//	    body_file    <path>
+//	    header       <name> <value>
+//	    templates
+//	}
+func unmarshalBlockResponse(d *caddyfile.Dispenser) (*blockResponse, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	b := new(blockResponse)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "status":
+			var code string
+			if !d.Args(&code) {
+				return nil, d.ArgErr()
+			}
+			status, err := strconv.Atoi(code)
+			if err != nil || status < 100 || status > 999 {
+				return nil, d.Errf("invalid status code %q", code)
+			}
+			b.Status = status
+		case "content_type":
+			if !d.Args(&b.ContentType) {
+				return nil, d.ArgErr()
+			}
+		case "body":
+			if !d.Args(&b.Body) {
+				return nil, d.ArgErr()
+			}
+		case "body_file":
+			if !d.Args(&b.BodyFile) {
+				return nil, d.ArgErr()
+			}
+		case "header":
+			var name, value string
+			if !d.Args(&name, &value) {
+				return nil, d.ArgErr()
+			}
+			if b.Headers == nil {
+				b.Headers = make(http.Header)
+			}
+			b.Headers.Add(name, value)
+		case "templates":
+			b.Templates = true
+		default:
+			return nil, d.Errf("invalid block_response key %q", d.Val())
+		}
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+
+	if b.Body != "" && b.BodyFile != "" {
+		return nil, d.Err("body and body_file are mutually exclusive")
+	}
+	return b, nil
+}
@@ -0,0 +1,426 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+)
+
+const blockResponseDirectives = `SecRuleEngine On
+SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain
+SecRule REQUEST_URI "@contains attack" "id:10,phase:1,deny,status:403,msg:'Attack'"
+SecRule RESPONSE_HEADERS:X-Leak "@streq headers" "id:20,phase:3,deny,status:403,msg:'Leak'"
+SecRule RESPONSE_BODY "@contains secret" "id:30,phase:4,deny,status:403,msg:'Leak'"`
+
+func TestBlockResponse(t *testing.T) {
+	t.Setenv("WAF_SECRET", "s3cr3t")
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "403.html"),
+		[]byte(`<p>Rule {{placeholder "http.waf.rule_id"}} blocked {{.OriginalReq.URL.Path}}</p>{{include "footer.html"}}`), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "footer.html"), []byte(`<footer>WAF</footer>`), 0600))
+
+	tests := map[string]struct {
+		response   *blockResponse
+		target     string
+		header     string
+		body       string
+		wantStatus int
+		wantBody   string
+		wantHeader map[string]string
+	}{
+		"json in request phase": {
+			response: &blockResponse{
+				ContentType: "application/json",
+				Body:        `{"error": "blocked", "rule": {http.waf.rule_id}, "reference": "{http.transaction_id}"}`,
+				Headers:     http.Header{"X-Blocked": {"{http.waf.action}"}},
+			},
+			target:     "/attack",
+			wantStatus: http.StatusForbidden,
+			wantBody:   `{"error": "blocked", "rule": 10, "reference": "lb-1"}`,
+			wantHeader: map[string]string{
+				"Content-Type":   "application/json",
+				"X-Blocked":      "deny",
+				"X-Request-Id":   "lb-1",
+				"Content-Length": "53",
+			},
+		},
+		"status override": {
+			response:   &blockResponse{Status: http.StatusNotFound, Body: "not found"},
+			target:     "/attack",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "not found",
+		},
+		"template in response headers phase": {
+			response: &blockResponse{
+				ContentType: "text/html",
+				BodyFile:    filepath.Join(dir, "403.html"),
+				Templates:   true,
+			},
+			target:     "/page",
+			header:     "headers",
+			body:       "hello",
+			wantStatus: http.StatusForbidden,
+			wantBody:   `<p>Rule 20 blocked /page</p><footer>WAF</footer>`,
+			wantHeader: map[string]string{
+				"Content-Type": "text/html",
+				"X-Upstream":   "",
+				"X-Request-Id": "lb-1",
+			},
+		},
+		"template in response body phase": {
+			response: &blockResponse{
+				BodyFile:  filepath.Join(dir, "403.html"),
+				Templates: true,
+			},
+			target:     "/page",
+			body:       "top secret",
+			wantStatus: http.StatusForbidden,
+			wantBody:   `<p>Rule 30 blocked /page</p><footer>WAF</footer>`,
+			wantHeader: map[string]string{
+				"X-Upstream": "",
+			},
+		},
+		"template output is not expanded": {
+			response: &blockResponse{
+				BodyFile:  filepath.Join(dir, "403.html"),
+				Templates: true,
+			},
+			target:     "/attack/%7Benv.WAF_SECRET%7D",
+			wantStatus: http.StatusForbidden,
+			wantBody:   `<p>Rule 10 blocked /attack/{env.WAF_SECRET}</p><footer>WAF</footer>`,
+		},
+		"no file placeholders in body": {
+			response:   &blockResponse{Body: "{file." + filepath.Join(dir, "footer.html") + "} {env.WAF_SECRET}"},
+			target:     "/attack",
+			wantStatus: http.StatusForbidden,
+			wantBody:   "{file." + filepath.Join(dir, "footer.html") + "} s3cr3t",
+		},
+		"allowed": {
+			response:   &blockResponse{Body: "blocked"},
+			target:     "/page",
+			body:       "hello",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			t.Cleanup(cancel)
+
+			m := &corazaModule{
+				Directives:                  blockResponseDirectives,
+				BlockResponse:               test.response,
+				TransactionID:               txIDHeader,
+				TransactionIDHeader:         "X-Request-Id",
+				TransactionIDResponseHeader: "X-Request-Id",
+			}
+			require.NoError(t, m.Provision(ctx))
+			t.Cleanup(func() { _ = m.Cleanup() })
+
+			req := newServeHTTPRequest(http.MethodGet, test.target, nil)
+			req.Header.Set("X-Request-Id", "lb-1")
+			rec := httptest.NewRecorder()
+			err := m.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("X-Upstream", "app")
+				w.Header().Set("X-Leak", test.header)
+				_, err := w.Write([]byte(test.body))
+				return err
+			}))
+			require.NoError(t, err, "the handler writes the response itself")
+
+			require.Equal(t, test.wantStatus, rec.Code)
+			require.Equal(t, test.wantBody, rec.Body.String())
+			for name, want := range test.wantHeader {
+				require.Equal(t, want, rec.Header().Get(name), name)
+			}
+		})
+	}
+}
+
+func TestBlockResponseLeavesOtherErrorsToCaddy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{Directives: blockResponseDirectives}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	err := m.ServeHTTP(httptest.NewRecorder(), newServeHTTPRequest(http.MethodGet, "/attack", nil), caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	var herr caddyhttp.HandlerError
+	require.ErrorAs(t, err, &herr)
+	require.ErrorIs(t, err, errInterruptionTriggered)
+	require.Equal(t, http.StatusForbidden, herr.StatusCode)
+}
+
+func TestBlockResponseProvision(t *testing.T) {
+	tests := map[string]struct {
+		response *blockResponse
+		errMsg   string
+	}{
+		"body and body_file": {
+			response: &blockResponse{Body: "blocked", BodyFile: "403.html"},
+			errMsg:   "mutually exclusive",
+		},
+		"missing body_file": {
+			response: &blockResponse{BodyFile: filepath.Join(t.TempDir(), "missing.html")},
+			errMsg:   "reading body_file",
+		},
+		"invalid template": {
+			response: &blockResponse{Body: "{{ .Unclosed", Templates: true},
+			errMsg:   "parsing body template",
+		},
+		"invalid status": {
+			response: &blockResponse{Status: 42},
+			errMsg:   "invalid status code",
+		},
+		"braces without templates": {
+			response: &blockResponse{Body: "{{ .Unclosed"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.response.provision()
+			if test.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, test.errMsg)
+		})
+	}
+}
+
+func TestUnmarshalBlockResponse(t *testing.T) {
+	tests := map[string]struct {
+		config string
+		want   *blockResponse
+		errMsg string
+	}{
+		"full": {
+			config: `coraza_waf {
+				block_response {
+					status 429
+					content_type text/html
+					body_file /etc/waf/403.html
+					header X-Blocked true
+					header X-Rule {http.waf.rule_id}
+					templates
+				}
+			}`,
+			want: &blockResponse{
+				Status:      429,
+				ContentType: "text/html",
+				BodyFile:    "/etc/waf/403.html",
+				Headers:     http.Header{"X-Blocked": {"true"}, "X-Rule": {"{http.waf.rule_id}"}},
+				Templates:   true,
+			},
+		},
+		"inline body": {
+			config: `coraza_waf {
+				block_response {
+					content_type application/json
+					body ` + "`" + `{"error": "blocked"}` + "`" + `
+				}
+			}`,
+			want: &blockResponse{ContentType: "application/json", Body: `{"error": "blocked"}`},
+		},
+		"argument": {
+			config: `coraza_waf {
+				block_response html
+			}`,
+			errMsg: "wrong argument count",
+		},
+		"invalid status": {
+			config: `coraza_waf {
+				block_response {
+					status forbidden
+				}
+			}`,
+			errMsg: "invalid status code",
+		},
+		"header without value": {
+			config: `coraza_waf {
+				block_response {
+					header X-Blocked
+				}
+			}`,
+			errMsg: "wrong argument count",
+		},
+		"templates with argument": {
+			config: `coraza_waf {
+				block_response {
+					templates on
+				}
+			}`,
+			errMsg: "wrong argument count",
+		},
+		"body and body_file": {
+			config: `coraza_waf {
+				block_response {
+					body blocked
+					body_file /etc/waf/403.html
+				}
+			}`,
+			errMsg: "mutually exclusive",
+		},
+		"unknown key": {
+			config: `coraza_waf {
+				block_response {
+					redirect /blocked
+				}
+			}`,
+			errMsg: "invalid block_response key",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &corazaModule{}
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.config))
+			if test.errMsg != "" {
+				require.ErrorContains(t, err, test.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, m.BlockResponse)
+		})
+	}
+}
+
+func TestRedirectInterruption(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{
+		Directives: `SecRuleEngine On
+SecRequestBodyAccess On
+SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain
+SecRule REQUEST_URI "@beginsWith /headers" "id:10,phase:1,redirect:https://example.com/verify"
+SecRule ARGS_POST:q "@streq bot" "id:20,phase:2,redirect:https://example.com/verify,status:303"
+SecRule RESPONSE_HEADERS:X-Leak "@streq headers" "id:30,phase:3,redirect:https://example.com/verify,status:307"
+SecRule RESPONSE_BODY "@contains secret" "id:40,phase:4,redirect:https://example.com/verify,status:301"`,
+		BlockResponse: &blockResponse{Body: "blocked"},
+	}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	tests := map[string]struct {
+		method     string
+		target     string
+		reqBody    string
+		leak       string
+		body       string
+		wantStatus int
+	}{
+		"request headers": {target: "/headers", wantStatus: http.StatusFound},
+		"request body": {
+			method:     http.MethodPost,
+			target:     "/form",
+			reqBody:    "q=bot",
+			wantStatus: http.StatusSeeOther,
+		},
+		"response headers": {target: "/", leak: "headers", body: "hello", wantStatus: http.StatusTemporaryRedirect},
+		"response body":    {target: "/", body: "top secret", wantStatus: http.StatusMovedPermanently},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := newServeHTTPRequest(method, test.target, strings.NewReader(test.reqBody))
+			if test.reqBody != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			rec := httptest.NewRecorder()
+			err := m.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("X-Leak", test.leak)
+				_, err := w.Write([]byte(test.body))
+				return err
+			}))
+			require.NoError(t, err)
+
+			require.Equal(t, test.wantStatus, rec.Code)
+			require.Equal(t, "https://example.com/verify", rec.Header().Get("Location"))
+			require.Empty(t, rec.Body.String())
+			require.Empty(t, rec.Header().Get("Content-Type"))
+			require.Empty(t, rec.Header().Get("X-Leak"))
+
+			repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			action, _ := repl.GetString("http.waf.action")
+			require.Equal(t, "redirect", action)
+		})
+	}
+}
+
+func TestDropInterruption(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{
+		Directives: `SecRuleEngine On
+SecRule REQUEST_URI "@beginsWith /scanner" "id:10,phase:1,drop"
+SecRule RESPONSE_HEADERS:X-Leak "@streq yes" "id:20,phase:3,drop"`,
+		BlockResponse: &blockResponse{Body: "blocked"},
+	}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = m.ServeHTTP(w, withServerContext(r), caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("X-Leak", r.URL.Query().Get("leak"))
+			_, err := w.Write([]byte("hello"))
+			return err
+		}))
+	})
+
+	servers := map[string]*httptest.Server{
+		"HTTP/1.1": httptest.NewUnstartedServer(handler),
+		"HTTP/2.0": httptest.NewUnstartedServer(handler),
+	}
+	servers["HTTP/1.1"].Start()
+	servers["HTTP/2.0"].EnableHTTP2 = true
+	servers["HTTP/2.0"].StartTLS()
+
+	for proto, srv := range servers {
+		t.Cleanup(srv.Close)
+		client := srv.Client()
+
+		for _, path := range []string{"/scanner", "/page?leak=yes"} {
+			t.Run(proto+" "+path, func(t *testing.T) {
+				resp, err := client.Get(srv.URL + path)
+				if err == nil {
+					resp.Body.Close()
+				}
+				require.Error(t, err, "the connection must be closed without a response")
+
+				resp, err = client.Get(srv.URL + "/page")
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.Equal(t, proto, resp.Proto)
+			})
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+// phaseNames maps rule phases to the names used when reporting them.
+var phaseNames = map[types.RulePhase]string{
+	types.PhaseRequestHeaders:  "request_headers",
+	types.PhaseRequestBody:     "request_body",
+	types.PhaseResponseHeaders: "response_headers",
+	types.PhaseResponseBody:    "response_body",
+	types.PhaseLogging:         "logging",
+}
+
+// phaseName returns the name of the given phase.
+func phaseName(phase types.RulePhase) string {
+	if name, ok := phaseNames[phase]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// compiledWAF is a coraza.WAF along with the metadata of the rules it was
+// compiled with, which Coraza does not expose.
+//
+// Rules removed by SecRuleRemoveById and friends after being defined are
+// still part of the metadata.
+type compiledWAF struct {
+	coraza.WAF
+	rules []types.RuleMetadata
+	// builtAt is when the compilation started, it took buildDuration.
+	builtAt       time.Time
+	buildDuration time.Duration
+
+	tagsOnce sync.Once
+	tags     map[string][]int
+
+	// logsInterruptions is set when the WAF counts in
+	// interruptionFormatWAFs, until it is closed.
+	logsInterruptions bool
+	closed            atomic.Bool
+}
+
+// ruleIDsWithTag returns the IDs of the rules tagged with tag. The index is
+// built on first use.
+func (w *compiledWAF) ruleIDsWithTag(tag string) []int {
+	w.tagsOnce.Do(func() {
+		w.tags = map[string][]int{}
+		for _, r := range withoutMarkers(w.rules) {
+			for _, t := range r.Tags() {
+				w.tags[t] = append(w.tags[t], r.ID())
+			}
+		}
+	})
+	return w.tags[tag]
+}
+
+// Close implements io.Closer.
+func (w *compiledWAF) Close() error {
+	if w.logsInterruptions && !w.closed.Swap(true) {
+		interruptionFormatWAFs.Add(-1)
+	}
+	if c, ok := w.WAF.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// wafRules returns the metadata of the rules the given WAF was compiled
+// with, or nil if they are unknown.
+func wafRules(waf coraza.WAF) []types.RuleMetadata {
+	if w := compiled(waf); w != nil {
+		return w.rules
+	}
+	return nil
+}
+
+// withoutMarkers returns rules without the SecMarker entries, which Coraza
+// keeps among the rules with ID 0.
+func withoutMarkers(rules []types.RuleMetadata) []types.RuleMetadata {
+	actual := make([]types.RuleMetadata, 0, len(rules))
+	for _, r := range rules {
+		if r.ID() != 0 {
+			actual = append(actual, r)
+		}
+	}
+	return actual
+}
+
+// compiled returns the compiledWAF currently behind waf, or nil if there is
+// none.
+func compiled(waf coraza.WAF) *compiledWAF {
+	switch w := waf.(type) {
+	case *compiledWAF:
+		return w
+	case *reloadableWAF:
+		return compiled(w.load())
+	}
+	return nil
+}
+
+var _ io.Closer = (*compiledWAF)(nil)
@@ -0,0 +1,68 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+)
+
+const (
+	// sampleByRequest samples requests on their own, keyed by their
+	// method, host and URI.
+	sampleByRequest = "request"
+	// sampleByClientIP samples clients, either all or none of the requests
+	// of a client are inspected.
+	sampleByClientIP = "client_ip"
+)
+
+// validateSampling checks the sampling settings of the module.
+func (m *corazaModule) validateSampling() error {
+	if m.SampleRate < 0 || m.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1, got %v", m.SampleRate)
+	}
+	switch m.SampleBy {
+	case "", sampleByRequest, sampleByClientIP:
+		return nil
+	default:
+		return fmt.Errorf("invalid sample_by %q, must be %q or %q", m.SampleBy, sampleByRequest, sampleByClientIP)
+	}
+}
+
+// sampled reports whether the rules should be evaluated for r, whose
+// transaction ID is id. The decision is a hash of the sampling key, so a
+// given client or request is always either in or out of the sample.
+func (m *corazaModule) sampled(r *http.Request, id string) bool {
+	if m.SampleRate == 0 || m.SampleRate >= 1 {
+		return true
+	}
+
+	var key string
+	switch {
+	case m.SampleBy == sampleByClientIP:
+		key, _ = getClientAddress(r)
+	case m.TransactionID == txIDHeader && id == r.Header.Get(m.TransactionIDHeader):
+		// The ID set by the proxy identifies the request across retries.
+		key = id
+	default:
+		key = r.Method + " " + r.Host + " " + r.RequestURI
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	// The 53 high bits make a uniformly distributed float in [0, 1).
+	return float64(mix64(h.Sum64())>>11)/(1<<53) < m.SampleRate
+}
+
+// mix64 is the finalizer of SplitMix64. FNV alone barely changes the high
+// bits between keys differing only in their last bytes, like IP addresses
+// of the same network.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,166 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampled(t *testing.T) {
+	tests := map[string]struct {
+		rate float64
+		by   string
+		// min and max bound the number of inspected requests out of 10000.
+		min, max int
+	}{
+		"unset":                {rate: 0, min: 10000, max: 10000},
+		"everything":           {rate: 1, min: 10000, max: 10000},
+		"per request":          {rate: 0.1, by: sampleByRequest, min: 800, max: 1200},
+		"per request default":  {rate: 0.5, min: 4700, max: 5300},
+		"per client IP":        {rate: 0.25, by: sampleByClientIP, min: 2200, max: 2800},
+		"per client IP sparse": {rate: 0.01, by: sampleByClientIP, min: 50, max: 150},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &corazaModule{SampleRate: test.rate, SampleBy: test.by}
+			var inspected int
+			for i := 0; i < 10000; i++ {
+				req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/?page=%d", i), nil)
+				req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)
+				if m.sampled(req, randomString(16)) {
+					inspected++
+				}
+			}
+			require.GreaterOrEqual(t, inspected, test.min)
+			require.LessOrEqual(t, inspected, test.max)
+		})
+	}
+}
+
+func TestSampledByClientIPIsDeterministic(t *testing.T) {
+	m := &corazaModule{SampleRate: 0.5, SampleBy: sampleByClientIP}
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+		want := m.sampled(req, randomString(16))
+		for j := 0; j < 10; j++ {
+			req.RemoteAddr = fmt.Sprintf("192.0.2.%d:%d", i, 2000+j)
+			require.Equal(t, want, m.sampled(req, randomString(16)), "client %s", req.RemoteAddr)
+		}
+	}
+}
+
+func TestSampledByRequestIsDeterministic(t *testing.T) {
+	t.Run("request attributes", func(t *testing.T) {
+		m := &corazaModule{SampleRate: 0.5}
+		decisions := map[bool]bool{}
+		for i := 0; i < 100; i++ {
+			target := fmt.Sprintf("/?page=%d", i)
+			want := m.sampled(httptest.NewRequest(http.MethodGet, target, nil), randomString(16))
+			decisions[want] = true
+			for j := 0; j < 10; j++ {
+				req := httptest.NewRequest(http.MethodGet, target, nil)
+				req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", j)
+				require.Equal(t, want, m.sampled(req, randomString(16)), "request %s", target)
+			}
+		}
+		require.Len(t, decisions, 2)
+	})
+
+	t.Run("header transaction ID", func(t *testing.T) {
+		m := &corazaModule{SampleRate: 0.5, TransactionID: txIDHeader, TransactionIDHeader: "X-Request-Id"}
+		decisions := map[bool]bool{}
+		for i := 0; i < 100; i++ {
+			id := fmt.Sprintf("req-%d", i)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Request-Id", id)
+			want := m.sampled(req, id)
+			decisions[want] = true
+			for j := 0; j < 10; j++ {
+				req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/retry/%d", j), nil)
+				req.Header.Set("X-Request-Id", id)
+				require.Equal(t, want, m.sampled(req, id), "request %s", id)
+			}
+		}
+		require.Len(t, decisions, 2)
+	})
+}
+
+func TestServeHTTPSkipsUnsampledRequests(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{
+		Directives: `SecRuleEngine On
+SecRule REQUEST_URI "@contains attack" "id:1,phase:1,deny,status:403"`,
+		SampleRate: 0.5,
+		SampleBy:   sampleByClientIP,
+	}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	// Find one client in the sample and one out of it.
+	var in, out string
+	for i := 0; in == "" || out == ""; i++ {
+		addr := fmt.Sprintf("198.51.100.%d:1234", i)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		if m.sampled(req, "") {
+			in = addr
+		} else {
+			out = addr
+		}
+	}
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	serve := func(addr string) (*http.Request, error) {
+		req := newServeHTTPRequest(http.MethodGet, "/?q=attack", nil)
+		req.RemoteAddr = addr
+		return req, m.ServeHTTP(httptest.NewRecorder(), req, next)
+	}
+
+	req, err := serve(out)
+	require.NoError(t, err, "requests out of the sample are not inspected")
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	id, ok := repl.GetString("http.transaction_id")
+	require.True(t, ok)
+	require.Len(t, id, 16)
+
+	_, err = serve(in)
+	var herr caddyhttp.HandlerError
+	require.ErrorAs(t, err, &herr)
+	require.Equal(t, http.StatusForbidden, herr.StatusCode)
+
+	require.Equal(t, uint64(2), m.stats.transactions.Load())
+	require.Equal(t, uint64(1), m.stats.skipped.Load())
+}
+
+func TestProvisionValidatesSampling(t *testing.T) {
+	tests := map[string]*corazaModule{
+		"negative rate":  {Directives: "SecRuleEngine On", SampleRate: -0.1},
+		"rate above 1":   {Directives: "SecRuleEngine On", SampleRate: 2},
+		"unknown key":    {Directives: "SecRuleEngine On", SampleRate: 0.5, SampleBy: "session"},
+		"sampled shadow": {Directives: "SecRuleEngine On", Shadow: &corazaModule{Directives: "SecRuleEngine On", SampleRate: 0.5}},
+	}
+
+	for name, m := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			require.Error(t, m.Provision(ctx))
+		})
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/corazawaf/coraza/v3/types"
+	"go.uber.org/zap"
+)
+
+// shadowTransaction evaluates a request with the shadow rule set, next to
+// the transaction of the enforcing WAF. Its interruptions are never acted
+// upon, they are only compared with the ones of the enforcing WAF.
+type shadowTransaction struct {
+	module *corazaModule
+	tx     types.Transaction
+	// release lets go of the WAF tx was created from.
+	release func()
+	// endCollections makes the persistent collections unavailable to tx,
+	// without storing its changes.
+	endCollections func()
+	// err is the first error the shadow transaction ran into, it is only
+	// ever logged.
+	err error
+}
+
+// shadowIDSuffix is appended to the ID of the enforcing transaction to make
+// the ID of the shadow one, so that audit logs tell them apart.
+const shadowIDSuffix = "-shadow"
+
+// newShadowTransaction starts a transaction of the shadow rule set for the
+// enforcing transaction id, and runs it over the request. It must be
+// called before the enforcing transaction reads the request body, both end
+// up reading the whole body. The shadow transaction loads the persistent
+// collections of the enforcing handler from collections but never stores
+// them, so that it does not count the requests twice.
+func (m *corazaModule) newShadowTransaction(id string, r *http.Request, collections CollectionStore) *shadowTransaction {
+	s := &shadowTransaction{module: m}
+	s.tx, s.release = m.overrides.newTransaction(m.waf, id+shadowIDSuffix, r)
+	s.endCollections = startReadOnlyCollections(r.Context(), s.tx, collections, m.logger)
+	m.logger.Debug("Shadow transaction started", zap.String("unique_id", id), zap.String("shadow_unique_id", s.tx.ID()))
+	if s.tx.IsRuleEngineOff() {
+		return s
+	}
+	if err := applyExclusions(m.Exclusions, m.waf, s.tx, r); err != nil {
+		s.err = err
+		return s
+	}
+	_, s.err = processRequest(s.tx, r)
+	return s
+}
+
+// active reports whether the shadow transaction still has phases to run.
+// Shadow rule sets are run in detection only mode unless they use a
+// profile, in which case a disruptive rule stops the transaction.
+func (s *shadowTransaction) active() bool {
+	return s.err == nil && !s.tx.IsRuleEngineOff() && !s.tx.IsInterrupted()
+}
+
+// wrap returns a response writer feeding the response to the shadow
+// transaction on its way to w.
+func (s *shadowTransaction) wrap(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	return preserveInterfaces(&shadowWriter{w: w, shadow: s, proto: r.Proto}, w)
+}
+
+// finish runs the remaining phases of the shadow transaction and logs
+// whether it disagrees with the enforcing one, tx.
+func (s *shadowTransaction) finish(tx types.Transaction, r *http.Request, logger *zap.Logger) {
+	defer func() {
+		processLogging(s.tx)
+		s.endCollections()
+		if err := s.tx.Close(); err != nil {
+			logger.Warn("Failed to close the shadow transaction", zap.String("unique_id", tx.ID()), zap.String("shadow_unique_id", s.tx.ID()), zap.Error(err))
+		}
+		s.release()
+	}()
+
+	if s.active() && s.tx.IsResponseBodyAccessible() && s.tx.IsResponseBodyProcessable() {
+		_, s.err = s.tx.ProcessResponseBody()
+	}
+	if s.err != nil {
+		logger.Warn("Shadow rule set failed to process the transaction", zap.String("unique_id", tx.ID()), zap.String("shadow_unique_id", s.tx.ID()), zap.Error(s.err))
+	}
+
+	primary, shadow := tx.Interruption(), interruptionOf(s.tx)
+	if (primary == nil) == (shadow == nil) {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("hostname", r.Host),
+		zap.String("uri", r.RequestURI),
+		zap.String("client_ip", r.RemoteAddr),
+		zap.String("unique_id", tx.ID()),
+		zap.String("shadow_unique_id", s.tx.ID()),
+	}
+	if shadow != nil {
+		logger.Warn("Shadow rule set would have blocked a request allowed by the WAF",
+			append(fields,
+				zap.Int("shadow_rule_id", shadow.RuleID),
+				zap.String("shadow_action", shadow.Action),
+				zap.Ints("shadow_matched_rules", matchedRuleIDs(s.tx)),
+			)...)
+		return
+	}
+	logger.Warn("Shadow rule set would have allowed a request blocked by the WAF",
+		append(fields,
+			zap.Int("rule_id", primary.RuleID),
+			zap.String("action", primary.Action),
+			zap.Ints("shadow_matched_rules", matchedRuleIDs(s.tx)),
+		)...)
+}
+
+// interruptionOf returns the interruption of tx, or the one it would have
+// had if it did not run in detection only mode.
+func interruptionOf(tx types.Transaction) *types.Interruption {
+	if it := tx.Interruption(); it != nil {
+		return it
+	}
+	if d, ok := tx.(interface{ DetectionOnlyInterruption() *types.Interruption }); ok {
+		return d.DetectionOnlyInterruption()
+	}
+	return nil
+}
+
+// matchedRuleIDs returns the IDs of the rules matched in tx.
+func matchedRuleIDs(tx types.Transaction) []int {
+	var ids []int
+	for _, mr := range tx.MatchedRules() {
+		if id := mr.Rule().ID(); id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// shadowWriter passes the response through to w, running the response
+// phases of the shadow transaction on the way.
+type shadowWriter struct {
+	w           http.ResponseWriter
+	shadow      *shadowTransaction
+	proto       string
+	wroteHeader bool
+}
+
+func (sw *shadowWriter) Header() http.Header {
+	return sw.w.Header()
+}
+
+func (sw *shadowWriter) WriteHeader(statusCode int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		if s := sw.shadow; s.active() {
+			for k, vv := range sw.w.Header() {
+				for _, v := range vv {
+					s.tx.AddResponseHeader(k, v)
+				}
+			}
+			s.tx.ProcessResponseHeaders(statusCode, sw.proto)
+		}
+	}
+	sw.w.WriteHeader(statusCode)
+}
+
+func (sw *shadowWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if s := sw.shadow; s.active() && s.tx.IsResponseBodyAccessible() && s.tx.IsResponseBodyProcessable() {
+		// Whatever goes past the body limit is not inspected, like in
+		// the enforcing transaction.
+		if _, _, err := s.tx.WriteResponseBody(b); err != nil {
+			s.err = err
+		}
+	}
+	return sw.w.Write(b)
+}
+
+func (sw *shadowWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{sw}, r)
+}
+
+func (sw *shadowWriter) Flush() {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := sw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+var _ responseWriter = (*shadowWriter)(nil)
@@ -0,0 +1,280 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const (
+	shadowPrimaryDirectives = `SecRuleEngine On
+SecRequestBodyAccess On
+SecRule REQUEST_URI "@beginsWith /primary" "id:101,phase:1,deny,status:403"
+SecRule REQUEST_URI "@beginsWith /both" "id:102,phase:1,deny,status:403"`
+
+	shadowCandidateDirectives = `SecRuleEngine On
+SecRequestBodyAccess On
+SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain
+SecRule REQUEST_URI "@beginsWith /shadow" "id:201,phase:1,deny,status:403"
+SecRule REQUEST_URI "@beginsWith /both" "id:202,phase:1,deny,status:403"
+SecRule ARGS_POST:q "@streq attack" "id:203,phase:2,deny,status:403"
+SecRule RESPONSE_BODY "@contains secret" "id:204,phase:4,deny,status:403"`
+)
+
+func newShadowModule(t *testing.T) (*corazaModule, *observer.ObservedLogs) {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{
+		Directives: shadowPrimaryDirectives,
+		Shadow:     &corazaModule{Directives: shadowCandidateDirectives},
+	}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	m.logger = zap.New(core)
+	return m, logs
+}
+
+func TestShadowRuleSet(t *testing.T) {
+	tests := map[string]struct {
+		method       string
+		target       string
+		body         string
+		response     string
+		wantStatus   int
+		wantMessage  string
+		wantRuleID   int
+		wantRuleKey  string
+		wantBodySeen string
+	}{
+		"shadow would block in request headers": {
+			target:      "/shadow",
+			wantStatus:  http.StatusOK,
+			wantMessage: "Shadow rule set would have blocked a request allowed by the WAF",
+			wantRuleID:  201,
+			wantRuleKey: "shadow_rule_id",
+		},
+		"shadow would block in request body": {
+			method:       http.MethodPost,
+			target:       "/form",
+			body:         "q=attack",
+			wantStatus:   http.StatusOK,
+			wantMessage:  "Shadow rule set would have blocked a request allowed by the WAF",
+			wantRuleID:   203,
+			wantRuleKey:  "shadow_rule_id",
+			wantBodySeen: "q=attack",
+		},
+		"shadow would block in response body": {
+			target:      "/page",
+			response:    "top secret",
+			wantStatus:  http.StatusOK,
+			wantMessage: "Shadow rule set would have blocked a request allowed by the WAF",
+			wantRuleID:  204,
+			wantRuleKey: "shadow_rule_id",
+		},
+		"shadow would allow": {
+			target:      "/primary",
+			wantStatus:  http.StatusForbidden,
+			wantMessage: "Shadow rule set would have allowed a request blocked by the WAF",
+			wantRuleID:  101,
+			wantRuleKey: "rule_id",
+		},
+		"both block": {
+			target:     "/both",
+			wantStatus: http.StatusForbidden,
+		},
+		"both allow": {
+			target:     "/ok",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, logs := newShadowModule(t)
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := newServeHTTPRequest(method, test.target, strings.NewReader(test.body))
+			if test.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			rec := httptest.NewRecorder()
+
+			var bodySeen string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				b, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				bodySeen = string(b)
+				w.Header().Set("Content-Type", "text/plain")
+				_, err = w.Write([]byte(test.response))
+				return err
+			})
+
+			err := m.ServeHTTP(rec, req, next)
+			if test.wantStatus == http.StatusOK {
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, rec.Code)
+				require.Equal(t, test.response, rec.Body.String())
+			} else {
+				var herr caddyhttp.HandlerError
+				require.ErrorAs(t, err, &herr)
+				require.Equal(t, test.wantStatus, herr.StatusCode)
+			}
+			if test.wantBodySeen != "" {
+				require.Equal(t, test.wantBodySeen, bodySeen)
+			}
+
+			if test.wantMessage == "" {
+				require.Zero(t, logs.FilterMessageSnippet("Shadow rule set").Len())
+				return
+			}
+			entries := logs.FilterMessage(test.wantMessage).All()
+			require.Len(t, entries, 1)
+			require.Equal(t, int64(test.wantRuleID), entries[0].ContextMap()[test.wantRuleKey])
+			fields := entries[0].ContextMap()
+			require.NotEmpty(t, fields["unique_id"])
+			require.Equal(t, fields["unique_id"].(string)+"-shadow", fields["shadow_unique_id"])
+		})
+	}
+}
+
+func TestShadowRuleSetIsDetectionOnly(t *testing.T) {
+	m, _ := newShadowModule(t)
+	require.True(t, m.Shadow.detectionOnly)
+	require.NotEqual(t, m.poolKey, m.Shadow.poolKey)
+
+	tx := m.Shadow.waf.NewTransaction()
+	defer tx.Close()
+	it, err := processRequest(tx, httptest.NewRequest(http.MethodGet, "/shadow", nil))
+	require.NoError(t, err)
+	require.Nil(t, it, "shadow rule sets must not interrupt")
+	require.NotNil(t, interruptionOf(tx))
+	require.Equal(t, 201, interruptionOf(tx).RuleID)
+}
+
+func TestUnmarshalShadow(t *testing.T) {
+	tests := map[string]struct {
+		config    string
+		shouldErr bool
+	}{
+		"valid shadow": {
+			config: `coraza_waf {
+				directives ` + "`SecRuleEngine On`" + `
+				shadow {
+					load_owasp_crs
+					crs {
+						paranoia_level 2
+					}
+					directives ` + "`Include @owasp_crs/*.conf`" + `
+				}
+			}`,
+		},
+		"shadow using a profile": {
+			config: `coraza_waf {
+				use strict
+				shadow {
+					use candidate
+				}
+			}`,
+		},
+		"shadow with argument": {
+			config: `coraza_waf {
+				shadow candidate
+			}`,
+			shouldErr: true,
+		},
+		"nested shadow": {
+			config: `coraza_waf {
+				shadow {
+					shadow {
+						directives ` + "`SecRuleEngine On`" + `
+					}
+				}
+			}`,
+			shouldErr: true,
+		},
+		"two shadows": {
+			config: `coraza_waf {
+				shadow {
+					directives ` + "`SecRuleEngine On`" + `
+				}
+				shadow {
+					directives ` + "`SecRuleEngine On`" + `
+				}
+			}`,
+			shouldErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &corazaModule{}
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.config))
+			if test.shouldErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, m.Shadow)
+		})
+	}
+}
+
+func TestProvisionRejectsNestedShadow(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	m := &corazaModule{
+		Directives: "SecRuleEngine On",
+		Shadow:     &corazaModule{Shadow: &corazaModule{}},
+	}
+	require.ErrorContains(t, m.Provision(ctx), "cannot have a shadow")
+}
+
+func TestShadowRuleSetDoesNotStoreCollections(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	m := &corazaModule{
+		Directives:     fmt.Sprintf(rateLimitDirectives, 5),
+		Shadow:         &corazaModule{Directives: fmt.Sprintf(rateLimitDirectives, 2)},
+		CollectionsRaw: json.RawMessage(`{"backend": "memory", "name": "test-shadow"}`),
+	}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+	core, logs := observer.New(zapcore.WarnLevel)
+	m.logger = zap.New(core)
+
+	for range 3 {
+		require.Equal(t, http.StatusOK, statusOf(t, m, "/"))
+	}
+
+	vars, err := m.collections.Load(context.Background(), "ip", "192.0.2.1")
+	require.NoError(t, err)
+	require.Equal(t, "3", vars["hits"], "only the enforcing transactions are counted")
+	entries := logs.FilterMessage("Shadow rule set would have blocked a request allowed by the WAF").All()
+	require.Len(t, entries, 1, "the shadow transactions read the stored counter")
+	require.Equal(t, int64(3), entries[0].ContextMap()["shadow_rule_id"])
+}
@@ -0,0 +1,39 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import "sync/atomic"
+
+// wafStats counts the requests seen by the handlers sharing a pooled WAF.
+// It outlives rule reloads, which swap the WAF but not the pool entry.
+type wafStats struct {
+	// transactions is the number of requests handled, whether their
+	// rules were evaluated or not.
+	transactions atomic.Uint64
+	// skipped is the number of requests left out by sampling.
+	skipped atomic.Uint64
+	// interrupted is the number of transactions interrupted by the rules.
+	interrupted atomic.Uint64
+}
+
+// countTransaction records a request, skipped tells whether sampling left
+// it out. It is a no-op on a nil receiver.
+func (s *wafStats) countTransaction(skipped bool) {
+	if s == nil {
+		return
+	}
+	s.transactions.Add(1)
+	if skipped {
+		s.skipped.Add(1)
+	}
+}
+
+// countInterruption records an interrupted transaction. It is a no-op on a
+// nil receiver.
+func (s *wafStats) countInterruption() {
+	if s == nil {
+		return
+	}
+	s.interrupted.Add(1)
+}
@@ -0,0 +1,83 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+
+	"github.com/corazawaf/coraza/v3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/corazawaf/coraza-caddy/v2"
+
+// phaseSpans traces the phases of a transaction as children of the span of
+// the request, the one of Caddy's tracing handler. A nil *phaseSpans traces
+// nothing.
+type phaseSpans struct {
+	ctx    context.Context
+	tracer trace.Tracer
+	tx     types.Transaction
+}
+
+// newPhaseSpans returns the phaseSpans of tx, or nil when the request is
+// not traced.
+func newPhaseSpans(ctx context.Context, tx types.Transaction) *phaseSpans {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.SpanContext().IsValid() {
+		return nil
+	}
+	// Spans go to the tracer provider of the tracing handler, not to the
+	// global one.
+	return &phaseSpans{
+		ctx:    ctx,
+		tracer: parent.TracerProvider().Tracer(tracerName),
+		tx:     tx,
+	}
+}
+
+// start starts the span of phase, the returned function ends it with the
+// outcome of the phase and err, if any.
+func (s *phaseSpans) start(phase types.RulePhase) func(err error) {
+	if s == nil {
+		return func(error) {}
+	}
+	_, span := s.tracer.Start(s.ctx, "waf."+phaseName(phase),
+		trace.WithAttributes(attribute.String("waf.transaction_id", s.tx.ID())))
+	return func(err error) {
+		span.SetAttributes(s.attributes(phase)...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// attributes describes the interruption of the transaction, if any, and
+// the rules of phase that matched.
+func (s *phaseSpans) attributes(phase types.RulePhase) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.Bool("waf.interrupted", s.tx.IsInterrupted())}
+	if it := s.tx.Interruption(); it != nil {
+		attrs = append(attrs,
+			attribute.Int("waf.interruption.rule_id", it.RuleID),
+			attribute.String("waf.interruption.action", it.Action),
+			attribute.Int("waf.interruption.status", obtainStatusCodeFromInterruptionOrDefault(it, 0)),
+		)
+	}
+	var ids []int
+	for _, mr := range s.tx.MatchedRules() {
+		// Like http.waf.matched_rules, rules without a message such as
+		// setup SecActions are left out.
+		if id := mr.Rule().ID(); id != 0 && mr.Rule().Phase() == phase && mr.Message() != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		attrs = append(attrs, attribute.IntSlice("waf.matched_rule_ids", ids))
+	}
+	return attrs
+}
@@ -0,0 +1,154 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestServeHTTPTracesPhases(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{Directives: `SecRuleEngine On
+SecRequestBodyAccess On
+SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain
+SecRule REQUEST_URI "@contains attack" "id:101,phase:1,deny,status:403,msg:'attack in uri'"
+SecRule ARGS_POST "@contains attack" "id:102,phase:2,deny,status:403,msg:'attack in body'"
+SecRule REQUEST_HEADERS:X-Suspicious "@eq 1" "id:103,phase:1,pass,log,msg:'suspicious'"
+SecRule RESPONSE_BODY "@contains secret" "id:104,phase:4,deny,status:403,msg:'leak'"`}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		_, err := w.Write([]byte(r.URL.Query().Get("body")))
+		return err
+	})
+
+	type span struct {
+		interrupted bool
+		ruleID      int64
+		matched     []int64
+	}
+	tests := map[string]struct {
+		method string
+		target string
+		body   string
+		header string
+		spans  map[string]span
+	}{
+		"allowed": {
+			method: http.MethodPost,
+			target: "/?body=hello",
+			body:   "q=fine",
+			header: "1",
+			spans: map[string]span{
+				"waf.request_headers":  {matched: []int64{103}},
+				"waf.request_body":     {},
+				"waf.response_headers": {},
+				"waf.response_body":    {},
+				"waf.logging":          {},
+			},
+		},
+		"interrupted in request headers": {
+			method: http.MethodGet,
+			target: "/attack",
+			spans: map[string]span{
+				"waf.request_headers": {interrupted: true, ruleID: 101, matched: []int64{101}},
+				"waf.logging":         {interrupted: true, ruleID: 101},
+			},
+		},
+		"interrupted in request body": {
+			method: http.MethodPost,
+			target: "/",
+			body:   "q=attack",
+			spans: map[string]span{
+				"waf.request_headers": {},
+				"waf.request_body":    {interrupted: true, ruleID: 102, matched: []int64{102}},
+				"waf.logging":         {interrupted: true, ruleID: 102},
+			},
+		},
+		"interrupted in response body": {
+			method: http.MethodGet,
+			target: "/?body=secret",
+			spans: map[string]span{
+				"waf.request_headers":  {},
+				"waf.request_body":     {},
+				"waf.response_headers": {},
+				"waf.response_body":    {interrupted: true, ruleID: 104, matched: []int64{104}},
+				"waf.logging":          {interrupted: true, ruleID: 104},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+
+			req := newServeHTTPRequest(test.method, test.target, strings.NewReader(test.body))
+			if test.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if test.header != "" {
+				req.Header.Set("X-Suspicious", test.header)
+			}
+			reqCtx, parent := provider.Tracer("test").Start(req.Context(), "request")
+			req = req.WithContext(reqCtx)
+
+			_ = m.ServeHTTP(httptest.NewRecorder(), req, next)
+			parent.End()
+
+			got := map[string]span{}
+			var txID string
+			for _, s := range exporter.GetSpans() {
+				if s.Name == "request" {
+					continue
+				}
+				require.Equal(t, parent.SpanContext().SpanID(), s.Parent.SpanID(), "span %s", s.Name)
+				var sp span
+				for _, attr := range s.Attributes {
+					switch attr.Key {
+					case "waf.transaction_id":
+						if txID == "" {
+							txID = attr.Value.AsString()
+						}
+						require.Equal(t, txID, attr.Value.AsString())
+					case "waf.interrupted":
+						sp.interrupted = attr.Value.AsBool()
+					case "waf.interruption.rule_id":
+						sp.ruleID = attr.Value.AsInt64()
+					case "waf.matched_rule_ids":
+						sp.matched = attr.Value.AsInt64Slice()
+					}
+				}
+				got[s.Name] = sp
+			}
+			require.NotEmpty(t, txID)
+			require.Equal(t, test.spans, got)
+		})
+	}
+}
+
+func TestPhaseSpansWithoutTracing(t *testing.T) {
+	require.Nil(t, newPhaseSpans(context.Background(), nil))
+
+	// A nil *phaseSpans traces nothing.
+	var spans *phaseSpans
+	spans.start(types.PhaseRequestHeaders)(nil)
+}
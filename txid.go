@@ -0,0 +1,74 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	// txIDRandom is a random string from crypto/rand.
+	txIDRandom = "random"
+	// txIDUUIDv7 is a time ordered UUID.
+	txIDUUIDv7 = "uuidv7"
+	// txIDCaddyUUID is {http.request.uuid}, the ID Caddy logs in its
+	// access logs.
+	txIDCaddyUUID = "caddy_uuid"
+	// txIDHeader is taken from a request header, set by a trusted proxy.
+	txIDHeader = "header"
+)
+
+// maxHeaderTxIDLength is the length past which IDs from request headers
+// are ignored.
+const maxHeaderTxIDLength = 128
+
+// headerTxIDRegex matches the IDs accepted from request headers. They end
+// up in logs and in the file names of the concurrent audit log, so they are
+// limited to characters safe in both.
+var headerTxIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// validateTransactionID checks the transaction ID settings of the module.
+func (m *corazaModule) validateTransactionID() error {
+	switch m.TransactionID {
+	case "", txIDRandom, txIDUUIDv7, txIDCaddyUUID:
+		if m.TransactionIDHeader != "" {
+			return fmt.Errorf("transaction_id_header requires transaction_id %q", txIDHeader)
+		}
+	case txIDHeader:
+		if m.TransactionIDHeader == "" {
+			return fmt.Errorf("transaction_id %q requires transaction_id_header", txIDHeader)
+		}
+	default:
+		return fmt.Errorf("invalid transaction_id %q, must be one of %s, %s, %s or %s",
+			m.TransactionID, txIDRandom, txIDUUIDv7, txIDCaddyUUID, txIDHeader)
+	}
+	return nil
+}
+
+// newTransactionID returns the ID of the transaction for r. Whenever the
+// configured source has no usable ID, a random one is used.
+func (m *corazaModule) newTransactionID(r *http.Request) string {
+	switch m.TransactionID {
+	case txIDUUIDv7:
+		if id, err := uuid.NewV7(); err == nil {
+			return id.String()
+		}
+	case txIDCaddyUUID:
+		if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+			if id, ok := repl.GetString("http.request.uuid"); ok && id != "" {
+				return id
+			}
+		}
+	case txIDHeader:
+		if id := r.Header.Get(m.TransactionIDHeader); len(id) <= maxHeaderTxIDLength && headerTxIDRegex.MatchString(id) {
+			return id
+		}
+	}
+	return randomString(16)
+}
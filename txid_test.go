@@ -0,0 +1,177 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTransactionID(t *testing.T) {
+	isRandom := func(t *testing.T, id string) {
+		t.Helper()
+		require.Len(t, id, 16)
+		require.Equal(t, -1, strings.IndexFunc(id, func(r rune) bool {
+			return !strings.ContainsRune(letterBytes, r)
+		}))
+	}
+
+	tests := map[string]struct {
+		module  corazaModule
+		request func(*http.Request)
+		check   func(*testing.T, *http.Request, string)
+	}{
+		"default": {
+			check: func(t *testing.T, _ *http.Request, id string) { isRandom(t, id) },
+		},
+		"random": {
+			module: corazaModule{TransactionID: txIDRandom},
+			check:  func(t *testing.T, _ *http.Request, id string) { isRandom(t, id) },
+		},
+		"uuidv7": {
+			module: corazaModule{TransactionID: txIDUUIDv7},
+			check: func(t *testing.T, _ *http.Request, id string) {
+				u, err := uuid.Parse(id)
+				require.NoError(t, err)
+				require.Equal(t, uuid.Version(7), u.Version())
+			},
+		},
+		"caddy uuid": {
+			module: corazaModule{TransactionID: txIDCaddyUUID},
+			request: func(r *http.Request) {
+				ctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{})
+				ctx = context.WithValue(ctx, caddyhttp.ExtraLogFieldsCtxKey, new(caddyhttp.ExtraLogFields))
+				*r = *r.WithContext(ctx)
+				caddyhttp.NewTestReplacer(r)
+			},
+			check: func(t *testing.T, r *http.Request, id string) {
+				repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+				want, ok := repl.GetString("http.request.uuid")
+				require.True(t, ok)
+				require.Equal(t, want, id)
+			},
+		},
+		"caddy uuid without replacer": {
+			module: corazaModule{TransactionID: txIDCaddyUUID},
+			check:  func(t *testing.T, _ *http.Request, id string) { isRandom(t, id) },
+		},
+		"header": {
+			module: corazaModule{TransactionID: txIDHeader, TransactionIDHeader: "X-Request-Id"},
+			request: func(r *http.Request) {
+				r.Header.Set("X-Request-Id", "lb-1234.abcd:5678")
+			},
+			check: func(t *testing.T, _ *http.Request, id string) {
+				require.Equal(t, "lb-1234.abcd:5678", id)
+			},
+		},
+		"missing header": {
+			module: corazaModule{TransactionID: txIDHeader, TransactionIDHeader: "X-Request-Id"},
+			check:  func(t *testing.T, _ *http.Request, id string) { isRandom(t, id) },
+		},
+		"unsafe header": {
+			module: corazaModule{TransactionID: txIDHeader, TransactionIDHeader: "X-Request-Id"},
+			request: func(r *http.Request) {
+				r.Header.Set("X-Request-Id", "../../etc/passwd")
+			},
+			check: func(t *testing.T, _ *http.Request, id string) { isRandom(t, id) },
+		},
+		"long header": {
+			module: corazaModule{TransactionID: txIDHeader, TransactionIDHeader: "X-Request-Id"},
+			request: func(r *http.Request) {
+				r.Header.Set("X-Request-Id", strings.Repeat("a", maxHeaderTxIDLength+1))
+			},
+			check: func(t *testing.T, _ *http.Request, id string) { isRandom(t, id) },
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.request != nil {
+				test.request(req)
+			}
+			test.check(t, req, test.module.newTransactionID(req))
+		})
+	}
+}
+
+func TestValidateTransactionID(t *testing.T) {
+	tests := map[string]struct {
+		module corazaModule
+		errMsg string
+	}{
+		"default":             {},
+		"uuidv7":              {module: corazaModule{TransactionID: txIDUUIDv7}},
+		"header":              {module: corazaModule{TransactionID: txIDHeader, TransactionIDHeader: "X-Request-Id"}},
+		"unknown source":      {module: corazaModule{TransactionID: "uuidv4"}, errMsg: "invalid transaction_id"},
+		"header without name": {module: corazaModule{TransactionID: txIDHeader}, errMsg: "requires transaction_id_header"},
+		"name without header": {module: corazaModule{TransactionIDHeader: "X-Request-Id"}, errMsg: "requires transaction_id"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.module.validateTransactionID()
+			if test.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, test.errMsg)
+		})
+	}
+}
+
+func TestServeHTTPEchoesTransactionID(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	m := &corazaModule{
+		Directives: `SecRuleEngine On
+SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain
+SecRule REQUEST_URI "@contains attack" "id:1,phase:1,deny,status:403"
+SecRule RESPONSE_BODY "@contains secret" "id:2,phase:4,deny,status:403"`,
+		TransactionID:               txIDHeader,
+		TransactionIDHeader:         "X-Request-Id",
+		TransactionIDResponseHeader: "X-Request-Id",
+	}
+	require.NoError(t, m.Provision(ctx))
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	tests := map[string]struct {
+		target string
+		body   string
+	}{
+		"allowed":             {target: "/", body: "hello"},
+		"blocked in request":  {target: "/attack", body: "hello"},
+		"blocked in response": {target: "/", body: "top secret"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := newServeHTTPRequest(http.MethodGet, test.target, nil)
+			req.Header.Set("X-Request-Id", "lb-42")
+			rec := httptest.NewRecorder()
+
+			_ = m.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("X-Upstream", "app")
+				_, err := w.Write([]byte(test.body))
+				return err
+			}))
+
+			require.Equal(t, "lb-42", rec.Header().Get("X-Request-Id"))
+			repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			id, _ := repl.GetString("http.transaction_id")
+			require.Equal(t, "lb-42", id)
+		})
+	}
+}
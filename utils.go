@@ -4,51 +4,43 @@
 package coraza
 
 import (
-	"math/rand"
+	"crypto/rand"
 	"net"
 	"net/http"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-const (
-	letterIdxBits = 6                    // 6 bits to represent a letter index
-	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
-)
 
-var src = rand.NewSource(time.Now().UnixNano())
-var mu sync.Mutex
+// letterIdxMask keeps the 6 bits needed to index letterBytes.
+const letterIdxMask = 1<<6 - 1
 
-// RandomString returns a pseudorandom string of length n.
-// It is safe to use this function in concurrent environments.
-// Implementation from https://stackoverflow.com/a/31832326
-// This is taken from Coraza code as a workaround for ID
+// randomString returns a random string of length n made of letters, read
+// from crypto/rand. It is safe to use this function in concurrent
+// environments.
 func randomString(n int) string {
-	sb := strings.Builder{}
-	sb.Grow(n)
-
-	mu.Lock()
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			sb.WriteByte(letterBytes[idx])
-			i--
+	b := make([]byte, n)
+	buf := make([]byte, n+n/4)
+	for i := 0; i < n; {
+		// crypto/rand.Read never returns an error.
+		_, _ = rand.Read(buf)
+		for _, c := range buf {
+			// Values past the alphabet are dropped rather than wrapped
+			// around, which would make the first letters more likely.
+			if idx := int(c & letterIdxMask); idx < len(letterBytes) {
+				b[i] = letterBytes[idx]
+				if i++; i == n {
+					break
+				}
+			}
 		}
-		cache >>= letterIdxBits
-		remain--
 	}
-	mu.Unlock()
-
-	return sb.String()
+	return string(b)
 }
 
 func getClientAddress(req *http.Request) (string, int) {
@@ -80,3 +72,31 @@ func getClientAddress(req *http.Request) (string, int) {
 	return clientIp, clientPort
 
 }
+
+// moduleVersion returns the version of the Go module at path the binary is
+// built with, or "unknown".
+func moduleVersion(path string) string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path != path {
+				continue
+			}
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// corazaVersion is the version of Coraza the binary is built with.
+var corazaVersion = sync.OnceValue(func() string {
+	return moduleVersion("github.com/corazawaf/coraza/v3")
+})
+
+// crsVersion is the version of the OWASP Core Rule Set embedded in the
+// binary.
+var crsVersion = sync.OnceValue(func() string {
+	return moduleVersion("github.com/corazawaf/coraza-coreruleset/v4")
+})
@@ -49,3 +49,18 @@ func TestParsegClientAddress(t *testing.T) {
 	require.Equal(t, clientIp, ip)
 	require.Equal(t, 0, port)
 }
+
+func TestRandomString(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		s := randomString(16)
+		require.Len(t, s, 16)
+		for _, c := range s {
+			require.Contains(t, letterBytes, string(c))
+		}
+		require.False(t, seen[s], "duplicate ID %q", s)
+		seen[s] = true
+	}
+	require.Len(t, randomString(1), 1)
+	require.Len(t, randomString(100), 100)
+}
@@ -0,0 +1,153 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/debuglog"
+)
+
+// parsingDirectiveMsg is the debug message the Coraza parser logs right
+// before evaluating each directive.
+const parsingDirectiveMsg = "Parsing directive"
+
+// ruleIDRegex extracts the id action out of a SecRule or SecAction.
+var ruleIDRegex = regexp.MustCompile(`(?:^|[\s,"'])id\s*:\s*'?(\d+)`)
+
+// errStopWalking is used to stop walking the directives once the one being
+// looked for was found.
+var errStopWalking = errors.New("stop walking")
+
+// directiveError is a WAF compilation error along with the location of the
+// directive that caused it.
+type directiveError struct {
+	directive
+	ruleID int
+	err    error
+}
+
+func (e *directiveError) Error() string {
+	var sb strings.Builder
+	if e.file == inlineFile {
+		sb.WriteString("directives")
+	} else {
+		sb.WriteString(e.file)
+	}
+	fmt.Fprintf(&sb, ":%d", e.line)
+	if e.ruleID != 0 {
+		fmt.Fprintf(&sb, " (rule id %d)", e.ruleID)
+	}
+	sb.WriteString(": ")
+	sb.WriteString(e.err.Error())
+	return sb.String()
+}
+
+func (e *directiveError) Unwrap() error {
+	return e.err
+}
+
+// locateError finds the directive that made the compilation of config fail
+// with err. Coraza does not report where an error comes from, so the rules
+// are compiled again counting the directives the parser goes through, and
+// the directives are then walked up to that same position. err is returned
+// as-is if it does not come from the parser or cannot be located.
+func (m *corazaModule) locateError(config coraza.WAFConfig, err error) error {
+	if !strings.HasPrefix(err.Error(), "invalid WAF config from") {
+		return err
+	}
+
+	counter := &directiveCounter{count: new(int)}
+	if waf, cerr := coraza.NewWAF(config.WithDebugLogger(counter)); cerr == nil {
+		// Should not happen, the same config failed to compile already.
+		if c, ok := waf.(io.Closer); ok {
+			_ = c.Close()
+		}
+		return err
+	}
+
+	var (
+		i     int
+		found *directive
+	)
+	w := &directiveWalker{
+		root: ruleFS(m.LoadOWASPCRS),
+		onDirective: func(d directive) error {
+			i++
+			if i == *counter.count {
+				found = &d
+				return errStopWalking
+			}
+			return nil
+		},
+	}
+	// The CRS setup actions are defined first, they cannot fail to
+	// compile but still count.
+	crs, _ := m.crsDirectives()
+	werr := w.walk(crs, crsSettingsFile, "")
+	if werr == nil {
+		werr = w.walkString(m.Directives)
+	}
+	if werr == nil {
+		for _, inc := range m.Include {
+			if werr = w.walkInclude(inc, ""); werr != nil {
+				break
+			}
+		}
+	}
+
+	if found == nil {
+		return err
+	}
+
+	derr := &directiveError{directive: *found, err: err}
+	if modSecCollectionRegex.MatchString(found.text) {
+		derr.err = fmt.Errorf("%w: %w", err, errModSecCollection)
+	}
+	if match := ruleIDRegex.FindStringSubmatch(found.text); match != nil {
+		derr.ruleID, _ = strconv.Atoi(match[1])
+	}
+	return derr
+}
+
+// directiveCounter is a debuglog.Logger that discards everything but counts
+// the directives evaluated by the Coraza parser.
+type directiveCounter struct {
+	count *int
+}
+
+var _ debuglog.Logger = (*directiveCounter)(nil)
+
+func (c *directiveCounter) WithOutput(io.Writer) debuglog.Logger          { return c }
+func (c *directiveCounter) WithLevel(debuglog.Level) debuglog.Logger      { return c }
+func (c *directiveCounter) With(...debuglog.ContextField) debuglog.Logger { return c }
+func (c *directiveCounter) Trace() debuglog.Event                         { return noopEvent{} }
+func (c *directiveCounter) Debug() debuglog.Event                         { return counterEvent{c.count} }
+func (c *directiveCounter) Info() debuglog.Event                          { return noopEvent{} }
+func (c *directiveCounter) Warn() debuglog.Event                          { return noopEvent{} }
+func (c *directiveCounter) Error() debuglog.Event                         { return noopEvent{} }
+
+// counterEvent increments count every time a directive is parsed.
+type counterEvent struct {
+	count *int
+}
+
+func (e counterEvent) Msg(msg string) {
+	if msg == parsingDirectiveMsg {
+		*e.count++
+	}
+}
+func (e counterEvent) Str(string, string) debuglog.Event            { return e }
+func (e counterEvent) Err(error) debuglog.Event                     { return e }
+func (e counterEvent) Bool(string, bool) debuglog.Event             { return e }
+func (e counterEvent) Int(string, int) debuglog.Event               { return e }
+func (e counterEvent) Uint(string, uint) debuglog.Event             { return e }
+func (e counterEvent) Stringer(string, fmt.Stringer) debuglog.Event { return e }
+func (e counterEvent) IsEnabled() bool                              { return true }
@@ -0,0 +1,190 @@
+// Copyright 2025 The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package coraza
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	tmpDir := t.TempDir()
+	brokenFile := filepath.Join(tmpDir, "broken.conf")
+	require.NoError(t, os.WriteFile(brokenFile, []byte(`
+SecRule REQUEST_URI "/a" "id:10,phase:1,deny"
+
+SecRule REQUEST_URI "/b" \
+	"id:11,phase:1,notanaction"
+`), 0644))
+
+	tests := map[string]struct {
+		module      corazaModule
+		expectedErr string
+	}{
+		"valid directives": {
+			module: corazaModule{Directives: `
+				SecRuleEngine On
+				SecRule REQUEST_URI "/a" "id:1,phase:1,deny"
+			`},
+		},
+		"crs is honored": {
+			module: corazaModule{
+				LoadOWASPCRS: true,
+				Directives:   "Include @coraza.conf-recommended\nInclude @crs-setup.conf.example",
+			},
+		},
+		"crs files without load_owasp_crs": {
+			module:      corazaModule{Directives: "Include @crs-setup.conf.example"},
+			expectedErr: "directives:1: ",
+		},
+		"unknown directive": {
+			module: corazaModule{Directives: `
+				SecRuleEngine On
+				SecUnknownDirective foo
+			`},
+			expectedErr: `directives:3: invalid WAF config from string: unknown directive "secunknowndirective"`,
+		},
+		"broken rule": {
+			module: corazaModule{Directives: `
+				SecRuleEngine On
+				SecRule REQUEST_URI "/a" "id:1,phase:1,deny"
+				SecRule REQUEST_URI "/b" "id:2,phase:1,notanaction"
+			`},
+			expectedErr: "directives:4 (rule id 2): ",
+		},
+		"broken rule in included file": {
+			module: corazaModule{Directives: `
+				SecRuleEngine On
+				Include ` + brokenFile,
+			},
+			expectedErr: brokenFile + ":4 (rule id 11): ",
+		},
+		"broken rule in deprecated include": {
+			module:      corazaModule{Include: []string{filepath.Join(tmpDir, "*.conf")}},
+			expectedErr: brokenFile + ":4 (rule id 11): ",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := validateHandler(t, &test.module)
+			if test.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			require.Contains(t, err.Error(), test.expectedErr)
+		})
+	}
+}
+
+// validateHandler validates a config serving every request through m, the
+// way caddy validate does.
+func validateHandler(t *testing.T, m *corazaModule) error {
+	t.Helper()
+
+	routes := caddyhttp.RouteList{{
+		HandlersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(m, "handler", "waf", nil)},
+	}}
+	server := &caddyhttp.Server{Listen: []string{"localhost:0"}, Routes: routes}
+	app := caddyhttp.App{Servers: map[string]*caddyhttp.Server{"srv0": server}}
+	return caddy.Validate(&caddy.Config{
+		Admin:   &caddy.AdminConfig{Disabled: true},
+		AppsRaw: caddy.ModuleMap{"http": caddyconfig.JSON(app, nil)},
+	})
+}
+
+func TestValidateDoesNotUsePool(t *testing.T) {
+	directives := "SecRuleEngine On\nSecAction \"id:1,phase:1,pass,nolog\""
+
+	t.Run("new rules", func(t *testing.T) {
+		m := &corazaModule{Directives: directives}
+		require.NoError(t, validateHandler(t, m))
+
+		_, exists := wafPool.References(m.computePoolKey())
+		require.False(t, exists, "validation must not register the WAF in the pool")
+	})
+
+	t.Run("broken rule file", func(t *testing.T) {
+		ruleFile := filepath.Join(t.TempDir(), "broken.conf")
+		require.NoError(t, os.WriteFile(ruleFile, []byte(`SecRule REQUEST_URI "/a" "id:1,phase:1,notanaction"`), 0644))
+		before := poolSize()
+
+		err := validateHandler(t, &corazaModule{Directives: "SecRuleEngine On\nInclude " + ruleFile})
+		require.ErrorContains(t, err, ruleFile+":1 (rule id 1): ")
+		require.Equal(t, before, poolSize(), "validation must not register the WAF in the pool")
+	})
+
+	t.Run("not provisioned", func(t *testing.T) {
+		before := poolSize()
+		require.NoError(t, (&corazaModule{Directives: directives}).Validate())
+		require.ErrorContains(t, (&corazaModule{Directives: "SecUnknownDirective foo"}).Validate(), "directives:1: ")
+		require.ErrorContains(t, (&corazaModule{Shadow: &corazaModule{Directives: "SecUnknownDirective foo"}}).Validate(), "shadow: directives:1: ")
+		require.Equal(t, before, poolSize())
+	})
+
+	t.Run("rules of the running config", func(t *testing.T) {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+		running := &corazaModule{Directives: directives}
+		require.NoError(t, running.Provision(ctx))
+		t.Cleanup(func() { require.NoError(t, running.Cleanup()) })
+		running.overrides.disableRules(overrideScope{}, []int{1}, 0, false)
+
+		require.NoError(t, validateHandler(t, &corazaModule{Directives: directives}))
+
+		refs, exists := wafPool.References(running.poolKey)
+		require.True(t, exists)
+		require.Equal(t, 1, refs, "validation must not hold references")
+		require.NotNil(t, running.overrides.info(), "validation must not drop the runtime overrides")
+	})
+}
+
+// poolSize returns the number of WAFs in the pool.
+func poolSize() int {
+	n := 0
+	wafPool.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestProvisionReportsDirectiveLocation(t *testing.T) {
+	m := &corazaModule{Directives: "SecRuleEngine On\nSecRule REQUEST_URI \"/a\" \"id:7,phase:1,notanaction\""}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	err := m.Provision(ctx)
+	require.ErrorContains(t, err, "directives:2 (rule id 7): ")
+}
+
+func TestProvisionReportsModSecCollections(t *testing.T) {
+	tests := map[string]string{
+		"variable": `SecRule IP:hits "@gt 10" "id:1,phase:1,deny"`,
+		"setvar":   `SecAction "id:1,phase:1,pass,setvar:session.seen=1"`,
+	}
+
+	for name, directives := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &corazaModule{Directives: directives}
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			t.Cleanup(cancel)
+
+			err := m.Provision(ctx)
+			require.ErrorIs(t, err, errModSecCollection)
+			require.ErrorContains(t, err, "directives:1 (rule id 1): ")
+		})
+	}
+	require.False(t, modSecCollectionRegex.MatchString(`SecRule TX:ip.hits "@gt 10" "id:1,phase:1,deny,setvar:tx.ip.hits=+1,msg:'User: blocked'"`))
+}